@@ -121,8 +121,10 @@ export async function fetchWithAuth(url: string, options: RequestInit = {}) {
 }
 
 // API functions
-export async function getTopicsWithLimit(limit: number) {
-  const response = await fetchWithAuth(`/chat/topics/limit?n=${limit}`);
+// cursor 为上一页返回的 next_cursor，用于继续加载更早的话题
+export async function getTopicsWithLimit(limit: number, cursor?: string) {
+  const query = cursor ? `&cursor=${encodeURIComponent(cursor)}` : '';
+  const response = await fetchWithAuth(`/chat/topics/limit?n=${limit}${query}`);
   if (!response.ok) {
     const data = await response.json().catch(() => ({}));
     throw new Error(data?.error || 'Failed to fetch topics');
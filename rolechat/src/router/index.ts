@@ -14,6 +14,8 @@ const routes = [
     ]
   },
   { path: '/login', name: 'Login', component: LoginVue },
+  // OpenID Connect 登录完成后后端重定向到这里，令牌在 URL fragment 中
+  { path: '/login/callback', name: 'LoginCallback', component: LoginVue },
   {
     path: '/app',
     component: MainLayout,
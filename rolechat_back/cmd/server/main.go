@@ -15,6 +15,7 @@ import (
 
 	"rolechat_back/internal/app/routes"
 	"rolechat_back/internal/repository"
+	"rolechat_back/internal/service"
 	"rolechat_back/pkg/config"
 	"rolechat_back/pkg/logger"
 )
@@ -36,17 +37,29 @@ func main() {
 		logger.Fatal("Failed to connect to database", "error", err)
 	}
 	logger.Info("Database connected successfully")
+	go func() {
+		if err := repository.BackfillSearchVectors(db); err != nil {
+			logger.Warn("Search index backfill failed", "error", err)
+		}
+	}()
 
 	r := gin.Default()
+	// 登录限流按客户端 IP 计数，只信任配置的反向代理转发的 X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		logger.Fatal("Invalid server.trusted_proxies", "error", err)
+	}
 
 	config_cors := cors.DefaultConfig()
 
 	config_cors.AllowOrigins = []string{"*"}
-	config_cors.AllowMethods = []string{"GET", "POST", "DELETE", "PUT", "OPTIONS"}
+	config_cors.AllowMethods = []string{"GET", "POST", "DELETE", "PUT", "PATCH", "OPTIONS"}
 	config_cors.AllowHeaders = []string{"Origin", "Content-Type", "Authorization"}
+	// 停止与恢复流式回复需要读取生成ID
+	config_cors.ExposeHeaders = []string{"X-Generation-ID"}
 	r.Use(cors.New(config_cors))
 
-	routes.SetupRoutes(r, db, cfg)
+	generations := service.NewGenerationRegistry()
+	routes.SetupRoutes(r, db, cfg, generations)
 	logger.Info("Routes registered successfully")
 
 	srv := &http.Server{
@@ -71,11 +84,21 @@ func main() {
 	<-quit
 	logger.Info("Shutting down server...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// 先停止接受新的生成并等待进行中的回复写入数据库，超时后保存已生成的部分；
+	// 流式连接要等生成结束才会关闭，所以与 Shutdown 同时进行
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer drainCancel()
+	drained := make(chan error, 1)
+	go func() { drained <- generations.Drain(drainCtx) }()
 
+	// 留出时间把生成结束的事件发给仍在连接的客户端
+	ctx, cancel := context.WithTimeout(context.Background(), 65*time.Second)
+	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		logger.Fatal("Server forced to shutdown", "error", err)
+		logger.Warn("Server shutdown timed out", "error", err)
+	}
+	if err := <-drained; err != nil {
+		logger.Warn("Generations cut short by shutdown", "error", err)
 	}
 
 	logger.Info("Server exited properly")
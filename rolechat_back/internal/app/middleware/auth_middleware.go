@@ -1,16 +1,19 @@
 package middleware
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 
-	"rolechat_back/pkg/config"
+	"rolechat_back/internal/service"
 	"rolechat_back/pkg/utils"
 
 	"github.com/gin-gonic/gin"
 )
 
-func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
+// AuthMiddleware accepts access tokens that are validly signed by keys and
+// still honoured by guard, which may be nil to trust the signature alone.
+func AuthMiddleware(keys *utils.KeySet, guard *service.TokenGuard) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -24,19 +27,58 @@ func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 			return
 		}
 
-		tokenString := parts[1]
-		claims, err := utils.ValidateToken(tokenString, cfg.JWT.AccessSecret)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		authenticate(c, keys, guard, parts[1])
+	}
+}
+
+// WebSocketAuthMiddleware also accepts a ticket from POST /api/chat/ws/ticket
+// as ?ticket=, since browsers cannot set headers on WebSocket handshakes.
+func WebSocketAuthMiddleware(keys *utils.KeySet, guard *service.TokenGuard, tickets *service.WSTickets) gin.HandlerFunc {
+	header := AuthMiddleware(keys, guard)
+	return func(c *gin.Context) {
+		ticket := c.Query("ticket")
+		if ticket == "" || c.GetHeader("Authorization") != "" {
+			header(c)
 			return
 		}
-		if claims.TokenType != "access" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "wrong token type"})
+		claims, ok := tickets.Redeem(ticket)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired ticket"})
 			return
 		}
+		allow(c, guard, claims)
+	}
+}
 
-		c.Set("userID", claims.UserID)
-		c.Set("userRole", claims.Role)
-		c.Next()
+func authenticate(c *gin.Context, keys *utils.KeySet, guard *service.TokenGuard, tokenString string) {
+	claims, err := utils.ValidateToken(tokenString, keys)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token"})
+		return
 	}
+	if claims.TokenType != "access" {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "wrong token type"})
+		return
+	}
+	allow(c, guard, claims)
+}
+
+func allow(c *gin.Context, guard *service.TokenGuard, claims *utils.JWTClaims) {
+	role, err := guard.Check(claims)
+	if err != nil {
+		status := http.StatusUnauthorized
+		if errors.Is(err, service.ErrAccountDisabled) {
+			status = http.StatusForbidden
+		} else if !errors.Is(err, service.ErrTokenRevoked) {
+			status = http.StatusInternalServerError
+		}
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Set("userID", claims.UserID)
+	c.Set("userRole", role)
+	c.Set("sessionID", claims.SessionID)
+	c.Set("claims", claims)
+	c.Next()
 }
@@ -1,34 +1,99 @@
 package routes
 
 import (
+	"time"
+
 	"rolechat_back/internal/app/middleware"
 	"rolechat_back/internal/handler"
+	"rolechat_back/internal/models"
 	"rolechat_back/internal/repository"
 	"rolechat_back/internal/service"
 	"rolechat_back/pkg/ai"
 	"rolechat_back/pkg/config"
 	"rolechat_back/pkg/logger"
+	"rolechat_back/pkg/mailer"
+	"rolechat_back/pkg/oidc"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
 )
 
-func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
+// SetupRoutes registers the API. Streamed replies run in generations, which
+// the caller drains on shutdown.
+func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config, generations *service.GenerationRegistry) {
 
+	keys, err := service.NewTokenKeys(cfg.JWT)
+	if err != nil {
+		logger.Fatal("Failed to load JWT signing keys", "error", err)
+	}
 	repo := repository.NewUserRepository(db)
-	userSvc := service.NewUserService(repo, cfg)
-	userHandler := handler.NewUserHandler(userSvc)
+	guard := service.NewTokenGuard(repo, time.Duration(cfg.JWT.AccessExpiresMins)*time.Minute)
+	auditRepo := repository.NewAuditRepository(db)
+	limiter := service.NewLoginLimiter(auditRepo, cfg.Auth.LoginMaxFailures, time.Duration(cfg.Auth.LoginLockoutMins)*time.Minute)
+	userSvc := service.NewUserService(repo, cfg, keys, guard, limiter)
+	mail, err := mailer.New(cfg.Mail)
+	if err != nil {
+		logger.Warn("mail not configured; writing mail to the log", "error", err)
+		mail = &mailer.FileMailer{From: cfg.Mail.From}
+	}
+	accountSvc := service.NewAccountService(repo, mail, guard, cfg)
+	userHandler := handler.NewUserHandler(userSvc, accountSvc)
+	providers := make([]handler.OIDCProvider, 0, len(cfg.OIDC))
+	for _, pc := range cfg.OIDC {
+		if pc.Name == "" || pc.Issuer == "" || pc.ClientID == "" {
+			logger.Warnf("oidc provider %q incomplete; skipped", pc.Name)
+			continue
+		}
+		display := pc.DisplayName
+		if display == "" {
+			display = pc.Name
+		}
+		providers = append(providers, handler.OIDCProvider{
+			Name:        pc.Name,
+			DisplayName: display,
+			Provider: oidc.NewProvider(oidc.Config{
+				Issuer:       pc.Issuer,
+				ClientID:     pc.ClientID,
+				ClientSecret: pc.ClientSecret,
+				RedirectURL:  pc.RedirectURL,
+				Scopes:       pc.Scopes,
+			}, nil),
+		})
+	}
+	oidcHandler := handler.NewOIDCHandler(userSvc, providers, cfg.App.BaseURL, cfg.JWT.RefreshSecret)
 
 	chatRepo := repository.NewChatRepository(db)
-	chatSvc := service.NewChatService(chatRepo)
-	chatHandler := handler.NewChatHandler(chatSvc)
+	notifier := service.NewNotifier()
+	chatSvc := service.NewChatService(chatRepo, notifier)
+	chatHandler := handler.NewChatHandler(chatSvc, cfg.App.ImportMaxMB)
+	shareSvc := service.NewShareService(repository.NewShareRepository(db), chatRepo)
+	shareHandler := handler.NewShareHandler(shareSvc)
+	feedbackSvc := service.NewFeedbackService(repository.NewFeedbackRepository(db), chatRepo)
+	feedbackHandler := handler.NewFeedbackHandler(feedbackSvc)
+	personaSvc := service.NewPersonaService(repository.NewPersonaRepository(db))
+	if err := personaSvc.Load(); err != nil {
+		logger.Warn("load personas failed; using built-in personas", "error", err)
+	}
+	adminSvc := service.NewAdminService(repo, chatRepo, auditRepo, guard)
+	adminHandler := handler.NewAdminHandler(adminSvc, chatSvc, personaSvc)
 	zhipuKey := cfg.APIKey.ZhipuAI
-	var aiHandler *handler.AIHandler
+	var (
+		aiHandler *handler.AIHandler
+		wsHandler *handler.WSHandler
+	)
 	if zhipuKey != "" {
 		zc := ai.NewZhipuClient(zhipuKey)
-		aiSvc := service.NewAIService(chatRepo, zc)
-		aiHandler = handler.NewAIHandler(chatSvc, aiSvc)
+		aiSvc := service.NewAIService(chatRepo, zc, generations, notifier)
+		aiHandler = handler.NewAIHandler(chatSvc, aiSvc, generations)
+		wsHandler = handler.NewWSHandler(chatSvc, aiSvc, generations, notifier, guard, service.NewWSTickets())
+	}
+
+	uploadDir := cfg.App.UploadDir
+	if uploadDir == "" {
+		uploadDir = "uploads"
 	}
+	r.Static("/uploads", uploadDir)
+	r.GET("/.well-known/jwks.json", handler.NewKeysHandler(keys.Access).JWKS)
 
 	api := r.Group("/api")
 	{
@@ -37,21 +102,78 @@ func SetupRoutes(r *gin.Engine, db *gorm.DB, cfg *config.Config) {
 		{
 			auth.POST("/register", userHandler.Register)
 			auth.POST("/login", userHandler.Login)
+			auth.POST("/login/mfa", userHandler.LoginMFA)
 			auth.POST("/refresh", userHandler.Refresh)
+			auth.POST("/logout", userHandler.Logout)
+			auth.POST("/verify-email/request", userHandler.RequestEmailVerification)
+			auth.POST("/verify-email/confirm", userHandler.VerifyEmail)
+			auth.POST("/password-reset/request", userHandler.RequestPasswordReset)
+			auth.POST("/password-reset/confirm", userHandler.ResetPassword)
+			auth.GET("/oidc/providers", oidcHandler.ListProviders)
+			auth.GET("/oidc/:provider/login", oidcHandler.Login)
+			auth.GET("/oidc/:provider/callback", oidcHandler.Callback)
+		}
+		api.GET("/share/:token", shareHandler.GetShared)
+		if wsHandler != nil {
+			api.GET("/chat/ws", middleware.WebSocketAuthMiddleware(keys.Access, guard, wsHandler.Tickets), wsHandler.Serve)
 		}
 
 		secure := api.Group("")
-		secure.Use(middleware.AuthMiddleware(cfg))
+		secure.Use(middleware.AuthMiddleware(keys.Access, guard))
 		secure.GET("/me", userHandler.GetProfile)
+		secure.PATCH("/me", userHandler.UpdateProfile)
+		secure.DELETE("/me", userHandler.DeleteAccount)
+		secure.POST("/me/avatar", userHandler.UploadAvatar)
+		secure.PUT("/me/password", userHandler.ChangePassword)
+		secure.POST("/me/2fa/setup", userHandler.SetupTOTP)
+		secure.POST("/me/2fa/enable", userHandler.EnableTOTP)
+		secure.POST("/me/2fa/disable", userHandler.DisableTOTP)
+		secure.GET("/me/2fa/recovery-codes", userHandler.RecoveryCodesLeft)
+		secure.POST("/me/2fa/recovery-codes", userHandler.RegenerateRecoveryCodes)
+		secure.GET("/auth/sessions", userHandler.ListSessions)
+		secure.DELETE("/auth/sessions", userHandler.RevokeAllSessions)
+		secure.DELETE("/auth/sessions/:jti", userHandler.RevokeSession)
 		secure.POST("/chat/message", chatHandler.SendMessage)
 		secure.GET("/chat/topics", chatHandler.ListTopics)
 		secure.GET("/chat/topics/limit", chatHandler.ListTopicsWithLimit)
+		secure.PUT("/chat/topics/:id", chatHandler.RenameTopic)
+		secure.PATCH("/chat/topics/:id", chatHandler.UpdateTopicMeta)
+		secure.GET("/chat/folders", chatHandler.ListFolders)
+		secure.GET("/chat/tags", chatHandler.ListTags)
+		secure.GET("/chat/search", chatHandler.Search)
 		secure.GET("/chat/topics/:id/messages", chatHandler.ListMessages)
+		secure.GET("/chat/topics/:id/export", chatHandler.ExportTopic)
+		secure.GET("/chat/export", chatHandler.ExportAll)
+		secure.POST("/chat/import", chatHandler.Import)
+		secure.POST("/chat/topics/:id/shares", shareHandler.CreateShare)
+		secure.GET("/chat/topics/:id/shares", shareHandler.ListShares)
+		secure.DELETE("/chat/shares/:shareID", shareHandler.RevokeShare)
+		secure.PUT("/chat/messages/:id/feedback", feedbackHandler.Rate)
+		secure.DELETE("/chat/messages/:id/feedback", feedbackHandler.Clear)
 		if aiHandler != nil {
 			secure.POST("/chat/role-reply", aiHandler.RoleReply)
 			secure.POST("/chat/role-reply/stream", aiHandler.StreamRoleReply)
+			secure.GET("/chat/generations/:id/stream", aiHandler.ResumeGeneration)
+			secure.POST("/chat/generations/:id/stop", aiHandler.StopGeneration)
+			secure.POST("/chat/ws/ticket", wsHandler.IssueTicket)
 		} else {
-			logger.Warn("ZHIPU AI key not configured; /api/chat/role-reply and /api/chat/role-reply/stream not registered")
+			logger.Warn("ZHIPU AI key not configured; AI reply and WebSocket routes not registered")
 		}
+
+		admin := secure.Group("/admin")
+		admin.Use(middleware.RequireRole(models.RoleAdmin))
+		admin.GET("/users", adminHandler.ListUsers)
+		admin.GET("/users/:id", adminHandler.GetUser)
+		admin.PATCH("/users/:id", adminHandler.UpdateUser)
+		admin.GET("/users/:id/topics", adminHandler.ListUserTopics)
+		admin.GET("/topics/:id", adminHandler.GetTopic)
+		admin.GET("/topics/:id/messages", adminHandler.ListTopicMessages)
+		admin.GET("/personas", adminHandler.ListPersonas)
+		admin.POST("/personas", adminHandler.CreatePersona)
+		admin.PUT("/personas/:key", adminHandler.UpdatePersona)
+		admin.DELETE("/personas/:key", adminHandler.DeletePersona)
+		admin.GET("/feedback/stats", feedbackHandler.Stats)
+		admin.GET("/feedback", feedbackHandler.List)
+		admin.GET("/audit", adminHandler.ListAudit)
 	}
 }
@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/internal/service"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// AdminHandler serves /api/admin; the routes are limited to admins by
+// middleware.RequireRole.
+type AdminHandler struct {
+	Admin    service.AdminService
+	Chat     service.ChatService
+	Personas service.PersonaService
+}
+
+func NewAdminHandler(admin service.AdminService, chat service.ChatService, personas service.PersonaService) *AdminHandler {
+	return &AdminHandler{Admin: admin, Chat: chat, Personas: personas}
+}
+
+func adminErrorStatus(err error) int {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return http.StatusNotFound
+	}
+	switch err.Error() {
+	case "persona not found":
+		return http.StatusNotFound
+	case "persona already exists":
+		return http.StatusConflict
+	case "invalid cursor", "invalid role", "invalid status", "cannot change your own role or status",
+		"key must be 1-50 characters", "name too long", "system prompt required", "invalid chunking strategy":
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func adminUserJSON(u *models.User) gin.H {
+	return gin.H{
+		"id":         u.ID,
+		"email":      u.Email,
+		"nickname":   u.Nickname,
+		"role":       u.Role,
+		"status":     u.Status,
+		"created_at": u.CreatedAt,
+	}
+}
+
+func personaJSON(p *models.RolePersona) gin.H {
+	return gin.H{
+		"key":           p.Key,
+		"name":          p.Name,
+		"system_prompt": p.SystemPrompt,
+		"voice":         p.Voice,
+		"chunking":      p.Chunking,
+		"updated_at":    p.UpdatedAt,
+	}
+}
+
+func idParam(c *gin.Context, name string) (uint, bool) {
+	id64, err := strconv.ParseUint(c.Param(name), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return 0, false
+	}
+	return uint(id64), true
+}
+
+// ListUsers searches users by email or nickname (q), role and status,
+// newest first.
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	q := repository.UserQuery{Search: c.Query("q"), Role: c.Query("role"), Status: c.Query("status")}
+	q.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	users, next, err := h.Admin.ListUsers(q, c.Query("cursor"))
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(users))
+	for i := range users {
+		res = append(res, adminUserJSON(&users[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"users": res, "next_cursor": next})
+}
+
+func (h *AdminHandler) GetUser(c *gin.Context) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	u, err := h.Admin.GetUser(id)
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, adminUserJSON(u))
+}
+
+type updateUserRequest struct {
+	Role   *string `json:"role"`
+	Status *string `json:"status"`
+}
+
+func (h *AdminHandler) UpdateUser(c *gin.Context) {
+	adminIDVal, _ := c.Get("userID")
+	adminID := adminIDVal.(uint)
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	var req updateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := h.Admin.UpdateUser(adminID, id, service.UserUpdate{Role: req.Role, Status: req.Status})
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, adminUserJSON(u))
+}
+
+// ListUserTopics lists any user's topics, with the same filters as
+// GET /api/chat/topics.
+func (h *AdminHandler) ListUserTopics(c *gin.Context) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter limit, must be a positive integer"})
+		return
+	}
+	filter, err := topicFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	topics, next, err := h.Chat.ListUserTopics(id, filter, limit, c.Query("cursor"))
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(topics))
+	for i := range topics {
+		res = append(res, topicJSON(&topics[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"topics": res, "next_cursor": next})
+}
+
+// GetTopic shows any topic for moderation, along with its owner.
+func (h *AdminHandler) GetTopic(c *gin.Context) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	t, err := h.Admin.GetTopic(id)
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	res := topicJSON(t)
+	res["user_id"] = t.UserID
+	res["created_at"] = t.CreatedAt
+	c.JSON(http.StatusOK, res)
+}
+
+func (h *AdminHandler) ListTopicMessages(c *gin.Context) {
+	id, ok := idParam(c, "id")
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter limit, must be a positive integer"})
+		return
+	}
+	msgs, next, prev, err := h.Admin.ListTopicMessages(id, limit, c.Query("cursor"))
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(msgs))
+	for _, m := range msgs {
+		res = append(res, gin.H{"id": m.ID, "role": m.Role, "content": m.Content, "status": m.Status, "persona": m.Persona, "model": m.Model, "created_at": m.CreatedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": res, "next_cursor": next, "prev_cursor": prev})
+}
+
+func (h *AdminHandler) ListPersonas(c *gin.Context) {
+	list, err := h.Personas.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(list))
+	for i := range list {
+		res = append(res, personaJSON(&list[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"personas": res})
+}
+
+type personaRequest struct {
+	Key          string  `json:"key"`
+	Name         *string `json:"name"`
+	SystemPrompt *string `json:"system_prompt"`
+	Voice        *string `json:"voice"`
+	Chunking     *string `json:"chunking"`
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func (h *AdminHandler) CreatePersona(c *gin.Context) {
+	var req personaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p := &models.RolePersona{
+		Key:          req.Key,
+		Name:         deref(req.Name),
+		SystemPrompt: deref(req.SystemPrompt),
+		Voice:        deref(req.Voice),
+		Chunking:     deref(req.Chunking),
+	}
+	if err := h.Personas.Create(p); err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, personaJSON(p))
+}
+
+func (h *AdminHandler) UpdatePersona(c *gin.Context) {
+	var req personaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, err := h.Personas.Update(c.Param("key"), service.PersonaUpdate{
+		Name:         req.Name,
+		SystemPrompt: req.SystemPrompt,
+		Voice:        req.Voice,
+		Chunking:     req.Chunking,
+	})
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, personaJSON(p))
+}
+
+func (h *AdminHandler) DeletePersona(c *gin.Context) {
+	if err := h.Personas.Delete(c.Param("key")); err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
+
+// ListAudit returns audit entries, newest first, optionally filtered by
+// event and user_id.
+func (h *AdminHandler) ListAudit(c *gin.Context) {
+	q := repository.AuditQuery{Event: c.Query("event")}
+	if v := c.Query("user_id"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter user_id"})
+			return
+		}
+		q.UserID = uint(id)
+	}
+	q.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	entries, next, err := h.Admin.ListAudit(q, c.Query("cursor"))
+	if err != nil {
+		c.JSON(adminErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, gin.H{
+			"id":         e.ID,
+			"event":      e.Event,
+			"user_id":    e.UserID,
+			"email":      e.Email,
+			"ip":         e.IP,
+			"detail":     e.Detail,
+			"created_at": e.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": res, "next_cursor": next})
+}
@@ -1,20 +1,24 @@
 package handler
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"rolechat_back/internal/models"
 	"rolechat_back/internal/service"
+	"rolechat_back/pkg/logger"
+	"strconv"
 	"strings"
 	"time"
-	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 )
 
 type AIHandler struct {
-	ChatSvc service.ChatService
-	AISvc   service.AIService
+	ChatSvc     service.ChatService
+	AISvc       service.AIService
+	Generations *service.GenerationRegistry
 }
 
 type RoleReplyRequest struct {
@@ -22,19 +26,18 @@ type RoleReplyRequest struct {
 	PersonaName string `json:"persona_name"`
 	RoleID      string `json:"role_id"` // 前端发送的角色ID
 	Content     string `json:"content" binding:"required"`
+	// Stream only: chunking strategy (default, token, sentence, time) and,
+	// for time, the longest a chunk may be held back.
+	Chunking       string `json:"chunking"`
+	ChunkLatencyMs int    `json:"chunk_latency_ms"`
 }
 
-var demoPersonas = map[string]*models.RolePersona{
-	"导师":       {Name: "导师", SystemPrompt: "你是一个耐心的中文导师, 给出循序渐进的讲解, 语言温和。", Voice: "mentor"},
-	"搞笑":       {Name: "搞笑", SystemPrompt: "你是一名幽默搞笑的朋友, 回答要轻松, 可以加表情, 但保持有用信息。", Voice: "fun"},
-	"严肃":       {Name: "严肃", SystemPrompt: "你是一位严谨专业的顾问, 用正式语气回答, 避免多余的感叹。", Voice: "serious"},
-	"hermione": {Name: "赫敏", SystemPrompt: "你就是赫敏·格兰杰本人。请始终用第一人称'我'来回答，绝不使用第三人称。我是格兰芬多学院的学生，哈利和罗恩是我最好的朋友。我聪明博学，热爱学习，来自麻瓜家庭。", Voice: "hermione"},
-	"harry":    {Name: "哈利", SystemPrompt: "你就是哈利·波特本人。请始终用第一人称'我'来回答，绝不使用第三人称。我是哈利·波特，被称为'大难不死的男孩'，格兰芬多学院学生。赫敏和罗恩是我最好的朋友。我在德思礼家长大，经历过很多冒险。", Voice: "harry"},
-	"ron":      {Name: "罗恩", SystemPrompt: "你就是罗恩·韦斯莱本人。请始终用第一人称'我'来回答，绝不使用第三人称。我是罗恩·韦斯莱，来自韦斯莱家族，格兰芬多学院学生。哈利和赫敏是我最好的朋友。我有很多兄弟姐妹，擅长巫师棋。", Voice: "ron"},
+func (r RoleReplyRequest) chunkOptions() service.ChunkOptions {
+	return service.ChunkOptions{Strategy: r.Chunking, MaxLatency: time.Duration(r.ChunkLatencyMs) * time.Millisecond}
 }
 
-func NewAIHandler(chatSvc service.ChatService, aiSvc service.AIService) *AIHandler {
-	return &AIHandler{ChatSvc: chatSvc, AISvc: aiSvc}
+func NewAIHandler(chatSvc service.ChatService, aiSvc service.AIService, generations *service.GenerationRegistry) *AIHandler {
+	return &AIHandler{ChatSvc: chatSvc, AISvc: aiSvc, Generations: generations}
 }
 
 func (h *AIHandler) RoleReply(c *gin.Context) {
@@ -52,28 +55,30 @@ func (h *AIHandler) RoleReply(c *gin.Context) {
 		roleKey = req.PersonaName
 	}
 
-	persona := demoPersonas[roleKey]
+	persona := service.LookupPersona(roleKey)
 	if persona == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role/persona: " + roleKey})
 		return
 	}
 
-	_, userMsg, _, err := h.ChatSvc.AddMessage(userID, req.TopicID, "user", req.Content)
+	topic, userMsg, _, err := h.ChatSvc.AddMessage(userID, req.TopicID, "user", req.Content, roleKey)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	replyText, audio64, err := h.AISvc.GenerateRoleReply(userID, req.TopicID, persona, req.Content)
+	replyText, audio64, model, err := h.AISvc.GenerateRoleReply(userID, topic.ID, persona, req.Content)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	_, assistantMsg, _, err := h.ChatSvc.AddMessage(userID, req.TopicID, "assistant", replyText)
-	if err != nil {
+	assistantMsg := &models.Message{Content: replyText, Persona: roleKey, Model: model}
+	if err := h.ChatSvc.AddReply(userID, topic.ID, assistantMsg); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	go h.generateTitle(topic.ID)
 	c.JSON(http.StatusOK, gin.H{
+		"topic_id":          topic.ID,
 		"user_message":      gin.H{"id": userMsg.ID, "content": userMsg.Content},
 		"assistant_message": gin.H{"id": assistantMsg.ID, "content": assistantMsg.Content},
 		"audio_base64":      audio64,
@@ -96,86 +101,193 @@ func (h *AIHandler) StreamRoleReply(c *gin.Context) {
 		roleKey = req.PersonaName
 	}
 
-	persona := demoPersonas[roleKey]
+	persona := service.LookupPersona(roleKey)
 	if persona == nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role/persona: " + roleKey})
 		return
 	}
+	if _, err := service.NewChunker(req.chunkOptions()); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	topic, _, _, err := h.ChatSvc.AddMessage(userID, req.TopicID, "user", req.Content)
+	topic, userMsg, newTopic, err := h.ChatSvc.AddMessage(userID, req.TopicID, "user", req.Content, roleKey)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	effectiveTopicID := topic.ID
-	tokenCh, errCh, err := h.AISvc.StreamRoleReply(userID, effectiveTopicID, persona, req.Content)
+	gen, err := h.AISvc.StreamRoleReply(service.StreamRequest{
+		UserID:      userID,
+		TopicID:     topic.ID,
+		NewTopic:    newTopic,
+		PersonaKey:  roleKey,
+		UserMessage: userMsg,
+		Chunking:    req.chunkOptions(),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		status := http.StatusInternalServerError
+		if errors.Is(err, service.ErrShuttingDown) {
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	h.streamGeneration(c, gen, 0)
+}
+
+// ResumeGeneration re-attaches to a streamed reply after a dropped connection,
+// replaying the events after Last-Event-ID (or ?last_event_id=) first.
+func (h *AIHandler) ResumeGeneration(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	gen, err := h.Generations.Get(userID, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
 		return
 	}
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_event_id")
+	}
+	after := 0
+	if lastID != "" {
+		if after, err = strconv.Atoi(lastID); err != nil || after < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+	}
+	h.streamGeneration(c, gen, after)
+}
+
+// streamGeneration writes the generation's events after seq as SSE until it
+// ends or the client goes away. The generation keeps running and saves its
+// reply either way.
+func (h *AIHandler) streamGeneration(c *gin.Context, gen *service.Generation, after int) {
 	c.Writer.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	c.Writer.Header().Set("Cache-Control", "no-cache, no-transform")
 	c.Writer.Header().Set("Connection", "keep-alive")
 	c.Writer.Header().Set("X-Accel-Buffering", "no")
+	c.Writer.Header().Set("X-Generation-ID", gen.ID)
 	c.Writer.Flush()
-
-	var builder strings.Builder
-	lastFlushed := 0
-	flush := func(force bool) {
-		current := builder.String()
-		if len(current) == lastFlushed {
-			return
-		}
-		segment := current[lastFlushed:]
-		if !force {
-			rc := utf8.RuneCountInString(segment)
-			if rc < 12 {
-				r, _ := utf8.DecodeLastRuneInString(segment)
-				if !strings.ContainsRune("。！？!?，,；;\n", r) {
-					return
-				}
-			}
-		}
-		esc := strings.ReplaceAll(segment, "\n", "\\n")
-		fmt.Fprintf(c.Writer, "data: %s\n\n", esc)
-		c.Writer.Flush()
-		lastFlushed = len(current)
+	write := writeGenerationEvent
+	if streamProtocol(c) >= 2 {
+		write = writeGenerationEventV2
 	}
 
 	heartbeat := time.NewTicker(10 * time.Second)
 	defer heartbeat.Stop()
 
 	for {
-		select {
-		case tk, ok := <-tokenCh:
-			if !ok {
-				full := builder.String()
-				if full != "" {
-					_, _, _, _ = h.ChatSvc.AddMessage(userID, effectiveTopicID, "assistant", full)
-				}
-				flush(true)
-				fmt.Fprintf(c.Writer, "data: %s\n\n", "[DONE]")
-				c.Writer.Flush()
-				return
-			}
-			builder.WriteString(tk)
-			flush(false)
-		case e, ok := <-errCh:
-			if ok && e != nil {
-				fmt.Fprintf(c.Writer, "event: error\n")
-				fmt.Fprintf(c.Writer, "data: %s\n\n", strings.ReplaceAll(e.Error(), "\n", " "))
-				c.Writer.Flush()
-			}
+		evs, next, finished := gen.EventsAfter(after)
+		for _, ev := range evs {
+			write(c, gen, ev)
+			after = ev.Seq
+		}
+		c.Writer.Flush()
+		if finished {
 			return
+		}
+		select {
+		case <-next:
 		case <-heartbeat.C:
 			fmt.Fprintf(c.Writer, ": ping\n\n")
 			c.Writer.Flush()
 		case <-c.Request.Context().Done():
-			partial := builder.String()
-			if partial != "" && lastFlushed < len(partial) {
-				_, _, _, _ = h.ChatSvc.AddMessage(userID, effectiveTopicID, "assistant", partial)
-			}
 			return
 		}
 	}
 }
+
+// streamProtocol is the SSE format the client asked for with ?protocol= or
+// the X-Stream-Protocol header. Version 1, the default, sends bare text
+// chunks; version 2 sends typed JSON events.
+func streamProtocol(c *gin.Context) int {
+	v := c.Query("protocol")
+	if v == "" {
+		v = c.GetHeader("X-Stream-Protocol")
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 1
+	}
+	return n
+}
+
+// writeGenerationEvent writes ev in the version 1 format: bare text chunks,
+// [DONE] and an error event, as before the protocol was versioned. The
+// generation id comes first in a named generation event, which clients
+// reading only unnamed events or text fields skip, and every event carries
+// its id for resuming; metadata and usage are version 2 only.
+func writeGenerationEvent(c *gin.Context, gen *service.Generation, ev service.GenerationEvent) {
+	switch ev.Type {
+	case service.GenerationStart:
+		data, _ := json.Marshal(gin.H{"generation_id": gen.ID})
+		fmt.Fprintf(c.Writer, "id: %d\nevent: generation\ndata: %s\n\n", ev.Seq, data)
+	case service.GenerationChunk:
+		fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", ev.Seq, strings.ReplaceAll(ev.Text, "\n", "\\n"))
+	case service.GenerationDone:
+		fmt.Fprintf(c.Writer, "id: %d\ndata: %s\n\n", ev.Seq, "[DONE]")
+	case service.GenerationError:
+		fmt.Fprintf(c.Writer, "id: %d\nevent: error\n", ev.Seq)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", strings.ReplaceAll(ev.Text, "\n", " "))
+	}
+}
+
+// writeGenerationEventV2 writes ev as a named event with a JSON payload.
+func writeGenerationEventV2(c *gin.Context, gen *service.Generation, ev service.GenerationEvent) {
+	name, payload := generationEventJSON(gen, ev)
+	if name == "" {
+		return
+	}
+	data, _ := json.Marshal(payload)
+	fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, name, data)
+}
+
+// generationEventJSON maps ev to the event name and payload of the version 2
+// protocol.
+func generationEventJSON(gen *service.Generation, ev service.GenerationEvent) (string, gin.H) {
+	switch ev.Type {
+	case service.GenerationStart:
+		return "meta", gin.H{
+			"v":               2,
+			"generation_id":   gen.ID,
+			"topic_id":        gen.TopicID,
+			"new_topic":       gen.Meta.NewTopic,
+			"user_message_id": gen.Meta.UserMessageID,
+			"message_id":      gen.Meta.ReplyMessageID,
+			"persona":         gen.Meta.Persona,
+			"model":           gen.Meta.Model,
+		}
+	case service.GenerationChunk:
+		return "delta", gin.H{"text": ev.Text}
+	case service.GenerationUsage:
+		return "usage", gin.H{
+			"prompt_tokens":     ev.Usage.PromptTokens,
+			"completion_tokens": ev.Usage.CompletionTokens,
+			"total_tokens":      ev.Usage.TotalTokens,
+		}
+	case service.GenerationDone:
+		return "done", gin.H{"finish_reason": ev.FinishReason, "status": ev.Status, "message_id": ev.MessageID}
+	case service.GenerationError:
+		return "error", gin.H{"code": ev.Code, "message": ev.Text}
+	}
+	return "", nil
+}
+
+// StopGeneration stops a streamed reply started by the current user. The
+// stream itself delivers the partial reply and a final stopped event.
+func (h *AIHandler) StopGeneration(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	if err := h.Generations.Stop(userID, c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stopped": true})
+}
+
+func (h *AIHandler) generateTitle(topicID uint) {
+	if err := h.AISvc.GenerateTopicTitle(topicID); err != nil {
+		logger.Warnf("generate title for topic %d: %v", topicID, err)
+	}
+}
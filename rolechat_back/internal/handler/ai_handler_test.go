@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"rolechat_back/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestWriteGenerationEventV1(t *testing.T) {
+	gen, err := service.NewGenerationRegistry().Start(1, 2, service.GenerationMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		ev   service.GenerationEvent
+		want string
+	}{
+		{"start", service.GenerationEvent{Seq: 1, Type: service.GenerationStart}, "id: 1\nevent: generation\ndata: {\"generation_id\":\"" + gen.ID + "\"}\n\n"},
+		{"chunk", service.GenerationEvent{Seq: 2, Type: service.GenerationChunk, Text: "a\nb"}, "id: 2\ndata: a\\nb\n\n"},
+		{"usage", service.GenerationEvent{Seq: 3, Type: service.GenerationUsage}, ""},
+		{"done", service.GenerationEvent{Seq: 4, Type: service.GenerationDone}, "id: 4\ndata: [DONE]\n\n"},
+		{"error", service.GenerationEvent{Seq: 4, Type: service.GenerationError, Text: "upstream\nfailed"}, "id: 4\nevent: error\ndata: upstream failed\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			writeGenerationEvent(c, gen, tt.ev)
+			if got := w.Body.String(); got != tt.want {
+				t.Fatalf("frame = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,20 +1,37 @@
 package handler
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"time"
 
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
 	"rolechat_back/internal/service"
+	"rolechat_back/pkg/logger"
 
 	"github.com/gin-gonic/gin"
 )
 
 type ChatHandler struct {
 	Chat service.ChatService
+	// MaxImportBytes bounds the body of an import request.
+	MaxImportBytes int64
 }
 
-func NewChatHandler(s service.ChatService) *ChatHandler {
-	return &ChatHandler{Chat: s}
+// NewChatHandler accepts imports of up to maxImportMB megabytes, or 32 if it
+// is not positive.
+func NewChatHandler(s service.ChatService, maxImportMB int) *ChatHandler {
+	if maxImportMB <= 0 {
+		maxImportMB = 32
+	}
+	return &ChatHandler{Chat: s, MaxImportBytes: int64(maxImportMB) << 20}
 }
 
 type sendMessageRequest struct {
@@ -31,7 +48,7 @@ func (h *ChatHandler) SendMessage(c *gin.Context) {
 	}
 	userIDVal, _ := c.Get("userID")
 	userID := userIDVal.(uint)
-	topic, msg, newTopic, err := h.Chat.AddMessage(userID, req.TopicID, req.Role, req.Content)
+	topic, msg, newTopic, err := h.Chat.AddMessage(userID, req.TopicID, req.Role, req.Content, "")
 	if err != nil {
 		status := http.StatusInternalServerError
 		if err.Error() == "forbidden" {
@@ -47,19 +64,180 @@ func (h *ChatHandler) SendMessage(c *gin.Context) {
 	})
 }
 
+type renameTopicRequest struct {
+	Title string `json:"title" binding:"required"`
+}
+
+func (h *ChatHandler) RenameTopic(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req renameTopicRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	topic, err := h.Chat.RenameTopic(userID, uint(id64), req.Title)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.Error() {
+		case "forbidden":
+			status = http.StatusForbidden
+		case "title required":
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"topic": gin.H{"id": topic.ID, "title": topic.Title, "updated_at": topic.UpdatedAt}})
+}
+
+func topicJSON(t *models.Topic) gin.H {
+	tags := make([]string, 0, len(t.Tags))
+	for _, tag := range t.Tags {
+		tags = append(tags, tag.Tag)
+	}
+	return gin.H{
+		"id":         t.ID,
+		"title":      t.Title,
+		"updated_at": t.UpdatedAt,
+		"pinned":     t.Pinned,
+		"favorite":   t.Favorite,
+		"folder":     t.Folder,
+		"tags":       tags,
+	}
+}
+
+func boolQuery(c *gin.Context, key string) (*bool, error) {
+	v, ok := c.GetQuery(key)
+	if !ok || v == "" {
+		return nil, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter %s", key)
+	}
+	return &b, nil
+}
+
+// topicFilter reads pinned/favorite/folder/tag query parameters. An empty
+// folder= selects topics that are not in any folder.
+func topicFilter(c *gin.Context) (service.TopicFilter, error) {
+	var f service.TopicFilter
+	var err error
+	if f.Pinned, err = boolQuery(c, "pinned"); err != nil {
+		return f, err
+	}
+	if f.Favorite, err = boolQuery(c, "favorite"); err != nil {
+		return f, err
+	}
+	if folder, ok := c.GetQuery("folder"); ok {
+		f.Folder = &folder
+	}
+	f.Tag = c.Query("tag")
+	return f, nil
+}
+
 func (h *ChatHandler) ListTopics(c *gin.Context) {
 	userIDVal, _ := c.Get("userID")
 	userID := userIDVal.(uint)
-	topics, err := h.Chat.ListUserTopics(userID, 100, 0)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter limit, must be a positive integer"})
+		return
+	}
+	filter, err := topicFilter(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	topics, next, err := h.Chat.ListUserTopics(userID, filter, limit, c.Query("cursor"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "invalid cursor" {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 	res := make([]gin.H, 0, len(topics))
-	for _, t := range topics {
-		res = append(res, gin.H{"id": t.ID, "title": t.Title, "updated_at": t.UpdatedAt})
+	for i := range topics {
+		res = append(res, topicJSON(&topics[i]))
 	}
-	c.JSON(http.StatusOK, gin.H{"topics": res})
+	c.JSON(http.StatusOK, gin.H{"topics": res, "next_cursor": next})
+}
+
+type updateTopicMetaRequest struct {
+	Pinned   *bool     `json:"pinned"`
+	Favorite *bool     `json:"favorite"`
+	Folder   *string   `json:"folder"`
+	Tags     *[]string `json:"tags"`
+}
+
+func (h *ChatHandler) UpdateTopicMeta(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req updateTopicMetaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	topic, err := h.Chat.UpdateTopicMeta(userID, uint(id64), service.TopicMetaUpdate{
+		Pinned:   req.Pinned,
+		Favorite: req.Favorite,
+		Folder:   req.Folder,
+		Tags:     req.Tags,
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "forbidden" {
+			status = http.StatusForbidden
+		} else if errors.Is(err, service.ErrInvalidTopicMeta) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"topic": topicJSON(topic)})
+}
+
+func labelCountsJSON(counts []repository.LabelCount) []gin.H {
+	res := make([]gin.H, 0, len(counts))
+	for _, lc := range counts {
+		res = append(res, gin.H{"name": lc.Name, "count": lc.Count})
+	}
+	return res
+}
+
+func (h *ChatHandler) ListFolders(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	folders, err := h.Chat.ListFolders(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"folders": labelCountsJSON(folders)})
+}
+
+func (h *ChatHandler) ListTags(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	tags, err := h.Chat.ListTags(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tags": labelCountsJSON(tags)})
 }
 
 func (h *ChatHandler) ListTopicsWithLimit(c *gin.Context) {
@@ -74,26 +252,32 @@ func (h *ChatHandler) ListTopicsWithLimit(c *gin.Context) {
 		return
 	}
 
-	// 限制最大返回数量，防止查询过多数据
-	if limit > 1000 {
-		limit = 1000
+	filter, err := topicFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-
-	topics, err := h.Chat.ListUserTopics(userID, limit, 0)
+	topics, next, err := h.Chat.ListUserTopics(userID, filter, limit, c.Query("cursor"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		status := http.StatusInternalServerError
+		if err.Error() == "invalid cursor" {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 
 	res := make([]gin.H, 0, len(topics))
-	for _, t := range topics {
-		res = append(res, gin.H{"id": t.ID, "title": t.Title, "updated_at": t.UpdatedAt})
+	for i := range topics {
+		res = append(res, topicJSON(&topics[i]))
 	}
 
+	// n 超过单页上限时返回实际使用的上限，更多数据通过 next_cursor 继续翻页
 	c.JSON(http.StatusOK, gin.H{
-		"topics": res,
-		"count":  len(res),
-		"limit":  limit,
+		"topics":      res,
+		"count":       len(res),
+		"limit":       service.TopicPageLimit(limit),
+		"next_cursor": next,
 	})
 }
 
@@ -106,18 +290,233 @@ func (h *ChatHandler) ListMessages(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
 		return
 	}
-	msgs, err := h.Chat.ListTopicMessages(userID, uint(id64), 200, 0)
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "200"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter limit, must be a positive integer"})
+		return
+	}
+	msgs, next, prev, err := h.Chat.ListTopicMessages(userID, uint(id64), limit, c.Query("cursor"))
 	if err != nil {
 		status := http.StatusInternalServerError
-		if err.Error() == "forbidden" {
+		switch err.Error() {
+		case "forbidden":
 			status = http.StatusForbidden
+		case "invalid cursor":
+			status = http.StatusBadRequest
 		}
 		c.JSON(status, gin.H{"error": err.Error()})
 		return
 	}
 	res := make([]gin.H, 0, len(msgs))
 	for _, m := range msgs {
-		res = append(res, gin.H{"id": m.ID, "role": m.Role, "content": m.Content, "created_at": m.CreatedAt})
+		res = append(res, gin.H{"id": m.ID, "role": m.Role, "content": m.Content, "status": m.Status, "created_at": m.CreatedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": res, "next_cursor": next, "prev_cursor": prev})
+}
+
+// parseDateParam accepts RFC 3339 timestamps or plain dates. A plain date used
+// as an upper bound covers the whole day.
+func parseDateParam(v string, endOfDay bool) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		return nil, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return &t, nil
+}
+
+func (h *ChatHandler) Search(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	from, err := parseDateParam(c.Query("from"), false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter from"})
+		return
+	}
+	to, err := parseDateParam(c.Query("to"), true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter to"})
+		return
+	}
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	results, next, err := h.Chat.Search(userID, service.SearchOptions{
+		Query:    c.Query("q"),
+		Persona:  c.Query("persona"),
+		From:     from,
+		To:       to,
+		Cursor:   c.Query("cursor"),
+		PageSize: pageSize,
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch err.Error() {
+		case "query required", "invalid cursor":
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(results))
+	for _, r := range results {
+		item := gin.H{
+			"type":        r.Type,
+			"topic_id":    r.TopicID,
+			"topic_title": r.TopicTitle,
+			"snippet":     r.Snippet,
+			"created_at":  r.CreatedAt,
+			"rank":        r.Rank,
+		}
+		if r.Type == "message" {
+			item["message_id"] = r.MessageID
+			item["role"] = r.Role
+			item["persona"] = r.Persona
+		}
+		res = append(res, item)
+	}
+	c.JSON(http.StatusOK, gin.H{"results": res, "next_cursor": next})
+}
+
+var exportContentTypes = map[string]string{
+	service.ExportMarkdown: "text/markdown; charset=utf-8",
+	service.ExportJSON:     "application/json; charset=utf-8",
+	service.ExportText:     "text/plain; charset=utf-8",
+}
+
+func (h *ChatHandler) ExportTopic(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	format := c.DefaultQuery("format", service.ExportMarkdown)
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported format"})
+		return
+	}
+	export, err := h.Chat.ExportTopic(userID, uint(id64))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "forbidden" {
+			status = http.StatusForbidden
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	var buf bytes.Buffer
+	if err := export.Render(&buf, format); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	name := export.FileName(format)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"topic-%d.%s\"; filename*=UTF-8''%s", export.Topic.ID, format, url.PathEscape(name)))
+	c.Data(http.StatusOK, contentType, buf.Bytes())
+}
+
+// ExportAll builds the archive in a temporary file before sending anything,
+// so a failure part way is reported as an error instead of a truncated zip.
+func (h *ChatHandler) ExportAll(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	tmp, err := os.CreateTemp("", "rolechat-export-*.zip")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := h.Chat.ExportAll(userID, tmp); err != nil {
+		logger.Errorf("export data for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "export failed"})
+		return
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = tmp.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	name := fmt.Sprintf("rolechat-export-%s.zip", time.Now().UTC().Format("20060102"))
+	c.DataFromReader(http.StatusOK, size, "application/zip", tmp, map[string]string{
+		"Content-Disposition": fmt.Sprintf("attachment; filename=%q", name),
+	})
+}
+
+// Import accepts one or more uploaded files ("file" fields) holding ChatGPT
+// conversations.json exports or SillyTavern .jsonl chat logs. The source is
+// detected per file unless ?format= is given.
+func (h *ChatHandler) Import(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	format := c.Query("format")
+	if format != "" && format != service.ImportChatGPT && format != service.ImportSillyTavern {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unsupported format"})
+		return
+	}
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.MaxImportBytes)
+	form, err := c.MultipartForm()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("import larger than %d MB", h.MaxImportBytes>>20)})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	files := form.File["file"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "file required"})
+		return
+	}
+	res := make([]gin.H, 0)
+	imported, failed := 0, 0
+	for _, fh := range files {
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		data, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		source := format
+		if source == "" {
+			source = service.DetectImportFormat(data)
+		}
+		convs, err := service.ParseImport(source, data)
+		if err != nil {
+			failed++
+			res = append(res, gin.H{"file": fh.Filename, "source": source, "success": false, "error": err.Error()})
+			continue
+		}
+		for _, r := range h.Chat.Import(userID, source, convs) {
+			item := gin.H{"file": fh.Filename, "index": r.Index, "source": r.Source, "title": r.Title, "success": r.Error == ""}
+			if r.Error != "" {
+				failed++
+				item["error"] = r.Error
+			} else {
+				imported++
+				item["topic_id"] = r.TopicID
+				item["messages"] = r.Messages
+			}
+			res = append(res, item)
+		}
 	}
-	c.JSON(http.StatusOK, gin.H{"messages": res})
+	c.JSON(http.StatusOK, gin.H{"imported": imported, "failed": failed, "results": res})
 }
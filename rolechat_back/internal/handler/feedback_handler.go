@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"rolechat_back/internal/repository"
+	"rolechat_back/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type FeedbackHandler struct {
+	Feedback service.FeedbackService
+}
+
+func NewFeedbackHandler(s service.FeedbackService) *FeedbackHandler {
+	return &FeedbackHandler{Feedback: s}
+}
+
+type rateMessageRequest struct {
+	Rating string `json:"rating" binding:"required,oneof=up down"`
+	Reason string `json:"reason"`
+}
+
+func feedbackErrorStatus(err error) int {
+	switch err.Error() {
+	case "forbidden":
+		return http.StatusForbidden
+	case "invalid rating", "reason too long", "only assistant messages can be rated", "invalid cursor":
+		return http.StatusBadRequest
+	case "record not found":
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func (h *FeedbackHandler) Rate(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req rateMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rating := 1
+	if req.Rating == "down" {
+		rating = -1
+	}
+	f, err := h.Feedback.Rate(userID, uint(id64), rating, req.Reason)
+	if err != nil {
+		c.JSON(feedbackErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message_id": f.MessageID, "rating": req.Rating, "reason": f.Reason})
+}
+
+func (h *FeedbackHandler) Clear(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := h.Feedback.Clear(userID, uint(id64)); err != nil {
+		c.JSON(feedbackErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
+}
+
+// Stats aggregates ratings per persona and model, worst first.
+func (h *FeedbackHandler) Stats(c *gin.Context) {
+	from, err := parseDateParam(c.Query("from"), false)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter from"})
+		return
+	}
+	to, err := parseDateParam(c.Query("to"), true)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid parameter to"})
+		return
+	}
+	stats, err := h.Feedback.Stats(from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(stats))
+	for _, st := range stats {
+		total := st.Up + st.Down
+		downRatio := 0.0
+		if total > 0 {
+			downRatio = float64(st.Down) / float64(total)
+		}
+		res = append(res, gin.H{
+			"persona":    st.Persona,
+			"model":      st.Model,
+			"up":         st.Up,
+			"down":       st.Down,
+			"total":      total,
+			"down_ratio": downRatio,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"stats": res})
+}
+
+// List returns individual ratings with their reasons, newest first.
+func (h *FeedbackHandler) List(c *gin.Context) {
+	q := repository.FeedbackQuery{Persona: c.Query("persona"), Model: c.Query("model")}
+	switch c.Query("rating") {
+	case "up":
+		q.Rating = 1
+	case "down":
+		q.Rating = -1
+	}
+	q.Limit, _ = strconv.Atoi(c.DefaultQuery("limit", "50"))
+	items, next, err := h.Feedback.List(q, c.Query("cursor"))
+	if err != nil {
+		c.JSON(feedbackErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(items))
+	for _, f := range items {
+		rating := "up"
+		if f.Rating < 0 {
+			rating = "down"
+		}
+		res = append(res, gin.H{
+			"id":         f.ID,
+			"message_id": f.MessageID,
+			"rating":     rating,
+			"reason":     f.Reason,
+			"persona":    f.Persona,
+			"model":      f.Model,
+			"created_at": f.CreatedAt,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"feedback": res, "next_cursor": next})
+}
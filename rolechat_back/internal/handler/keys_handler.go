@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"net/http"
+
+	"rolechat_back/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// KeysHandler publishes the public keys access tokens are signed with, so
+// other services can verify them.
+type KeysHandler struct {
+	Keys *utils.KeySet
+}
+
+func NewKeysHandler(keys *utils.KeySet) *KeysHandler {
+	return &KeysHandler{Keys: keys}
+}
+
+// JWKS serves /.well-known/jwks.json. The set is empty while access tokens
+// are signed with the shared secret.
+func (h *KeysHandler) JWKS(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.Keys.JWKS())
+}
@@ -0,0 +1,15 @@
+package handler
+
+import (
+	"os"
+	"testing"
+
+	"rolechat_back/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	if err := logger.InitLogger("error"); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
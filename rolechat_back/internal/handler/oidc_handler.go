@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"rolechat_back/internal/service"
+	"rolechat_back/pkg/logger"
+	"rolechat_back/pkg/oidc"
+	"rolechat_back/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	oidcCookie     = "rolechat_oidc"
+	oidcCookiePath = "/api/auth/oidc"
+	oidcFlowTTL    = 10 * time.Minute
+)
+
+// OIDCProvider is a configured provider as offered on the login page.
+type OIDCProvider struct {
+	Name        string
+	DisplayName string
+	Provider    *oidc.Provider
+}
+
+// OIDCHandler runs the OpenID Connect login flow. The state, nonce and PKCE
+// verifier of a login in progress live in a signed cookie, so any instance
+// can handle the callback.
+type OIDCHandler struct {
+	Service   service.UserService
+	Providers []OIDCProvider
+	// FrontendURL receives the result of the callback in its fragment at
+	// /login/callback.
+	FrontendURL string
+	secret      []byte
+}
+
+// NewOIDCHandler signs the flow cookie with a key derived from secret, so the
+// cookie signature never shares a key with the tokens secret signs itself.
+func NewOIDCHandler(s service.UserService, providers []OIDCProvider, frontendURL, secret string) *OIDCHandler {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("oidc-flow"))
+	return &OIDCHandler{Service: s, Providers: providers, FrontendURL: strings.TrimRight(frontendURL, "/"), secret: mac.Sum(nil)}
+}
+
+func (h *OIDCHandler) provider(name string) *OIDCProvider {
+	for i := range h.Providers {
+		if h.Providers[i].Name == name {
+			return &h.Providers[i]
+		}
+	}
+	return nil
+}
+
+// ListProviders lists the providers the login page can offer.
+func (h *OIDCHandler) ListProviders(c *gin.Context) {
+	res := make([]gin.H, 0, len(h.Providers))
+	for _, p := range h.Providers {
+		res = append(res, gin.H{"name": p.Name, "display_name": p.DisplayName, "login_url": oidcCookiePath + "/" + p.Name + "/login"})
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": res})
+}
+
+type oidcFlow struct {
+	Provider string `json:"p"`
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"`
+	Expires  int64  `json:"e"`
+}
+
+func (h *OIDCHandler) sign(payload string) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (h *OIDCHandler) encodeFlow(f oidcFlow) string {
+	b, _ := json.Marshal(f)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + h.sign(payload)
+}
+
+func (h *OIDCHandler) decodeFlow(v string) (*oidcFlow, error) {
+	payload, sig, ok := strings.Cut(v, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(h.sign(payload))) {
+		return nil, errors.New("invalid login state")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("invalid login state")
+	}
+	var f oidcFlow
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, errors.New("invalid login state")
+	}
+	if time.Now().Unix() > f.Expires {
+		return nil, errors.New("login expired, please try again")
+	}
+	return &f, nil
+}
+
+func (h *OIDCHandler) setFlowCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value,
+		Path:     oidcCookiePath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   c.Request.TLS != nil,
+		// Lax still sends the cookie on the provider's top-level redirect
+		// back to the callback.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Login redirects the browser to the provider's sign-in page.
+func (h *OIDCHandler) Login(c *gin.Context) {
+	p := h.provider(c.Param("provider"))
+	if p == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown provider"})
+		return
+	}
+	f := oidcFlow{Provider: p.Name, Expires: time.Now().Add(oidcFlowTTL).Unix()}
+	for _, v := range []*string{&f.State, &f.Nonce, &f.Verifier} {
+		var err error
+		if *v, err = utils.RandomToken(32); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	target, err := p.Provider.AuthCodeURL(c.Request.Context(), f.State, f.Nonce, f.Verifier)
+	if err != nil {
+		logger.Warn("oidc login failed", "provider", p.Name, "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "identity provider unavailable"})
+		return
+	}
+	h.setFlowCookie(c, h.encodeFlow(f), int(oidcFlowTTL.Seconds()))
+	c.Redirect(http.StatusFound, target)
+}
+
+// Callback finishes the login the provider redirected back from and sends
+// the browser to the frontend with the tokens, or the MFA challenge, in the
+// URL fragment, which is not sent to servers or kept in logs.
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	cookie, _ := c.Cookie(oidcCookie)
+	h.setFlowCookie(c, "", -1)
+	p := h.provider(c.Param("provider"))
+	if p == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown provider"})
+		return
+	}
+	if e := c.Query("error"); e != "" {
+		h.finish(c, url.Values{"error": {e}})
+		return
+	}
+	f, err := h.decodeFlow(cookie)
+	if err == nil && (f.Provider != p.Name || !hmac.Equal([]byte(f.State), []byte(c.Query("state")))) {
+		err = errors.New("invalid login state")
+	}
+	if err != nil {
+		h.finish(c, url.Values{"error": {err.Error()}})
+		return
+	}
+	claims, err := p.Provider.Exchange(c.Request.Context(), c.Query("code"), f.Nonce, f.Verifier)
+	if err != nil {
+		logger.Warn("oidc callback failed", "provider", p.Name, "error", err)
+		h.finish(c, url.Values{"error": {"sign-in with " + p.Name + " failed"}})
+		return
+	}
+	access, refresh, err := h.Service.LoginWithIdentity(service.ExternalIdentity{
+		Provider:      p.Name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, clientInfo(c))
+	var mfa *service.MFARequiredError
+	switch {
+	case errors.As(err, &mfa):
+		h.finish(c, url.Values{"mfa_token": {mfa.Token}, "mfa_expires_in": {strconv.Itoa(int(mfa.ExpiresIn.Seconds()))}})
+	case err != nil:
+		h.finish(c, url.Values{"error": {err.Error()}})
+	default:
+		h.finish(c, url.Values{"access_token": {access}, "refresh_token": {refresh}})
+	}
+}
+
+func (h *OIDCHandler) finish(c *gin.Context, fragment url.Values) {
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, h.FrontendURL+"/login/callback#"+fragment.Encode())
+}
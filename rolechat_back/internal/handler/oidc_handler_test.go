@@ -0,0 +1,307 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/internal/service"
+	"rolechat_back/pkg/config"
+	"rolechat_back/pkg/oidc"
+	"rolechat_back/pkg/oidc/oidctest"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// identityRepo keeps the users and identities the OIDC login touches in
+// memory.
+type identityRepo struct {
+	repository.UserRepository
+	mu         sync.Mutex
+	users      map[uint]*models.User
+	identities []models.UserIdentity
+	revoked    []uint
+}
+
+func newIdentityRepo(users ...models.User) *identityRepo {
+	r := &identityRepo{users: map[uint]*models.User{}}
+	for i := range users {
+		u := users[i]
+		r.users[u.ID] = &u
+	}
+	return r
+}
+
+func (r *identityRepo) FindIdentity(provider, subject string) (*models.UserIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range r.identities {
+		if id.Provider == provider && id.Subject == subject {
+			return &id, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *identityRepo) FindByID(id uint) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if u, ok := r.users[id]; ok {
+		copy := *u
+		return &copy, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *identityRepo) FindByEmail(email string) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.Email == email {
+			copy := *u
+			return &copy, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *identityRepo) CreateIdentity(id *models.UserIdentity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.identities = append(r.identities, *id)
+	return nil
+}
+
+func (r *identityRepo) CreateUserWithIdentity(u *models.User, id *models.UserIdentity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u.ID = uint(len(r.users) + 1)
+	copy := *u
+	r.users[u.ID] = &copy
+	id.UserID = u.ID
+	r.identities = append(r.identities, *id)
+	return nil
+}
+
+func (r *identityRepo) UpdateUser(id uint, fields map[string]any) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := r.users[id]
+	for k, v := range fields {
+		switch k {
+		case "password_hash":
+			u.PasswordHash = v.(string)
+		case "totp_enabled":
+			u.TOTPEnabled = v.(bool)
+		case "totp_secret":
+			u.TOTPSecret = v.(string)
+		case "email_verified_at":
+			t := v.(time.Time)
+			u.EmailVerifiedAt = &t
+		case "status":
+			u.Status = v.(string)
+		}
+	}
+	return nil
+}
+
+func (r *identityRepo) RevokeAllRefreshTokens(userID uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.revoked = append(r.revoked, userID)
+	return nil
+}
+
+func (r *identityRepo) ReplaceRecoveryCodes(uint, []string) error         { return nil }
+func (r *identityRepo) SaveRefreshToken(*models.RefreshToken) error       { return nil }
+func (r *identityRepo) SetTOTPStep(uint, int64) (bool, error)             { return true, nil }
+func (r *identityRepo) ListRevokedTokens() ([]models.RevokedToken, error) { return nil, nil }
+func (r *identityRepo) GetRefreshTokenByJTI(string) (*models.RefreshToken, error) {
+	return nil, gorm.ErrRecordNotFound
+}
+
+const testFrontend = "https://rolechat.example"
+
+func newOIDCTestRouter(t *testing.T, repo *identityRepo) (*gin.Engine, *oidctest.Issuer) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	iss := oidctest.NewIssuer("rolechat", "secret")
+	t.Cleanup(iss.Close)
+	cfg := &config.Config{JWT: config.JWTConfig{AccessSecret: "access", RefreshSecret: "refresh", AccessExpiresMins: 15, RefreshExpiresHours: 24}}
+	keys, err := service.NewTokenKeys(cfg.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := service.NewUserService(repo, cfg, keys, nil, nil)
+	h := NewOIDCHandler(svc, []OIDCProvider{{
+		Name:        "test",
+		DisplayName: "Test",
+		Provider: oidc.NewProvider(oidc.Config{
+			Issuer:       iss.URL,
+			ClientID:     "rolechat",
+			ClientSecret: "secret",
+			RedirectURL:  testFrontend + "/api/auth/oidc/test/callback",
+		}, iss.Client()),
+	}}, testFrontend, "refresh")
+	r := gin.New()
+	r.GET("/api/auth/oidc/:provider/login", h.Login)
+	r.GET("/api/auth/oidc/:provider/callback", h.Callback)
+	return r, iss
+}
+
+// oidcLogin signs in at the fake issuer with claims and returns the fragment
+// the callback sends the browser to the frontend with. tamper may change the
+// callback query first.
+func oidcLogin(t *testing.T, r *gin.Engine, iss *oidctest.Issuer, claims map[string]any, tamper func(url.Values)) url.Values {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/auth/oidc/test/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+	code, state, err := iss.Authorize(rec.Header().Get("Location"), claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := url.Values{"code": {code}, "state": {state}}
+	if tamper != nil {
+		tamper(q)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/api/auth/oidc/test/callback?"+q.Encode(), nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	loc := rec.Header().Get("Location")
+	prefix := testFrontend + "/login/callback#"
+	if rec.Code != http.StatusFound || !strings.HasPrefix(loc, prefix) {
+		t.Fatalf("callback: status %d, location %q", rec.Code, loc)
+	}
+	fragment, err := url.ParseQuery(strings.TrimPrefix(loc, prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fragment
+}
+
+func TestOIDCFirstLoginCreatesAccount(t *testing.T) {
+	repo := newIdentityRepo()
+	r, iss := newOIDCTestRouter(t, repo)
+	got := oidcLogin(t, r, iss, map[string]any{"sub": "s1", "email": "new@example.com", "email_verified": true, "name": "New"}, nil)
+	if got.Get("access_token") == "" || got.Get("refresh_token") == "" {
+		t.Fatalf("fragment = %v, want tokens", got)
+	}
+	u, err := repo.FindByEmail("new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Nickname != "New" || u.Status != models.UserStatusActive || u.EmailVerifiedAt == nil || u.PasswordHash != "" {
+		t.Fatalf("created user = %+v", u)
+	}
+	if len(repo.identities) != 1 || repo.identities[0].UserID != u.ID || repo.identities[0].Subject != "s1" {
+		t.Fatalf("identities = %+v", repo.identities)
+	}
+
+	// The second login finds the identity, even if the email changed.
+	got = oidcLogin(t, r, iss, map[string]any{"sub": "s1", "email": "renamed@example.com", "email_verified": true}, nil)
+	if got.Get("access_token") == "" || len(repo.users) != 1 || len(repo.identities) != 1 {
+		t.Fatalf("second login: fragment %v, %d users, %d identities", got, len(repo.users), len(repo.identities))
+	}
+}
+
+func TestOIDCLinksVerifiedEmail(t *testing.T) {
+	verified := time.Now().Add(-time.Hour)
+	repo := newIdentityRepo(models.User{ID: 7, Email: "a@example.com", PasswordHash: "hash", Role: models.RoleUser, Status: models.UserStatusActive, EmailVerifiedAt: &verified})
+	r, iss := newOIDCTestRouter(t, repo)
+	got := oidcLogin(t, r, iss, map[string]any{"sub": "s1", "email": "a@example.com", "email_verified": true}, nil)
+	if got.Get("access_token") == "" {
+		t.Fatalf("fragment = %v, want tokens", got)
+	}
+	if len(repo.users) != 1 || len(repo.identities) != 1 || repo.identities[0].UserID != 7 {
+		t.Fatalf("identities = %+v", repo.identities)
+	}
+	if repo.users[7].PasswordHash != "hash" || len(repo.revoked) != 0 {
+		t.Fatal("linking to a verified account changed its credentials")
+	}
+}
+
+func TestOIDCClaimsUnverifiedAccount(t *testing.T) {
+	repo := newIdentityRepo(models.User{ID: 7, Email: "a@example.com", PasswordHash: "squatter", TOTPEnabled: true, TOTPSecret: "x", Role: models.RoleUser, Status: models.UserStatusPending})
+	r, iss := newOIDCTestRouter(t, repo)
+	got := oidcLogin(t, r, iss, map[string]any{"sub": "s1", "email": "a@example.com", "email_verified": true}, nil)
+	if got.Get("access_token") == "" {
+		t.Fatalf("fragment = %v, want tokens without a second factor", got)
+	}
+	u := repo.users[7]
+	if u.PasswordHash != "" || u.TOTPEnabled || u.EmailVerifiedAt == nil || u.Status != models.UserStatusActive {
+		t.Fatalf("claimed user = %+v", u)
+	}
+	if len(repo.revoked) != 1 {
+		t.Fatal("sessions of the unverified account were not revoked")
+	}
+}
+
+func TestOIDCLinkedAccountWithTOTP(t *testing.T) {
+	verified := time.Now()
+	repo := newIdentityRepo(models.User{ID: 7, Email: "a@example.com", TOTPEnabled: true, Role: models.RoleUser, Status: models.UserStatusActive, EmailVerifiedAt: &verified})
+	repo.identities = []models.UserIdentity{{UserID: 7, Provider: "test", Subject: "s1"}}
+	r, iss := newOIDCTestRouter(t, repo)
+	got := oidcLogin(t, r, iss, map[string]any{"sub": "s1"}, nil)
+	if got.Get("mfa_token") == "" || got.Get("access_token") != "" {
+		t.Fatalf("fragment = %v, want an MFA challenge", got)
+	}
+}
+
+func TestOIDCRejects(t *testing.T) {
+	verified := time.Now()
+	tests := []struct {
+		name   string
+		claims map[string]any
+		tamper func(url.Values)
+		want   string
+	}{
+		{"unverified email", map[string]any{"sub": "s1", "email": "a@example.com", "email_verified": false}, nil, "verified email"},
+		{"unverified email string", map[string]any{"sub": "s1", "email": "a@example.com", "email_verified": "false"}, nil, "verified email"},
+		{"no email", map[string]any{"sub": "s1"}, nil, "verified email"},
+		{"state", map[string]any{"sub": "s1", "email": "a@example.com", "email_verified": true}, func(q url.Values) { q.Set("state", "forged") }, "invalid login state"},
+		{"nonce", map[string]any{"sub": "s1", "email": "a@example.com", "email_verified": true, "nonce": "replayed"}, nil, "sign-in with test failed"},
+		{"audience", map[string]any{"sub": "s1", "email": "a@example.com", "email_verified": true, "aud": "another-client"}, nil, "sign-in with test failed"},
+		{"issuer", map[string]any{"sub": "s1", "email": "a@example.com", "email_verified": true, "iss": "https://evil.example"}, nil, "sign-in with test failed"},
+		{"provider error", nil, func(q url.Values) { q.Set("error", "access_denied") }, "access_denied"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newIdentityRepo(models.User{ID: 7, Email: "a@example.com", PasswordHash: "hash", Role: models.RoleUser, Status: models.UserStatusActive, EmailVerifiedAt: &verified})
+			r, iss := newOIDCTestRouter(t, repo)
+			got := oidcLogin(t, r, iss, tt.claims, tt.tamper)
+			if got.Get("access_token") != "" || !strings.Contains(got.Get("error"), tt.want) {
+				t.Fatalf("fragment = %v, want error %q", got, tt.want)
+			}
+			if len(repo.users) != 1 || len(repo.identities) != 0 {
+				t.Fatalf("rejected login changed accounts: %d users, %d identities", len(repo.users), len(repo.identities))
+			}
+		})
+	}
+}
+
+func TestOIDCFlowCookieKey(t *testing.T) {
+	h := NewOIDCHandler(nil, nil, testFrontend, "refresh")
+	flow := oidcFlow{Provider: "test", State: "s", Nonce: "n", Verifier: "v", Expires: time.Now().Add(time.Minute).Unix()}
+	got, err := h.decodeFlow(h.encodeFlow(flow))
+	if err != nil || *got != flow {
+		t.Fatalf("decodeFlow(encodeFlow()) = %+v, %v", got, err)
+	}
+	// A cookie signed with the refresh secret itself is not accepted.
+	raw := &OIDCHandler{secret: []byte("refresh")}
+	if _, err := h.decodeFlow(raw.encodeFlow(flow)); err == nil {
+		t.Fatal("flow signed with the underived secret accepted")
+	}
+}
@@ -0,0 +1,144 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ShareHandler struct {
+	Share service.ShareService
+}
+
+func NewShareHandler(s service.ShareService) *ShareHandler {
+	return &ShareHandler{Share: s}
+}
+
+type createShareRequest struct {
+	Snapshot          bool `json:"snapshot"`
+	SnapshotMessageID uint `json:"snapshot_message_id"`
+	ExpiresInHours    int  `json:"expires_in_hours"`
+}
+
+func shareJSON(s *models.TopicShare) gin.H {
+	return gin.H{
+		"id":                  s.ID,
+		"topic_id":            s.TopicID,
+		"snapshot_message_id": s.SnapshotMessageID,
+		"expires_at":          s.ExpiresAt,
+		"revoked":             s.Revoked,
+		"created_at":          s.CreatedAt,
+	}
+}
+
+func shareErrorStatus(err error) int {
+	switch err.Error() {
+	case "forbidden":
+		return http.StatusForbidden
+	case "share not found":
+		return http.StatusNotFound
+	case "topic has no messages", "snapshot message not in topic":
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func (h *ShareHandler) CreateShare(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	var req createShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresInHours < 0 || req.ExpiresInHours > 24*365 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_hours must be between 0 and 8760"})
+		return
+	}
+	share, token, err := h.Share.CreateShare(userID, uint(id64), service.ShareOptions{
+		Snapshot:          req.Snapshot,
+		SnapshotMessageID: req.SnapshotMessageID,
+		ExpiresIn:         time.Duration(req.ExpiresInHours) * time.Hour,
+	})
+	if err != nil {
+		c.JSON(shareErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	res := shareJSON(share)
+	res["token"] = token
+	res["path"] = "/api/share/" + token
+	c.JSON(http.StatusCreated, res)
+}
+
+func (h *ShareHandler) ListShares(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	id64, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	shares, err := h.Share.ListShares(userID, uint(id64))
+	if err != nil {
+		c.JSON(shareErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(shares))
+	for i := range shares {
+		res = append(res, shareJSON(&shares[i]))
+	}
+	c.JSON(http.StatusOK, gin.H{"shares": res})
+}
+
+func (h *ShareHandler) RevokeShare(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	id64, err := strconv.ParseUint(c.Param("shareID"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid id"})
+		return
+	}
+	if err := h.Share.RevokeShare(userID, uint(id64)); err != nil {
+		c.JSON(shareErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": true})
+}
+
+// GetShared is public: it must not expose who owns the topic.
+func (h *ShareHandler) GetShared(c *gin.Context) {
+	tr, err := h.Share.GetSharedTranscript(c.Param("token"))
+	if err != nil {
+		c.JSON(shareErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	msgs := make([]gin.H, 0, len(tr.Messages))
+	for _, m := range tr.Messages {
+		item := gin.H{"id": m.ID, "role": m.Role, "content": m.Content, "created_at": m.CreatedAt}
+		if m.Persona != "" {
+			item["persona"] = m.Persona
+			item["persona_name"] = service.PersonaName(m.Persona)
+		}
+		msgs = append(msgs, item)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.Header("X-Robots-Tag", "noindex")
+	c.JSON(http.StatusOK, gin.H{
+		"topic":               gin.H{"title": tr.Topic.Title, "created_at": tr.Topic.CreatedAt},
+		"snapshot_message_id": tr.Share.SnapshotMessageID,
+		"expires_at":          tr.Share.ExpiresAt,
+		"messages":            msgs,
+	})
+}
@@ -1,9 +1,14 @@
 package handler
 
 import (
+	"errors"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
+	"rolechat_back/internal/models"
 	"rolechat_back/internal/service"
 
 	"github.com/gin-gonic/gin"
@@ -11,24 +16,179 @@ import (
 
 type UserHandler struct {
 	Service service.UserService
+	Account service.AccountService
 }
 
-func NewUserHandler(s service.UserService) *UserHandler {
-	return &UserHandler{Service: s}
+func NewUserHandler(s service.UserService, account service.AccountService) *UserHandler {
+	return &UserHandler{Service: s, Account: account}
+}
+
+// loginErrorStatus tells accounts that exist but may not log in apart from
+// wrong credentials.
+func loginErrorStatus(err error) int {
+	if errors.Is(err, service.ErrAccountDisabled) || errors.Is(err, service.ErrEmailNotVerified) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// writeLoginError answers throttled logins with 429 and Retry-After, and
+// logins that need a second factor with the challenge token.
+func writeLoginError(c *gin.Context, err error) {
+	var mfa *service.MFARequiredError
+	if errors.As(err, &mfa) {
+		c.JSON(http.StatusOK, gin.H{"mfa_required": true, "mfa_token": mfa.Token, "mfa_expires_in": int(mfa.ExpiresIn.Seconds())})
+		return
+	}
+	var throttled *service.LoginThrottledError
+	if errors.As(err, &throttled) {
+		secs := int(math.Ceil(throttled.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(secs))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "retry_after": secs, "locked": throttled.Locked})
+		return
+	}
+	c.JSON(loginErrorStatus(err), gin.H{"error": err.Error()})
+}
+
+func clientInfo(c *gin.Context) service.ClientInfo {
+	return service.ClientInfo{UserAgent: c.Request.UserAgent(), IP: c.ClientIP()}
 }
 
 func (h *UserHandler) Health(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
+func profileJSON(u *models.User) gin.H {
+	return gin.H{
+		"user_id":        u.ID,
+		"email":          u.Email,
+		"email_verified": u.EmailVerifiedAt != nil,
+		"nickname":       u.Nickname,
+		"avatar_url":     u.AvatarURL,
+		"role":           u.Role,
+		"two_factor":     u.TOTPEnabled,
+		"has_password":   u.PasswordHash != "",
+		"created_at":     u.CreatedAt,
+	}
+}
+
+func profileErrorStatus(err error) int {
+	switch err.Error() {
+	case "current password is incorrect", "invalid two-factor code", "sign in again to continue":
+		return http.StatusForbidden
+	case "nickname too long", "avatar too large", "unsupported image type", "password must be at least 6 characters":
+		return http.StatusBadRequest
+	case "two-factor authentication already enabled", "two-factor authentication not enabled", "two-factor setup not started":
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
 func (h *UserHandler) GetProfile(c *gin.Context) {
 	userIDVal, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
 		return
 	}
-	_ = userIDVal
-	c.JSON(http.StatusOK, gin.H{"user_id": userIDVal})
+	user, err := h.Service.GetProfile(userIDVal.(uint))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, profileJSON(user))
+}
+
+type updateProfileRequest struct {
+	Nickname *string `json:"nickname"`
+}
+
+func (h *UserHandler) UpdateProfile(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	var req updateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, err := h.Service.UpdateProfile(userID, service.ProfileUpdate{Nickname: req.Nickname})
+	if err != nil {
+		c.JSON(profileErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, profileJSON(user))
+}
+
+// maxAvatarUpload leaves room for the multipart framing around the image.
+const maxAvatarUpload = 3 << 20
+
+// UploadAvatar takes the image as the multipart field "avatar".
+func (h *UserHandler) UploadAvatar(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAvatarUpload)
+	fh, err := c.FormFile("avatar")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "avatar file required"})
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, err := h.Service.SetAvatar(userID, data)
+	if err != nil {
+		c.JSON(profileErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, profileJSON(user))
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"` // empty for accounts without a password
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+// ChangePassword keeps the current session and logs out all others.
+func (h *UserHandler) ChangePassword(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	sessionID := c.GetString("sessionID")
+	var req changePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.Service.ChangePassword(userID, sessionID, req.CurrentPassword, req.NewPassword); err != nil {
+		c.JSON(profileErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"changed": true})
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+func (h *UserHandler) DeleteAccount(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	var req deleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.Service.DeleteAccount(userID, c.GetString("sessionID"), req.Password); err != nil {
+		c.JSON(profileErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": true})
 }
 
 type registerRequest struct {
@@ -48,7 +208,15 @@ func (h *UserHandler) Register(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	access, refresh, err := h.Service.Login(c.Request.Context(), req.Email, req.Password)
+	if err := h.Account.RequestEmailVerification(user.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user.Status == models.UserStatusPending {
+		c.JSON(http.StatusCreated, gin.H{"user_id": user.ID, "verification_required": true})
+		return
+	}
+	access, refresh, err := h.Service.Login(c.Request.Context(), req.Email, req.Password, clientInfo(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -72,9 +240,9 @@ func (h *UserHandler) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	access, refresh, err := h.Service.Login(c.Request.Context(), req.Email, req.Password)
+	access, refresh, err := h.Service.Login(c.Request.Context(), req.Email, req.Password, clientInfo(c))
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		writeLoginError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"access_token": access, "refresh_token": refresh})
@@ -90,10 +258,254 @@ func (h *UserHandler) Refresh(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	access, err := h.Service.RefreshAccessToken(req.RefreshToken)
+	access, refresh, err := h.Service.RefreshAccessToken(req.RefreshToken, clientInfo(c))
 	if err != nil {
+		c.JSON(loginErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"access_token": access, "refresh_token": refresh})
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+func (h *UserHandler) Logout(c *gin.Context) {
+	var req logoutRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.Service.Logout(req.RefreshToken); err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"access_token": access})
+	c.JSON(http.StatusOK, gin.H{"logged_out": true})
+}
+
+func (h *UserHandler) ListSessions(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	current, _ := c.Get("sessionID")
+	sessions, err := h.Service.ListSessions(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	res := make([]gin.H, 0, len(sessions))
+	for _, s := range sessions {
+		res = append(res, gin.H{
+			"jti":          s.TokenID,
+			"session_id":   s.Family(),
+			"device":       s.UserAgent,
+			"ip":           s.IP,
+			"created_at":   s.CreatedAt,
+			"last_used_at": s.LastUsedAt,
+			"expires_at":   s.ExpiresAt,
+			"current":      s.Family() == current,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": res})
+}
+
+func (h *UserHandler) RevokeSession(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	if err := h.Service.RevokeSession(userID, c.Param("jti")); err != nil {
+		status := http.StatusInternalServerError
+		if err.Error() == "session not found" {
+			status = http.StatusNotFound
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": true})
+}
+
+// RevokeAllSessions logs the user out everywhere, including this device.
+func (h *UserHandler) RevokeAllSessions(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	if err := h.Service.RevokeAllSessions(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": true})
+}
+
+type emailRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type tokenRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// RequestEmailVerification mails a new verification link. It answers the
+// same whether or not the address is registered.
+func (h *UserHandler) RequestEmailVerification(c *gin.Context) {
+	var req emailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.Account.RequestEmailVerification(req.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sent": true})
+}
+
+func (h *UserHandler) VerifyEmail(c *gin.Context) {
+	var req tokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.Account.VerifyEmail(req.Token); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"verified": true})
+}
+
+// RequestPasswordReset mails a reset link. It answers the same whether or
+// not the address is registered.
+func (h *UserHandler) RequestPasswordReset(c *gin.Context) {
+	var req emailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.Account.RequestPasswordReset(req.Email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sent": true})
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	var req resetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.Account.ResetPassword(req.Token, req.Password); err != nil {
+		c.JSON(accountErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"reset": true})
+}
+
+func accountErrorStatus(err error) int {
+	switch err.Error() {
+	case "invalid or expired token", "password must be at least 6 characters":
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+type mfaLoginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+// LoginMFA is the second step of a login with two-factor authentication:
+// the challenge from Login plus a TOTP or recovery code.
+func (h *UserHandler) LoginMFA(c *gin.Context) {
+	var req mfaLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	access, refresh, err := h.Service.CompleteMFALogin(req.MFAToken, req.Code, clientInfo(c))
+	if err != nil {
+		writeLoginError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"access_token": access, "refresh_token": refresh})
+}
+
+func (h *UserHandler) SetupTOTP(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	secret, uri, err := h.Service.SetupTOTP(userID)
+	if err != nil {
+		c.JSON(profileErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "otpauth_uri": uri})
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// EnableTOTP returns the recovery codes; they are not shown again.
+func (h *UserHandler) EnableTOTP(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	var req totpCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	codes, err := h.Service.EnableTOTP(userID, req.Code)
+	if err != nil {
+		c.JSON(profileErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "recovery_codes": codes})
+}
+
+type disableTOTPRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code" binding:"required"`
+}
+
+func (h *UserHandler) DisableTOTP(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	var req disableTOTPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.Service.DisableTOTP(userID, c.GetString("sessionID"), req.Password, req.Code); err != nil {
+		c.JSON(profileErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": false})
+}
+
+func (h *UserHandler) RecoveryCodesLeft(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	n, err := h.Service.RecoveryCodesLeft(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"remaining": n})
+}
+
+func (h *UserHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	var req totpCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	codes, err := h.Service.RegenerateRecoveryCodes(userID, req.Code)
+	if err != nil {
+		c.JSON(profileErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
 }
@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"rolechat_back/internal/service"
+	"rolechat_back/pkg/utils"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"golang.org/x/net/websocket"
+)
+
+// WSHandler serves /api/chat/ws, which carries sending messages, streamed
+// replies, stopping, typing indicators and topic updates over one socket.
+// Every frame is a JSON object with a "type".
+type WSHandler struct {
+	ChatSvc     service.ChatService
+	AISvc       service.AIService
+	Generations *service.GenerationRegistry
+	Notifier    *service.Notifier
+	// Guard is asked again while the socket is open, so a logout, ban or
+	// password change also ends sockets opened before it.
+	Guard   *service.TokenGuard
+	Tickets *service.WSTickets
+}
+
+func NewWSHandler(chatSvc service.ChatService, aiSvc service.AIService, generations *service.GenerationRegistry, notifier *service.Notifier, guard *service.TokenGuard, tickets *service.WSTickets) *WSHandler {
+	return &WSHandler{ChatSvc: chatSvc, AISvc: aiSvc, Generations: generations, Notifier: notifier, Guard: guard, Tickets: tickets}
+}
+
+// IssueTicket returns a single-use ticket to open the socket with as
+// ?ticket=, standing for the caller's access token.
+func (h *WSHandler) IssueTicket(c *gin.Context) {
+	claims, _ := c.Get("claims")
+	ticket, ttl, err := h.Tickets.Issue(claims.(*utils.JWTClaims))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expires_in": int(ttl.Seconds())})
+}
+
+// wsMessage is a frame sent by the client. Fields a type does not use are
+// ignored.
+type wsMessage struct {
+	Type         string `json:"type"`
+	RequestID    string `json:"request_id"`
+	TopicID      uint   `json:"topic_id"`
+	RoleID       string `json:"role_id"`
+	PersonaName  string `json:"persona_name"`
+	Content      string `json:"content"`
+	GenerationID string `json:"generation_id"`
+	LastSeq      int    `json:"last_seq"`
+	Typing       bool   `json:"typing"`
+	// send: same as the stream request fields of RoleReplyRequest
+	Chunking       string `json:"chunking"`
+	ChunkLatencyMs int    `json:"chunk_latency_ms"`
+}
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsAuthInterval = 15 * time.Second
+)
+
+func (h *WSHandler) Serve(c *gin.Context) {
+	userIDVal, _ := c.Get("userID")
+	userID := userIDVal.(uint)
+	claims, _ := c.Get("claims")
+	websocket.Server{
+		// Authentication already happened; any origin may connect, as with CORS.
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			h.session(ws, userID, claims.(*utils.JWTClaims))
+		},
+	}.ServeHTTP(c.Writer, c.Request)
+}
+
+type wsSession struct {
+	h      *WSHandler
+	ws     *websocket.Conn
+	userID uint
+	claims *utils.JWTClaims
+	id     string
+	out    chan gin.H
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (h *WSHandler) session(ws *websocket.Conn, userID uint, claims *utils.JWTClaims) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &wsSession{h: h, ws: ws, userID: userID, claims: claims, id: uuid.NewString(), out: make(chan gin.H, 64), ctx: ctx, cancel: cancel}
+	go s.writeLoop()
+	notes, unsubscribe := h.Notifier.Subscribe(userID, s.id)
+	defer unsubscribe()
+	go s.forwardNotifications(notes)
+
+	for {
+		var msg wsMessage
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			return
+		}
+		s.handle(msg)
+	}
+}
+
+// writeLoop is the only writer of the socket. It closes the socket on a
+// failed write or once the token it was opened with is no longer honoured,
+// which also ends the read loop.
+func (s *wsSession) writeLoop() {
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	auth := time.NewTicker(wsAuthInterval)
+	defer auth.Stop()
+	for {
+		var frame gin.H
+		select {
+		case frame = <-s.out:
+		case <-ping.C:
+			frame = gin.H{"type": "ping"}
+		case <-auth.C:
+			if !s.authorized() {
+				return
+			}
+			continue
+		case <-s.ctx.Done():
+			return
+		}
+		if !s.authorized() || !s.write(frame) {
+			return
+		}
+	}
+}
+
+// authorized checks the token again. If it has been revoked, or the account
+// disabled, the client is told why and the socket is closed.
+func (s *wsSession) authorized() bool {
+	if _, err := s.h.Guard.Check(s.claims); err != nil {
+		code := "unauthorized"
+		if errors.Is(err, service.ErrAccountDisabled) {
+			code = "forbidden"
+		}
+		s.write(gin.H{"type": "error", "code": code, "message": err.Error()})
+		s.close()
+		return false
+	}
+	return true
+}
+
+func (s *wsSession) write(frame gin.H) bool {
+	_ = s.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := websocket.JSON.Send(s.ws, frame); err != nil {
+		s.close()
+		return false
+	}
+	return true
+}
+
+func (s *wsSession) close() {
+	s.cancel()
+	s.ws.Close()
+}
+
+func (s *wsSession) send(frame gin.H) {
+	select {
+	case s.out <- frame:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *wsSession) sendError(requestID, code, message string) {
+	frame := gin.H{"type": "error", "code": code, "message": message}
+	if requestID != "" {
+		frame["request_id"] = requestID
+	}
+	s.send(frame)
+}
+
+func (s *wsSession) handle(msg wsMessage) {
+	switch msg.Type {
+	case "send":
+		s.sendMessage(msg)
+	case "stop":
+		if err := s.h.Generations.Stop(s.userID, msg.GenerationID); err != nil {
+			s.sendError(msg.RequestID, "not_found", err.Error())
+		}
+	case "resume":
+		gen, err := s.h.Generations.Get(s.userID, msg.GenerationID)
+		if err != nil {
+			s.sendError(msg.RequestID, "not_found", err.Error())
+			return
+		}
+		go s.forward(gen, msg.LastSeq, msg.RequestID)
+	case "typing":
+		s.h.Notifier.Publish(s.userID, service.Notification{
+			Type:    service.NotifyTyping,
+			TopicID: msg.TopicID,
+			Role:    "user",
+			Typing:  msg.Typing,
+			Source:  s.id,
+		})
+	case "ping":
+		s.send(gin.H{"type": "pong"})
+	default:
+		s.sendError(msg.RequestID, "unknown_type", "unknown message type: "+msg.Type)
+	}
+}
+
+// sendMessage saves the user message and streams the reply on this socket,
+// like POST /api/chat/role-reply/stream.
+func (s *wsSession) sendMessage(msg wsMessage) {
+	if strings.TrimSpace(msg.Content) == "" {
+		s.sendError(msg.RequestID, "bad_request", "content required")
+		return
+	}
+	roleKey := msg.RoleID
+	if roleKey == "" {
+		roleKey = msg.PersonaName
+	}
+	if service.LookupPersona(roleKey) == nil {
+		s.sendError(msg.RequestID, "bad_request", "Invalid role/persona: "+roleKey)
+		return
+	}
+	chunking := service.ChunkOptions{Strategy: msg.Chunking, MaxLatency: time.Duration(msg.ChunkLatencyMs) * time.Millisecond}
+	if _, err := service.NewChunker(chunking); err != nil {
+		s.sendError(msg.RequestID, "bad_request", err.Error())
+		return
+	}
+	topic, userMsg, newTopic, err := s.h.ChatSvc.AddMessage(s.userID, msg.TopicID, "user", msg.Content, roleKey)
+	if err != nil {
+		s.sendError(msg.RequestID, "bad_request", err.Error())
+		return
+	}
+	gen, err := s.h.AISvc.StreamRoleReply(service.StreamRequest{
+		UserID:      s.userID,
+		TopicID:     topic.ID,
+		NewTopic:    newTopic,
+		PersonaKey:  roleKey,
+		UserMessage: userMsg,
+		Chunking:    chunking,
+	})
+	if err != nil {
+		code := "internal_error"
+		if errors.Is(err, service.ErrShuttingDown) {
+			code = "unavailable"
+		}
+		s.sendError(msg.RequestID, code, err.Error())
+		return
+	}
+	go s.forward(gen, 0, msg.RequestID)
+}
+
+// forward sends the generation's events after seq using the payloads of the
+// version 2 SSE protocol, tagged with the generation and request they belong
+// to.
+func (s *wsSession) forward(gen *service.Generation, after int, requestID string) {
+	for {
+		evs, next, finished := gen.EventsAfter(after)
+		for _, ev := range evs {
+			after = ev.Seq
+			name, frame := generationEventJSON(gen, ev)
+			if name == "" {
+				continue
+			}
+			frame["type"] = name
+			frame["generation_id"] = gen.ID
+			frame["seq"] = ev.Seq
+			if requestID != "" {
+				frame["request_id"] = requestID
+			}
+			s.send(frame)
+		}
+		if finished {
+			return
+		}
+		select {
+		case <-next:
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *wsSession) forwardNotifications(notes <-chan service.Notification) {
+	for {
+		select {
+		case n := <-notes:
+			switch n.Type {
+			case service.NotifyTopic:
+				s.send(gin.H{"type": "topic", "topic": topicJSON(n.Topic)})
+			case service.NotifyTyping:
+				s.send(gin.H{"type": "typing", "topic_id": n.TopicID, "role": n.Role, "typing": n.Typing})
+			}
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+const (
+	AuditLoginLockout = "login_lockout"
+)
+
+// AuditLog records security-relevant events for admins to review.
+type AuditLog struct {
+	ID        uint   `gorm:"primaryKey"`
+	Event     string `gorm:"size:32;not null;index"`
+	UserID    uint   `gorm:"index"` // 0 when no user is known
+	Email     string `gorm:"size:255"`
+	IP        string `gorm:"size:64"`
+	Detail    string `gorm:"type:text"`
+	CreatedAt time.Time
+}
+
+func (AuditLog) TableName() string { return "audit_logs" }
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// MessageFeedback is a user's rating of an assistant message. Persona and
+// model are copied from the message so aggregates survive later changes.
+type MessageFeedback struct {
+	ID        uint   `gorm:"primaryKey"`
+	MessageID uint   `gorm:"not null;uniqueIndex:idx_feedback_message_user"`
+	UserID    uint   `gorm:"not null;uniqueIndex:idx_feedback_message_user"`
+	Rating    int    `gorm:"not null"` // 1 = thumbs up, -1 = thumbs down
+	Reason    string `gorm:"type:text"`
+	Persona   string `gorm:"type:varchar(50);index"`
+	Model     string `gorm:"type:varchar(50);index"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (MessageFeedback) TableName() string { return "message_feedback" }
@@ -6,11 +6,21 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	MessageStatusGenerating = "generating" // reply is still streaming; content is a checkpoint
+	MessageStatusComplete   = "complete"
+	MessageStatusTruncated  = "truncated" // generation was stopped or cut short by a shutdown
+	MessageStatusFailed     = "failed"    // the model returned an error part way
+)
+
 type Message struct {
 	ID        uint   `gorm:"primaryKey"`
 	TopicID   uint   `gorm:"not null;index"`
 	Role      string `gorm:"type:varchar(20);not null"`
 	Content   string `gorm:"type:text;not null"`
+	Persona   string `gorm:"type:varchar(50);index"`
+	Model     string `gorm:"type:varchar(50)"` // model that generated an assistant message
+	Status    string `gorm:"type:varchar(16);not null;default:complete"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt gorm.DeletedAt `gorm:"index"`
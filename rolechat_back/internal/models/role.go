@@ -4,9 +4,11 @@ import "time"
 
 type RolePersona struct {
 	ID           uint   `gorm:"primaryKey"`
+	Key          string `gorm:"type:varchar(50);index"` // role_id sent by clients
 	Name         string `gorm:"type:varchar(50);uniqueIndex"`
 	SystemPrompt string `gorm:"type:text"`
 	Voice        string `gorm:"type:varchar(50)"`
+	Chunking     string `gorm:"type:varchar(16)"` // default stream chunking strategy, empty for the default
 	CreatedAt    time.Time
 	UpdatedAt    time.Time
 }
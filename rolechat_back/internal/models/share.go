@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// TopicShare is a public read-only link to a topic. Only the SHA-256 of the
+// token is stored; the token itself is shown once when the link is created.
+type TopicShare struct {
+	ID                uint   `gorm:"primaryKey"`
+	TopicID           uint   `gorm:"not null;index"`
+	UserID            uint   `gorm:"not null;index"`
+	TokenHash         string `gorm:"uniqueIndex;size:64;not null"`
+	SnapshotMessageID uint   // 0 shares the live transcript
+	ExpiresAt         *time.Time
+	Revoked           bool `gorm:"default:false"`
+	CreatedAt         time.Time
+}
+
+func (TopicShare) TableName() string { return "topic_shares" }
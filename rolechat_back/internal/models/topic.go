@@ -6,16 +6,41 @@ import (
 	"gorm.io/gorm"
 )
 
+// Title sources. Only titles still derived from the first message may be
+// replaced by a model-generated one; user renames are never overwritten.
+const (
+	TitleSourceAuto = "auto"
+	TitleSourceAI   = "ai"
+	TitleSourceUser = "user"
+)
+
 type Topic struct {
-	ID        uint      `gorm:"primaryKey"`
-	UserID    uint      `gorm:"not null;index"`
-	Title     string    `gorm:"type:varchar(255)"`
-	Messages  []Message `gorm:"foreignKey:TopicID"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt gorm.DeletedAt `gorm:"index"`
+	ID          uint       `gorm:"primaryKey"`
+	UserID      uint       `gorm:"not null;index"`
+	Title       string     `gorm:"type:varchar(255)"`
+	TitleSource string     `gorm:"type:varchar(10);not null;default:auto"`
+	Pinned      bool       `gorm:"not null;default:false"`
+	Favorite    bool       `gorm:"not null;default:false"`
+	Folder      string     `gorm:"type:varchar(64);not null;default:'';index"`
+	Tags        []TopicTag `gorm:"foreignKey:TopicID"`
+	Messages    []Message  `gorm:"foreignKey:TopicID"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
 }
 
 func (Topic) TableName() string {
 	return "topics"
 }
+
+// TopicTag is a user-defined label; a topic may carry several.
+type TopicTag struct {
+	ID      uint   `gorm:"primaryKey"`
+	TopicID uint   `gorm:"not null;uniqueIndex:idx_topic_tag"`
+	UserID  uint   `gorm:"not null;index"`
+	Tag     string `gorm:"type:varchar(32);not null;uniqueIndex:idx_topic_tag;index"`
+}
+
+func (TopicTag) TableName() string {
+	return "topic_tags"
+}
@@ -6,29 +6,119 @@ import (
 	"gorm.io/gorm"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+const (
+	UserStatusPending  = "pending" // waiting for email verification
+	UserStatusActive   = "active"
+	UserStatusDisabled = "disabled"
+)
+
 type User struct {
 	ID           uint   `gorm:"primaryKey"`
 	Email        string `gorm:"uniqueIndex;not null"`
 	PasswordHash string `gorm:"not null"`
 	Role         string `gorm:"not null;default:user"`
 	Nickname     string `gorm:"not null;"`
+	AvatarURL    string `gorm:"size:255"`
 	Status       string `gorm:"not null;"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
-	DeletedAt    gorm.DeletedAt `gorm:"index"`
+	// EmailVerifiedAt is nil until the user proves they own Email.
+	EmailVerifiedAt *time.Time
+	// TOTPSecret is set once enrollment starts; logins only ask for a code
+	// when TOTPEnabled. TOTPLastStep is the time step of the last code
+	// accepted, which may not be used again.
+	TOTPSecret   string `gorm:"size:64"`
+	TOTPEnabled  bool   `gorm:"not null;default:false"`
+	TOTPLastStep int64  `gorm:"not null;default:0"`
+	// TokensValidAfter rejects every access token issued before it, e.g.
+	// after logging out everywhere.
+	TokensValidAfter *time.Time
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	DeletedAt        gorm.DeletedAt `gorm:"index"`
 }
 
 func (User) TableName() string {
 	return "users"
 }
 
+// RefreshToken is also the record of a login session: one per device. Each
+// refresh replaces the token with a new one in the same family, so a family
+// is a session and FamilyID, the jti of its first token, its stable id.
 type RefreshToken struct {
 	ID         uint      `gorm:"primaryKey"`
 	UserID     uint      `gorm:"index;not null"`
 	TokenID    string    `gorm:"uniqueIndex;size:64;not null"` // jti
+	FamilyID   string    `gorm:"size:64;index"`
 	TokenHash  string    `gorm:"not null"`
 	ExpiresAt  time.Time `gorm:"index"`
 	Revoked    bool      `gorm:"default:false"`
 	ReplacedBy string    `gorm:"size:64"`
+	UserAgent  string    `gorm:"size:255"`
+	IP         string    `gorm:"size:64"`
+	RevokedAt  *time.Time
+	LastUsedAt time.Time
 	CreatedAt  time.Time
 }
+
+// Family returns the session id, also for tokens issued before families
+// were recorded.
+func (t *RefreshToken) Family() string {
+	if t.FamilyID == "" {
+		return t.TokenID
+	}
+	return t.FamilyID
+}
+
+// RevokedToken denylists access tokens before they expire. TokenID is the
+// jti of a single access token or the id of a revoked session, which covers
+// every access token issued in it. Entries are only needed until ExpiresAt,
+// when all tokens they match have expired too.
+type RevokedToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	TokenID   string    `gorm:"uniqueIndex;size:64;not null"`
+	UserID    uint      `gorm:"index;not null"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+const (
+	TokenPurposeVerifyEmail   = "verify_email"
+	TokenPurposeResetPassword = "reset_password"
+)
+
+// UserToken is a single-use token mailed to a user to prove they own their
+// address. Only its hash is stored.
+type UserToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    uint      `gorm:"index;not null"`
+	Purpose   string    `gorm:"size:16;not null"`
+	TokenHash string    `gorm:"uniqueIndex;size:64;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// RecoveryCode is a single-use code that replaces a TOTP code when the
+// user's authenticator is lost. Only its hash is stored.
+type RecoveryCode struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	CodeHash  string `gorm:"size:64;not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// UserIdentity links a user to an account at an OpenID Connect provider,
+// identified there by Subject.
+type UserIdentity struct {
+	ID        uint   `gorm:"primaryKey"`
+	UserID    uint   `gorm:"index;not null"`
+	Provider  string `gorm:"size:64;not null;uniqueIndex:idx_identity_subject"`
+	Subject   string `gorm:"size:255;not null;uniqueIndex:idx_identity_subject"`
+	Email     string
+	CreatedAt time.Time
+}
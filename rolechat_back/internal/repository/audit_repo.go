@@ -0,0 +1,49 @@
+package repository
+
+import (
+	"context"
+
+	"rolechat_back/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type AuditRepository interface {
+	Create(entry *models.AuditLog) error
+	List(q AuditQuery) ([]models.AuditLog, error)
+}
+
+type AuditQuery struct {
+	Event    string
+	UserID   uint
+	BeforeID uint
+	Limit    int
+}
+
+type auditRepository struct {
+	db *gorm.DB
+}
+
+func NewAuditRepository(db *gorm.DB) AuditRepository {
+	return &auditRepository{db: db}
+}
+
+func (r *auditRepository) Create(entry *models.AuditLog) error {
+	return r.db.WithContext(context.Background()).Create(entry).Error
+}
+
+func (r *auditRepository) List(aq AuditQuery) ([]models.AuditLog, error) {
+	q := r.db.WithContext(context.Background())
+	if aq.Event != "" {
+		q = q.Where("event = ?", aq.Event)
+	}
+	if aq.UserID > 0 {
+		q = q.Where("user_id = ?", aq.UserID)
+	}
+	if aq.BeforeID > 0 {
+		q = q.Where("id < ?", aq.BeforeID)
+	}
+	var res []models.AuditLog
+	err := q.Order("id DESC").Limit(aq.Limit).Find(&res).Error
+	return res, err
+}
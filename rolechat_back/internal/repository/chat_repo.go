@@ -3,7 +3,9 @@ package repository
 import (
 	"context"
 	"errors"
+	"slices"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"rolechat_back/internal/models"
@@ -14,9 +16,55 @@ import (
 type ChatRepository interface {
 	CreateTopic(userID uint, title string) (*models.Topic, error)
 	GetTopicByID(id uint) (*models.Topic, error)
-	ListTopicsByUser(userID uint, limit, offset int) ([]models.Topic, error)
-	CreateMessage(topicID uint, role, content string) (*models.Message, error)
-	ListMessagesByTopic(topicID uint, limit, offset int) ([]models.Message, error)
+	GetTopicWithTags(id uint) (*models.Topic, error)
+	RenameTopic(id uint, title string) error
+	SetGeneratedTitle(id uint, title string) (bool, error)
+	ListTopicsByUser(userID uint, filter TopicFilter, limit int, after *TopicCursor) ([]models.Topic, error)
+	UpdateTopicMeta(id uint, fields map[string]any) error
+	SetTopicTags(topicID, userID uint, tags []string) error
+	ListFolders(userID uint) ([]LabelCount, error)
+	ListTags(userID uint) ([]LabelCount, error)
+	CreateMessage(m *models.Message) error
+	CreateReply(m *models.Message) error
+	UpdateReply(id uint, content, status string) error
+	DeleteMessage(id uint) error
+	GetMessageByID(id uint) (*models.Message, error)
+	CountReplies(topicID uint) (int64, error)
+	ListMessagesByTopic(topicID uint, limit int, cursor MessageCursor) ([]models.Message, error)
+	ImportTopic(t *models.Topic, msgs []models.Message) error
+	ListAllTopicsByUser(userID uint) ([]models.Topic, error)
+	ListAllMessagesByTopic(topicID uint) ([]models.Message, error)
+	ListMessagesByTopics(topicIDs []uint) ([]models.Message, error)
+	Search(p SearchParams) ([]SearchHit, error)
+}
+
+// TopicCursor is the sort key of the last topic on the previous page.
+type TopicCursor struct {
+	Pinned    bool
+	UpdatedAt time.Time
+	ID        uint
+}
+
+// TopicFilter narrows ListTopicsByUser; nil / empty fields match everything.
+type TopicFilter struct {
+	Pinned   *bool
+	Favorite *bool
+	Folder   *string
+	Tag      string
+}
+
+type LabelCount struct {
+	Name  string
+	Count int
+}
+
+// MessageCursor selects messages older than BeforeID or newer than AfterID.
+// With neither set the most recent messages are returned, or the first ones
+// with FromStart.
+type MessageCursor struct {
+	BeforeID  uint
+	AfterID   uint
+	FromStart bool
 }
 
 type chatRepository struct {
@@ -27,19 +75,26 @@ func NewChatRepository(db *gorm.DB) ChatRepository {
 	return &chatRepository{db: db}
 }
 
-func (r *chatRepository) CreateTopic(userID uint, title string) (*models.Topic, error) {
+func normalizeTitle(title string) string {
+	title = strings.ReplaceAll(strings.TrimSpace(title), "\n", " ")
 	if title == "" {
 		title = "Untitled"
 	}
-	title = strings.ReplaceAll(strings.TrimSpace(title), "\n", " ")
 	if utf8.RuneCountInString(title) > 80 {
 		runes := []rune(title)
 		title = string(runes[:80])
 	}
-	t := &models.Topic{UserID: userID, Title: title}
+	return title
+}
+
+func (r *chatRepository) CreateTopic(userID uint, title string) (*models.Topic, error) {
+	t := &models.Topic{UserID: userID, Title: normalizeTitle(title), TitleSource: models.TitleSourceAuto}
 	if err := r.db.WithContext(context.Background()).Create(t).Error; err != nil {
 		return nil, err
 	}
+	if err := indexTopicTitle(r.db, t.ID, t.Title); err != nil {
+		return nil, err
+	}
 	return t, nil
 }
 
@@ -51,35 +106,229 @@ func (r *chatRepository) GetTopicByID(id uint) (*models.Topic, error) {
 	return &t, nil
 }
 
-func (r *chatRepository) ListTopicsByUser(userID uint, limit, offset int) ([]models.Topic, error) {
-	if limit <= 0 || limit > 100 {
-		limit = 50
+func (r *chatRepository) GetTopicWithTags(id uint) (*models.Topic, error) {
+	var t models.Topic
+	err := r.db.WithContext(context.Background()).
+		Preload("Tags", func(db *gorm.DB) *gorm.DB { return db.Order("tag ASC") }).
+		First(&t, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *chatRepository) RenameTopic(id uint, title string) error {
+	title = normalizeTitle(title)
+	err := r.db.WithContext(context.Background()).Model(&models.Topic{}).Where("id = ?", id).
+		Updates(map[string]any{"title": title, "title_source": models.TitleSourceUser}).Error
+	if err != nil {
+		return err
 	}
+	return indexTopicTitle(r.db, id, title)
+}
+
+// SetGeneratedTitle replaces the title only while it is still the one derived
+// from the first message, so a concurrent user rename always wins.
+func (r *chatRepository) SetGeneratedTitle(id uint, title string) (bool, error) {
+	title = normalizeTitle(title)
+	res := r.db.WithContext(context.Background()).Model(&models.Topic{}).
+		Where("id = ? AND title_source = ?", id, models.TitleSourceAuto).
+		Updates(map[string]any{"title": title, "title_source": models.TitleSourceAI})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return false, res.Error
+	}
+	return true, indexTopicTitle(r.db, id, title)
+}
+
+// ListTopicsByUser sorts pinned topics first, then by recent activity. The
+// caller bounds limit.
+func (r *chatRepository) ListTopicsByUser(userID uint, filter TopicFilter, limit int, after *TopicCursor) ([]models.Topic, error) {
 	var topics []models.Topic
-	err := r.db.WithContext(context.Background()).Where("user_id = ?", userID).
-		Order("updated_at DESC").
-		Limit(limit).Offset(offset).Find(&topics).Error
+	q := r.db.WithContext(context.Background()).Where("user_id = ?", userID)
+	if filter.Pinned != nil {
+		q = q.Where("pinned = ?", *filter.Pinned)
+	}
+	if filter.Favorite != nil {
+		q = q.Where("favorite = ?", *filter.Favorite)
+	}
+	if filter.Folder != nil {
+		q = q.Where("folder = ?", *filter.Folder)
+	}
+	if filter.Tag != "" {
+		q = q.Where("EXISTS (SELECT 1 FROM topic_tags tt WHERE tt.topic_id = topics.id AND tt.tag = ?)", filter.Tag)
+	}
+	if after != nil {
+		q = q.Where("(pinned, updated_at, id) < (?, ?, ?)", after.Pinned, after.UpdatedAt, after.ID)
+	}
+	err := q.Preload("Tags", func(db *gorm.DB) *gorm.DB { return db.Order("tag ASC") }).
+		Order("pinned DESC, updated_at DESC, id DESC").Limit(limit).Find(&topics).Error
 	return topics, err
 }
 
-func (r *chatRepository) CreateMessage(topicID uint, role, content string) (*models.Message, error) {
-	if content == "" {
-		return nil, errors.New("content required")
+// UpdateTopicMeta changes organisational fields without touching
+// updated_at, so pinning or filing a topic does not reorder the list.
+func (r *chatRepository) UpdateTopicMeta(id uint, fields map[string]any) error {
+	return r.db.WithContext(context.Background()).Model(&models.Topic{}).Where("id = ?", id).UpdateColumns(fields).Error
+}
+
+func (r *chatRepository) SetTopicTags(topicID, userID uint, tags []string) error {
+	return r.db.WithContext(context.Background()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("topic_id = ?", topicID).Delete(&models.TopicTag{}).Error; err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			return nil
+		}
+		rows := make([]models.TopicTag, 0, len(tags))
+		for _, tag := range tags {
+			rows = append(rows, models.TopicTag{TopicID: topicID, UserID: userID, Tag: tag})
+		}
+		return tx.Create(&rows).Error
+	})
+}
+
+func (r *chatRepository) ListFolders(userID uint) ([]LabelCount, error) {
+	var res []LabelCount
+	err := r.db.WithContext(context.Background()).Model(&models.Topic{}).
+		Select("folder AS name, COUNT(*) AS count").
+		Where("user_id = ? AND folder <> ''", userID).
+		Group("folder").Order("folder ASC").Scan(&res).Error
+	return res, err
+}
+
+func (r *chatRepository) ListTags(userID uint) ([]LabelCount, error) {
+	var res []LabelCount
+	err := r.db.WithContext(context.Background()).Table("topic_tags tt").
+		Select("tt.tag AS name, COUNT(*) AS count").
+		Joins("JOIN topics t ON t.id = tt.topic_id AND t.deleted_at IS NULL").
+		Where("tt.user_id = ?", userID).
+		Group("tt.tag").Order("tt.tag ASC").Scan(&res).Error
+	return res, err
+}
+
+func (r *chatRepository) CreateMessage(m *models.Message) error {
+	if m.Content == "" {
+		return errors.New("content required")
 	}
-	m := &models.Message{TopicID: topicID, Role: role, Content: content}
 	if err := r.db.WithContext(context.Background()).Create(m).Error; err != nil {
+		return err
+	}
+	if err := indexMessage(r.db, m.ID, m.Content); err != nil {
+		return err
+	}
+	_ = r.db.WithContext(context.Background()).Model(&models.Topic{}).Where("id = ?", m.TopicID).Update("updated_at", gorm.Expr("NOW()"))
+	return nil
+}
+
+// CreateReply stores the row of a reply that is still being generated. Its
+// content is filled in by UpdateReply as the reply streams in.
+func (r *chatRepository) CreateReply(m *models.Message) error {
+	m.Status = models.MessageStatusGenerating
+	if err := r.db.WithContext(context.Background()).Create(m).Error; err != nil {
+		return err
+	}
+	_ = r.db.WithContext(context.Background()).Model(&models.Topic{}).Where("id = ?", m.TopicID).Update("updated_at", gorm.Expr("NOW()"))
+	return nil
+}
+
+// UpdateReply checkpoints or finalises a reply. The search index is only
+// updated once the reply stops generating.
+func (r *chatRepository) UpdateReply(id uint, content, status string) error {
+	err := r.db.WithContext(context.Background()).Model(&models.Message{}).Where("id = ?", id).
+		Updates(map[string]any{"content": content, "status": status}).Error
+	if err != nil || status == models.MessageStatusGenerating {
+		return err
+	}
+	return indexMessage(r.db, id, content)
+}
+
+func (r *chatRepository) DeleteMessage(id uint) error {
+	return r.db.WithContext(context.Background()).Delete(&models.Message{}, id).Error
+}
+
+func (r *chatRepository) GetMessageByID(id uint) (*models.Message, error) {
+	var m models.Message
+	if err := r.db.WithContext(context.Background()).First(&m, id).Error; err != nil {
 		return nil, err
 	}
-	_ = r.db.WithContext(context.Background()).Model(&models.Topic{}).Where("id = ?", topicID).Update("updated_at", gorm.Expr("NOW()"))
-	return m, nil
+	return &m, nil
+}
+
+// CountReplies counts the topic's assistant messages that finished.
+func (r *chatRepository) CountReplies(topicID uint) (int64, error) {
+	var n int64
+	err := r.db.WithContext(context.Background()).Model(&models.Message{}).
+		Where("topic_id = ? AND role = ? AND status = ?", topicID, "assistant", models.MessageStatusComplete).
+		Count(&n).Error
+	return n, err
 }
 
-func (r *chatRepository) ListMessagesByTopic(topicID uint, limit, offset int) ([]models.Message, error) {
-	if limit <= 0 || limit > 200 {
-		limit = 100
+// ListMessagesByTopic always returns messages in ascending id order, whichever
+// direction the cursor pages in. The caller bounds limit.
+func (r *chatRepository) ListMessagesByTopic(topicID uint, limit int, cursor MessageCursor) ([]models.Message, error) {
+	var msgs []models.Message
+	q := r.db.WithContext(context.Background()).Where("topic_id = ?", topicID)
+	if cursor.AfterID > 0 || cursor.FromStart {
+		err := q.Where("id > ?", cursor.AfterID).Order("id ASC").Limit(limit).Find(&msgs).Error
+		return msgs, err
+	}
+	if cursor.BeforeID > 0 {
+		q = q.Where("id < ?", cursor.BeforeID)
+	}
+	if err := q.Order("id DESC").Limit(limit).Find(&msgs).Error; err != nil {
+		return nil, err
 	}
+	slices.Reverse(msgs)
+	return msgs, nil
+}
+
+// ImportTopic stores a topic with its full history in one transaction,
+// keeping the timestamps of the source.
+func (r *chatRepository) ImportTopic(t *models.Topic, msgs []models.Message) error {
+	t.Title = normalizeTitle(t.Title)
+	return r.db.WithContext(context.Background()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(t).Error; err != nil {
+			return err
+		}
+		if err := indexTopicTitle(tx, t.ID, t.Title); err != nil {
+			return err
+		}
+		for i := range msgs {
+			msgs[i].TopicID = t.ID
+		}
+		if err := tx.CreateInBatches(msgs, 200).Error; err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if err := indexMessage(tx, m.ID, m.Content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ListAllTopicsByUser and ListAllMessagesByTopic are unpaged and meant for
+// exports only.
+func (r *chatRepository) ListAllTopicsByUser(userID uint) ([]models.Topic, error) {
+	var topics []models.Topic
+	err := r.db.WithContext(context.Background()).Where("user_id = ?", userID).Order("id ASC").Find(&topics).Error
+	return topics, err
+}
+
+func (r *chatRepository) ListAllMessagesByTopic(topicID uint) ([]models.Message, error) {
 	var msgs []models.Message
-	err := r.db.WithContext(context.Background()).Where("topic_id = ?", topicID).
-		Order("id ASC").Limit(limit).Offset(offset).Find(&msgs).Error
+	err := r.db.WithContext(context.Background()).Where("topic_id = ?", topicID).Order("id ASC").Find(&msgs).Error
+	return msgs, err
+}
+
+// ListMessagesByTopics loads the messages of several topics in one query,
+// ordered by topic and then id.
+func (r *chatRepository) ListMessagesByTopics(topicIDs []uint) ([]models.Message, error) {
+	var msgs []models.Message
+	if len(topicIDs) == 0 {
+		return msgs, nil
+	}
+	err := r.db.WithContext(context.Background()).Where("topic_id IN ?", topicIDs).Order("topic_id ASC, id ASC").Find(&msgs).Error
 	return msgs, err
 }
@@ -39,8 +39,41 @@ func InitDB(dbCfg *config.DatabaseConfig) (*gorm.DB, error) {
 	if err != nil {
 		return nil, fmt.Errorf("connect db failed after retries: %w", err)
 	}
-	if err := db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Message{}, &models.RefreshToken{}, &models.RolePersona{}); err != nil {
+	if err := db.AutoMigrate(&models.User{}, &models.Topic{}, &models.Message{}, &models.RefreshToken{}, &models.RolePersona{}, &models.TopicShare{}, &models.TopicTag{}, &models.MessageFeedback{}, &models.RevokedToken{}, &models.UserToken{}, &models.AuditLog{}, &models.RecoveryCode{}, &models.UserIdentity{}); err != nil {
 		return nil, err
 	}
+	if err := ensureSearchIndexes(db); err != nil {
+		return nil, fmt.Errorf("ensure search indexes: %w", err)
+	}
+	if err := recoverGeneratingReplies(db); err != nil {
+		return nil, fmt.Errorf("recover generating replies: %w", err)
+	}
 	return db, nil
 }
+
+// recoverGeneratingReplies marks replies left generating by a crash as
+// truncated, keeping their last checkpoint, and drops the ones that had no
+// content yet, as a generation failing before its first chunk does.
+// Generations only live in the process that started them, so none of these
+// can still be running.
+func recoverGeneratingReplies(db *gorm.DB) error {
+	var msgs []models.Message
+	if err := db.Where("status = ?", models.MessageStatusGenerating).Find(&msgs).Error; err != nil {
+		return err
+	}
+	for _, m := range msgs {
+		if m.Content == "" {
+			if err := db.Delete(&models.Message{}, m.ID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err := db.Model(&models.Message{}).Where("id = ?", m.ID).Update("status", models.MessageStatusTruncated).Error; err != nil {
+			return err
+		}
+		if err := indexMessage(db, m.ID, m.Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
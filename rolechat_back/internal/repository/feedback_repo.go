@@ -0,0 +1,88 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"rolechat_back/internal/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type FeedbackRepository interface {
+	Upsert(f *models.MessageFeedback) error
+	Delete(messageID, userID uint) error
+	Stats(from, to *time.Time) ([]FeedbackStat, error)
+	List(q FeedbackQuery) ([]models.MessageFeedback, error)
+}
+
+type FeedbackStat struct {
+	Persona string
+	Model   string
+	Up      int
+	Down    int
+}
+
+type FeedbackQuery struct {
+	Rating   int // 0 matches both
+	Persona  string
+	Model    string
+	BeforeID uint
+	Limit    int
+}
+
+type feedbackRepository struct {
+	db *gorm.DB
+}
+
+func NewFeedbackRepository(db *gorm.DB) FeedbackRepository {
+	return &feedbackRepository{db: db}
+}
+
+// Upsert keeps one rating per user and message; rating again replaces it.
+func (r *feedbackRepository) Upsert(f *models.MessageFeedback) error {
+	return r.db.WithContext(context.Background()).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "message_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"rating", "reason", "updated_at"}),
+	}).Create(f).Error
+}
+
+func (r *feedbackRepository) Delete(messageID, userID uint) error {
+	return r.db.WithContext(context.Background()).Where("message_id = ? AND user_id = ?", messageID, userID).Delete(&models.MessageFeedback{}).Error
+}
+
+func (r *feedbackRepository) Stats(from, to *time.Time) ([]FeedbackStat, error) {
+	q := r.db.WithContext(context.Background()).Model(&models.MessageFeedback{}).
+		Select("persona, model, " +
+			"COUNT(*) FILTER (WHERE rating > 0) AS up, " +
+			"COUNT(*) FILTER (WHERE rating < 0) AS down")
+	if from != nil {
+		q = q.Where("created_at >= ?", *from)
+	}
+	if to != nil {
+		q = q.Where("created_at < ?", *to)
+	}
+	var stats []FeedbackStat
+	err := q.Group("persona, model").Order("down DESC, persona ASC, model ASC").Scan(&stats).Error
+	return stats, err
+}
+
+func (r *feedbackRepository) List(fq FeedbackQuery) ([]models.MessageFeedback, error) {
+	q := r.db.WithContext(context.Background())
+	if fq.Rating != 0 {
+		q = q.Where("rating = ?", fq.Rating)
+	}
+	if fq.Persona != "" {
+		q = q.Where("persona = ?", fq.Persona)
+	}
+	if fq.Model != "" {
+		q = q.Where("model = ?", fq.Model)
+	}
+	if fq.BeforeID > 0 {
+		q = q.Where("id < ?", fq.BeforeID)
+	}
+	var res []models.MessageFeedback
+	err := q.Order("id DESC").Limit(fq.Limit).Find(&res).Error
+	return res, err
+}
@@ -0,0 +1,51 @@
+package repository
+
+import (
+	"context"
+
+	"rolechat_back/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type PersonaRepository interface {
+	List() ([]models.RolePersona, error)
+	FindByKey(key string) (*models.RolePersona, error)
+	Create(p *models.RolePersona) error
+	Save(p *models.RolePersona) error
+	Delete(id uint) error
+}
+
+type personaRepository struct {
+	db *gorm.DB
+}
+
+func NewPersonaRepository(db *gorm.DB) PersonaRepository {
+	return &personaRepository{db: db}
+}
+
+func (r *personaRepository) List() ([]models.RolePersona, error) {
+	var res []models.RolePersona
+	err := r.db.WithContext(context.Background()).Order("id ASC").Find(&res).Error
+	return res, err
+}
+
+func (r *personaRepository) FindByKey(key string) (*models.RolePersona, error) {
+	var p models.RolePersona
+	if err := r.db.WithContext(context.Background()).Where("key = ?", key).First(&p).Error; err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (r *personaRepository) Create(p *models.RolePersona) error {
+	return r.db.WithContext(context.Background()).Create(p).Error
+}
+
+func (r *personaRepository) Save(p *models.RolePersona) error {
+	return r.db.WithContext(context.Background()).Save(p).Error
+}
+
+func (r *personaRepository) Delete(id uint) error {
+	return r.db.WithContext(context.Background()).Delete(&models.RolePersona{}, id).Error
+}
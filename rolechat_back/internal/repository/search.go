@@ -0,0 +1,169 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+type SearchParams struct {
+	UserID  uint
+	Query   string // tsquery literal built by utils.SearchQuery
+	Persona string
+	From    *time.Time
+	To      *time.Time
+	Limit   int
+	Offset  int
+}
+
+type SearchHit struct {
+	Kind       string // "message" or "topic"
+	MessageID  uint
+	TopicID    uint
+	TopicTitle string
+	Role       string
+	Persona    string
+	Text       string
+	CreatedAt  time.Time
+	Rank       float64
+}
+
+// ensureSearchIndexes adds the tsvector columns and GIN indexes that
+// AutoMigrate cannot express. Rows written before they existed are indexed
+// by BackfillSearchVectors.
+func ensureSearchIndexes(db *gorm.DB) error {
+	stmts := []string{
+		"ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector",
+		"ALTER TABLE topics ADD COLUMN IF NOT EXISTS search_vector tsvector",
+		"CREATE INDEX IF NOT EXISTS idx_messages_search_vector ON messages USING GIN (search_vector)",
+		"CREATE INDEX IF NOT EXISTS idx_topics_search_vector ON topics USING GIN (search_vector)",
+	}
+	for _, stmt := range stmts {
+		if err := db.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// searchBackfillBatch is how many rows BackfillSearchVectors indexes per
+// statement.
+const searchBackfillBatch = 500
+
+// BackfillSearchVectors indexes the messages and topic titles written before
+// search existed. It can take a while on a large database, so the server
+// runs it in the background after starting; until it finishes, older
+// conversations are missing from search results. Rows written meanwhile are
+// indexed as usual and left alone here.
+func BackfillSearchVectors(db *gorm.DB) error {
+	if err := backfillSearchTable(db, "messages", "content"); err != nil {
+		return err
+	}
+	return backfillSearchTable(db, "topics", "title")
+}
+
+func backfillSearchTable(db *gorm.DB, table, column string) error {
+	var last uint
+	for {
+		var rows []struct {
+			ID   uint
+			Text string
+		}
+		err := db.Raw("SELECT id, "+column+" AS text FROM "+table+" WHERE search_vector IS NULL AND id > ? ORDER BY id LIMIT ?", last, searchBackfillBatch).
+			Scan(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+		values := make([]string, len(rows))
+		args := make([]any, 0, 2*len(rows))
+		for i, row := range rows {
+			values[i] = "(?::bigint, ?::tsvector)"
+			args = append(args, row.ID, utils.SearchVector(row.Text))
+		}
+		// Only rows still unindexed are written: a reply finished since the
+		// select has already been indexed with its final content.
+		stmt := "UPDATE " + table + " AS t SET search_vector = v.vec FROM (VALUES " + strings.Join(values, ", ") +
+			") AS v(id, vec) WHERE t.id = v.id AND t.search_vector IS NULL"
+		if err := db.Exec(stmt, args...).Error; err != nil {
+			return err
+		}
+		if len(rows) < searchBackfillBatch {
+			return nil
+		}
+		last = rows[len(rows)-1].ID
+	}
+}
+
+func indexMessage(db *gorm.DB, id uint, content string) error {
+	return db.WithContext(context.Background()).Model(&models.Message{}).Where("id = ?", id).
+		UpdateColumn("search_vector", gorm.Expr("?::tsvector", utils.SearchVector(content))).Error
+}
+
+func indexTopicTitle(db *gorm.DB, id uint, title string) error {
+	return db.WithContext(context.Background()).Model(&models.Topic{}).Where("id = ?", id).
+		UpdateColumn("search_vector", gorm.Expr("?::tsvector", utils.SearchVector(title))).Error
+}
+
+// Search ranks the user's messages and topic titles against p.Query. Title
+// hits are weighted up since a matching title usually describes the whole
+// conversation.
+func (r *chatRepository) Search(p SearchParams) ([]SearchHit, error) {
+	var (
+		msgWhere   strings.Builder
+		topicWhere strings.Builder
+		args       []any
+	)
+	args = append(args, p.Query, p.UserID)
+	if p.Persona != "" {
+		msgWhere.WriteString(" AND m.persona = ?")
+		args = append(args, p.Persona)
+	}
+	if p.From != nil {
+		msgWhere.WriteString(" AND m.created_at >= ?")
+		args = append(args, *p.From)
+	}
+	if p.To != nil {
+		msgWhere.WriteString(" AND m.created_at < ?")
+		args = append(args, *p.To)
+	}
+	args = append(args, p.UserID)
+	if p.Persona != "" {
+		topicWhere.WriteString(" AND EXISTS (SELECT 1 FROM messages pm WHERE pm.topic_id = t.id AND pm.persona = ? AND pm.deleted_at IS NULL)")
+		args = append(args, p.Persona)
+	}
+	if p.From != nil {
+		topicWhere.WriteString(" AND t.created_at >= ?")
+		args = append(args, *p.From)
+	}
+	if p.To != nil {
+		topicWhere.WriteString(" AND t.created_at < ?")
+		args = append(args, *p.To)
+	}
+	args = append(args, p.Limit, p.Offset)
+
+	sql := `WITH q AS (SELECT ?::tsquery AS query)
+SELECT * FROM (
+	SELECT 'message' AS kind, m.id AS message_id, m.topic_id, t.title AS topic_title, m.role, m.persona,
+		m.content AS text, m.created_at, ts_rank_cd(m.search_vector, q.query) AS rank
+	FROM messages m JOIN topics t ON t.id = m.topic_id, q
+	WHERE t.user_id = ? AND m.deleted_at IS NULL AND t.deleted_at IS NULL
+		AND m.search_vector @@ q.query` + msgWhere.String() + `
+	UNION ALL
+	SELECT 'topic' AS kind, 0 AS message_id, t.id AS topic_id, t.title AS topic_title, '' AS role, '' AS persona,
+		t.title AS text, t.created_at, ts_rank_cd(t.search_vector, q.query) * 2 AS rank
+	FROM topics t, q
+	WHERE t.user_id = ? AND t.deleted_at IS NULL
+		AND t.search_vector @@ q.query` + topicWhere.String() + `
+) hits
+ORDER BY rank DESC, created_at DESC
+LIMIT ? OFFSET ?`
+
+	var hits []SearchHit
+	err := r.db.WithContext(context.Background()).Raw(sql, args...).Scan(&hits).Error
+	return hits, err
+}
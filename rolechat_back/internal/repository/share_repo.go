@@ -0,0 +1,55 @@
+package repository
+
+import (
+	"context"
+
+	"rolechat_back/internal/models"
+
+	"gorm.io/gorm"
+)
+
+type ShareRepository interface {
+	Create(s *models.TopicShare) error
+	GetByID(id uint) (*models.TopicShare, error)
+	GetByTokenHash(hash string) (*models.TopicShare, error)
+	ListByTopic(topicID uint) ([]models.TopicShare, error)
+	Revoke(id uint) error
+}
+
+type shareRepository struct {
+	db *gorm.DB
+}
+
+func NewShareRepository(db *gorm.DB) ShareRepository {
+	return &shareRepository{db: db}
+}
+
+func (r *shareRepository) Create(s *models.TopicShare) error {
+	return r.db.WithContext(context.Background()).Create(s).Error
+}
+
+func (r *shareRepository) GetByID(id uint) (*models.TopicShare, error) {
+	var s models.TopicShare
+	if err := r.db.WithContext(context.Background()).First(&s, id).Error; err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *shareRepository) GetByTokenHash(hash string) (*models.TopicShare, error) {
+	var s models.TopicShare
+	if err := r.db.WithContext(context.Background()).Where("token_hash = ?", hash).First(&s).Error; err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (r *shareRepository) ListByTopic(topicID uint) ([]models.TopicShare, error) {
+	var shares []models.TopicShare
+	err := r.db.WithContext(context.Background()).Where("topic_id = ?", topicID).Order("id DESC").Find(&shares).Error
+	return shares, err
+}
+
+func (r *shareRepository) Revoke(id uint) error {
+	return r.db.WithContext(context.Background()).Model(&models.TopicShare{}).Where("id = ?", id).Update("revoked", true).Error
+}
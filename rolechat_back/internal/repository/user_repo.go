@@ -2,18 +2,53 @@ package repository
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
 	"rolechat_back/internal/models"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type UserRepository interface {
 	Create(user *models.User) error
 	FindByEmail(email string) (*models.User, error)
+	FindByID(id uint) (*models.User, error)
 	SaveRefreshToken(t *models.RefreshToken) error
 	GetRefreshTokenByJTI(jti string) (*models.RefreshToken, error)
-	RevokeRefreshToken(jti, replacedBy string) error
+	RevokeRefreshToken(jti, replacedBy string) (bool, error)
+	RevokeRefreshTokenFamily(familyID string) error
+	ListActiveRefreshTokens(userID uint) ([]models.RefreshToken, error)
+	RevokeAllRefreshTokens(userID uint) error
+	SetTokensValidAfter(userID uint, t time.Time) error
+	RevokeAccessToken(t *models.RevokedToken) error
+	ListRevokedTokens() ([]models.RevokedToken, error)
+	ListUsers(q UserQuery) ([]models.User, error)
+	UpdateUser(id uint, fields map[string]any) error
+	CreateUserToken(t *models.UserToken) error
+	GetUserTokenByHash(hash string) (*models.UserToken, error)
+	LatestUserToken(userID uint, purpose string) (*models.UserToken, error)
+	UseUserToken(t *models.UserToken) (bool, error)
+	DeleteUser(id uint) error
+	SetTOTPStep(userID uint, step int64) (bool, error)
+	ReplaceRecoveryCodes(userID uint, hashes []string) error
+	UseRecoveryCode(userID uint, hash string) (bool, error)
+	CountRecoveryCodes(userID uint) (int64, error)
+	FindIdentity(provider, subject string) (*models.UserIdentity, error)
+	CreateUserWithIdentity(user *models.User, identity *models.UserIdentity) error
+	CreateIdentity(identity *models.UserIdentity) error
+}
+
+// UserQuery filters the user list for admins. Search matches email or
+// nickname.
+type UserQuery struct {
+	Search   string
+	Role     string
+	Status   string
+	BeforeID uint
+	Limit    int
 }
 
 type userRepository struct {
@@ -36,6 +71,14 @@ func (r *userRepository) FindByEmail(email string) (*models.User, error) {
 	return &user, nil
 }
 
+func (r *userRepository) FindByID(id uint) (*models.User, error) {
+	var user models.User
+	if err := r.db.WithContext(context.Background()).First(&user, id).Error; err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (r *userRepository) SaveRefreshToken(t *models.RefreshToken) error {
 	return r.db.WithContext(context.Background()).Create(t).Error
 }
@@ -48,7 +91,222 @@ func (r *userRepository) GetRefreshTokenByJTI(jti string) (*models.RefreshToken,
 	return &rt, nil
 }
 
-func (r *userRepository) RevokeRefreshToken(jti, replacedBy string) error {
-	return r.db.WithContext(context.Background()).Model(&models.RefreshToken{}).Where("token_id = ? AND revoked = false", jti).Updates(map[string]any{"revoked": true, "replaced_by": replacedBy}).Error
+// RevokeRefreshToken reports whether this call revoked the token, so of two
+// concurrent rotations only one succeeds.
+func (r *userRepository) RevokeRefreshToken(jti, replacedBy string) (bool, error) {
+	res := r.db.WithContext(context.Background()).Model(&models.RefreshToken{}).Where("token_id = ? AND revoked = false", jti).Updates(map[string]any{"revoked": true, "revoked_at": time.Now(), "replaced_by": replacedBy})
+	return res.RowsAffected == 1, res.Error
+}
+
+func (r *userRepository) RevokeRefreshTokenFamily(familyID string) error {
+	return r.db.WithContext(context.Background()).Model(&models.RefreshToken{}).
+		Where("(family_id = ? OR token_id = ?) AND revoked = false", familyID, familyID).
+		Updates(map[string]any{"revoked": true, "revoked_at": time.Now()}).Error
+}
+
+// ListActiveRefreshTokens returns the user's sessions that can still be
+// refreshed, most recently used first.
+func (r *userRepository) ListActiveRefreshTokens(userID uint) ([]models.RefreshToken, error) {
+	var tokens []models.RefreshToken
+	err := r.db.WithContext(context.Background()).
+		Where("user_id = ? AND revoked = false AND expires_at > ?", userID, time.Now()).
+		Order("last_used_at DESC, id DESC").Find(&tokens).Error
+	return tokens, err
+}
+
+func (r *userRepository) RevokeAllRefreshTokens(userID uint) error {
+	return r.db.WithContext(context.Background()).Model(&models.RefreshToken{}).Where("user_id = ? AND revoked = false", userID).
+		Updates(map[string]any{"revoked": true, "revoked_at": time.Now()}).Error
+}
+
+func (r *userRepository) SetTokensValidAfter(userID uint, t time.Time) error {
+	return r.db.WithContext(context.Background()).Model(&models.User{}).Where("id = ?", userID).Update("tokens_valid_after", t).Error
+}
+
+// RevokeAccessToken adds t to the denylist, ignoring ids already on it, and
+// drops entries that have expired.
+func (r *userRepository) RevokeAccessToken(t *models.RevokedToken) error {
+	db := r.db.WithContext(context.Background())
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(t).Error; err != nil {
+		return err
+	}
+	return db.Where("expires_at <= ?", time.Now()).Delete(&models.RevokedToken{}).Error
+}
+
+// ListRevokedTokens returns the denylist entries that can still match an
+// unexpired token.
+func (r *userRepository) ListRevokedTokens() ([]models.RevokedToken, error) {
+	var tokens []models.RevokedToken
+	err := r.db.WithContext(context.Background()).Where("expires_at > ?", time.Now()).Find(&tokens).Error
+	return tokens, err
+}
+
+func (r *userRepository) ListUsers(uq UserQuery) ([]models.User, error) {
+	q := r.db.WithContext(context.Background())
+	if uq.Search != "" {
+		like := "%" + escapeLike(uq.Search) + "%"
+		q = q.Where("email ILIKE ? OR nickname ILIKE ?", like, like)
+	}
+	if uq.Role != "" {
+		q = q.Where("role = ?", uq.Role)
+	}
+	if uq.Status != "" {
+		q = q.Where("status = ?", uq.Status)
+	}
+	if uq.BeforeID > 0 {
+		q = q.Where("id < ?", uq.BeforeID)
+	}
+	var users []models.User
+	err := q.Order("id DESC").Limit(uq.Limit).Find(&users).Error
+	return users, err
+}
+
+func (r *userRepository) UpdateUser(id uint, fields map[string]any) error {
+	return r.db.WithContext(context.Background()).Model(&models.User{}).Where("id = ?", id).Updates(fields).Error
+}
+
+func (r *userRepository) CreateUserToken(t *models.UserToken) error {
+	return r.db.WithContext(context.Background()).Create(t).Error
+}
+
+func (r *userRepository) GetUserTokenByHash(hash string) (*models.UserToken, error) {
+	var t models.UserToken
+	if err := r.db.WithContext(context.Background()).Where("token_hash = ?", hash).First(&t).Error; err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (r *userRepository) LatestUserToken(userID uint, purpose string) (*models.UserToken, error) {
+	var t models.UserToken
+	err := r.db.WithContext(context.Background()).Where("user_id = ? AND purpose = ?", userID, purpose).
+		Order("id DESC").First(&t).Error
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// UseUserToken marks t used, along with every other unused token the user
+// has for the same purpose. It reports whether t was still usable, so a
+// token works once even under concurrent requests.
+func (r *userRepository) UseUserToken(t *models.UserToken) (bool, error) {
+	var used bool
+	err := r.db.WithContext(context.Background()).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		res := tx.Model(&models.UserToken{}).Where("id = ? AND used_at IS NULL AND expires_at > ?", t.ID, now).Update("used_at", now)
+		if res.Error != nil || res.RowsAffected == 0 {
+			return res.Error
+		}
+		used = true
+		return tx.Model(&models.UserToken{}).Where("user_id = ? AND purpose = ? AND used_at IS NULL", t.UserID, t.Purpose).Update("used_at", now).Error
+	})
+	return used, err
+}
+
+// DeleteUser deletes the user's topics, messages, shares, ratings and
+// tokens. The user row is kept, soft-deleted and stripped of personal data,
+// so ids in logs and the token denylist stay meaningful and the address can
+// be registered again.
+func (r *userRepository) DeleteUser(id uint) error {
+	return r.db.WithContext(context.Background()).Transaction(func(tx *gorm.DB) error {
+		topics := tx.Unscoped().Model(&models.Topic{}).Select("id").Where("user_id = ?", id)
+		messages := tx.Unscoped().Model(&models.Message{}).Select("id").Where("topic_id IN (?)", topics)
+		if err := tx.Where("user_id = ? OR message_id IN (?)", id, messages).Delete(&models.MessageFeedback{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("topic_id IN (?)", topics).Delete(&models.Message{}).Error; err != nil {
+			return err
+		}
+		for _, m := range []any{&models.TopicTag{}, &models.TopicShare{}, &models.RefreshToken{}, &models.UserToken{}, &models.RecoveryCode{}, &models.UserIdentity{}} {
+			if err := tx.Where("user_id = ?", id).Delete(m).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("user_id = ?", id).Delete(&models.Topic{}).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&models.User{}).Where("id = ?", id).Updates(map[string]any{
+			"email":         fmt.Sprintf("deleted-%d@deleted.invalid", id),
+			"password_hash": "",
+			"nickname":      "",
+			"avatar_url":    "",
+			"totp_secret":   "",
+			"totp_enabled":  false,
+			"status":        models.UserStatusDisabled,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&models.User{}, id).Error
+	})
+}
+
+// SetTOTPStep records the time step of an accepted TOTP code. It reports
+// false if that step or a later one was already used, so each code works
+// once.
+func (r *userRepository) SetTOTPStep(userID uint, step int64) (bool, error) {
+	res := r.db.WithContext(context.Background()).Model(&models.User{}).
+		Where("id = ? AND totp_last_step < ?", userID, step).Update("totp_last_step", step)
+	return res.RowsAffected == 1, res.Error
 }
 
+func (r *userRepository) ReplaceRecoveryCodes(userID uint, hashes []string) error {
+	return r.db.WithContext(context.Background()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if len(hashes) == 0 {
+			return nil
+		}
+		codes := make([]models.RecoveryCode, 0, len(hashes))
+		for _, h := range hashes {
+			codes = append(codes, models.RecoveryCode{UserID: userID, CodeHash: h})
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+func (r *userRepository) UseRecoveryCode(userID uint, hash string) (bool, error) {
+	res := r.db.WithContext(context.Background()).Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).Update("used_at", time.Now())
+	return res.RowsAffected > 0, res.Error
+}
+
+func (r *userRepository) CountRecoveryCodes(userID uint) (int64, error) {
+	var n int64
+	err := r.db.WithContext(context.Background()).Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND used_at IS NULL", userID).Count(&n).Error
+	return n, err
+}
+
+func (r *userRepository) FindIdentity(provider, subject string) (*models.UserIdentity, error) {
+	var id models.UserIdentity
+	if err := r.db.WithContext(context.Background()).Where("provider = ? AND subject = ?", provider, subject).First(&id).Error; err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
+
+// CreateUserWithIdentity creates a user who signed up through a provider,
+// together with the link to it.
+func (r *userRepository) CreateUserWithIdentity(user *models.User, identity *models.UserIdentity) error {
+	return r.db.WithContext(context.Background()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		identity.UserID = user.ID
+		return tx.Create(identity).Error
+	})
+}
+
+func (r *userRepository) CreateIdentity(identity *models.UserIdentity) error {
+	return r.db.WithContext(context.Background()).Create(identity).Error
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike makes s match literally inside a LIKE pattern.
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
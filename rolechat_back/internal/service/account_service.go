@@ -0,0 +1,178 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/pkg/config"
+	"rolechat_back/pkg/logger"
+	"rolechat_back/pkg/mailer"
+	"rolechat_back/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+const (
+	verifyEmailTokenTTL   = 24 * time.Hour
+	resetPasswordTokenTTL = time.Hour
+	// accountMailInterval is how soon another mail of the same kind may be
+	// sent to a user.
+	accountMailInterval = time.Minute
+)
+
+var errInvalidAccountToken = errors.New("invalid or expired token")
+
+// AccountService runs the flows that prove a user owns their email address:
+// verifying it and resetting a forgotten password. The request methods do
+// not reveal whether an address is registered.
+type AccountService interface {
+	RequestEmailVerification(email string) error
+	VerifyEmail(token string) error
+	RequestPasswordReset(email string) error
+	ResetPassword(token, newPassword string) error
+}
+
+type accountService struct {
+	repo   repository.UserRepository
+	mailer mailer.Mailer
+	guard  *TokenGuard
+	cfg    *config.Config
+}
+
+func NewAccountService(repo repository.UserRepository, m mailer.Mailer, guard *TokenGuard, cfg *config.Config) AccountService {
+	return &accountService{repo: repo, mailer: m, guard: guard, cfg: cfg}
+}
+
+// issue creates a token for the user unless one was sent moments ago, and
+// mails the link to it in the background.
+func (s *accountService) issue(user *models.User, purpose string, ttl time.Duration, subject, text, path string) error {
+	if last, err := s.repo.LatestUserToken(user.ID, purpose); err == nil && time.Since(last.CreatedAt) < accountMailInterval {
+		return nil
+	}
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.CreateUserToken(&models.UserToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		TokenHash: utils.HashToken(token),
+		ExpiresAt: time.Now().Add(ttl),
+	}); err != nil {
+		return err
+	}
+	link := strings.TrimRight(s.cfg.App.BaseURL, "/") + path + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf("%s\n\n%s\n\n如果这不是你本人的操作，请忽略这封邮件。\n", text, link)
+	go func() {
+		if err := s.mailer.Send(user.Email, subject, body); err != nil {
+			logger.Warnf("send %s mail to user %d: %v", purpose, user.ID, err)
+		}
+	}()
+	return nil
+}
+
+// consume returns the user a valid token of purpose was issued to and
+// marks it used.
+func (s *accountService) consume(token, purpose string) (*models.User, error) {
+	t, err := s.repo.GetUserTokenByHash(utils.HashToken(token))
+	if err != nil || t.Purpose != purpose {
+		return nil, errInvalidAccountToken
+	}
+	ok, err := s.repo.UseUserToken(t)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errInvalidAccountToken
+	}
+	user, err := s.repo.FindByID(t.UserID)
+	if err != nil {
+		return nil, errInvalidAccountToken
+	}
+	return user, nil
+}
+
+// findForMail returns nil, without an error, for addresses that are not
+// registered.
+func (s *accountService) findForMail(email string) (*models.User, error) {
+	user, err := s.repo.FindByEmail(email)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return user, err
+}
+
+// verifiedFields marks the address verified and activates accounts that
+// were waiting for it.
+func verifiedFields(user *models.User) map[string]any {
+	fields := map[string]any{}
+	if user.EmailVerifiedAt == nil {
+		fields["email_verified_at"] = time.Now()
+	}
+	if user.Status == models.UserStatusPending {
+		fields["status"] = models.UserStatusActive
+	}
+	return fields
+}
+
+func (s *accountService) RequestEmailVerification(email string) error {
+	user, err := s.findForMail(email)
+	if err != nil || user == nil || user.EmailVerifiedAt != nil {
+		return err
+	}
+	return s.issue(user, models.TokenPurposeVerifyEmail, verifyEmailTokenTTL,
+		"验证你的 RoleChat 邮箱", "请打开下面的链接验证邮箱，链接 24 小时内有效：", "/verify-email")
+}
+
+func (s *accountService) VerifyEmail(token string) error {
+	user, err := s.consume(token, models.TokenPurposeVerifyEmail)
+	if err != nil {
+		return err
+	}
+	if fields := verifiedFields(user); len(fields) > 0 {
+		if err := s.repo.UpdateUser(user.ID, fields); err != nil {
+			return err
+		}
+		s.guard.Forget(user.ID)
+	}
+	return nil
+}
+
+func (s *accountService) RequestPasswordReset(email string) error {
+	user, err := s.findForMail(email)
+	if err != nil || user == nil || user.Status == models.UserStatusDisabled {
+		return err
+	}
+	return s.issue(user, models.TokenPurposeResetPassword, resetPasswordTokenTTL,
+		"重置你的 RoleChat 密码", "请打开下面的链接设置新密码，链接 1 小时内有效：", "/reset-password")
+}
+
+// ResetPassword sets a new password and logs the user out everywhere. The
+// mailed link also proves the address, so it counts as verified.
+func (s *accountService) ResetPassword(token, newPassword string) error {
+	if len(newPassword) < 6 {
+		return errors.New("password must be at least 6 characters")
+	}
+	user, err := s.consume(token, models.TokenPurposeResetPassword)
+	if err != nil {
+		return err
+	}
+	hash, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	fields := verifiedFields(user)
+	fields["password_hash"] = hash
+	if err := s.repo.UpdateUser(user.ID, fields); err != nil {
+		return err
+	}
+	if err := s.repo.RevokeAllRefreshTokens(user.ID); err != nil {
+		return err
+	}
+	return s.guard.RevokeAll(user.ID)
+}
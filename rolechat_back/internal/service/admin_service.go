@@ -0,0 +1,128 @@
+package service
+
+import (
+	"errors"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+)
+
+// AdminService backs the /api/admin endpoints. Callers must already have
+// checked that the acting user is an admin.
+type AdminService interface {
+	ListUsers(q repository.UserQuery, cursor string) (users []models.User, nextCursor string, err error)
+	GetUser(userID uint) (*models.User, error)
+	// UpdateUser changes another user's role or status. Disabling a user
+	// also ends all of their sessions.
+	UpdateUser(adminID, userID uint, upd UserUpdate) (*models.User, error)
+	GetTopic(topicID uint) (*models.Topic, error)
+	ListTopicMessages(topicID uint, limit int, cursor string) (msgs []models.Message, nextCursor, prevCursor string, err error)
+	ListAudit(q repository.AuditQuery, cursor string) (entries []models.AuditLog, nextCursor string, err error)
+}
+
+// UserUpdate holds the user fields to change; nil fields are left as they
+// are.
+type UserUpdate struct {
+	Role   *string
+	Status *string
+}
+
+type adminService struct {
+	userRepo  repository.UserRepository
+	chatRepo  repository.ChatRepository
+	auditRepo repository.AuditRepository
+	guard     *TokenGuard
+}
+
+func NewAdminService(userRepo repository.UserRepository, chatRepo repository.ChatRepository, auditRepo repository.AuditRepository, guard *TokenGuard) AdminService {
+	return &adminService{userRepo: userRepo, chatRepo: chatRepo, auditRepo: auditRepo, guard: guard}
+}
+
+func (s *adminService) ListUsers(q repository.UserQuery, cursor string) ([]models.User, string, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	limit := pageLimit(q.Limit, defaultAdminPage, maxAdminPage)
+	q.BeforeID = c.Before
+	q.Limit = limit + 1
+	users, err := s.userRepo.ListUsers(q)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(users) <= limit {
+		return users, "", nil
+	}
+	users = users[:limit]
+	return users, encodeCursor(pageCursor{Before: users[len(users)-1].ID}), nil
+}
+
+func (s *adminService) GetUser(userID uint) (*models.User, error) {
+	return s.userRepo.FindByID(userID)
+}
+
+func (s *adminService) UpdateUser(adminID, userID uint, upd UserUpdate) (*models.User, error) {
+	if adminID == userID {
+		return nil, errors.New("cannot change your own role or status")
+	}
+	fields := map[string]any{}
+	if upd.Role != nil {
+		if *upd.Role != models.RoleUser && *upd.Role != models.RoleAdmin {
+			return nil, errors.New("invalid role")
+		}
+		fields["role"] = *upd.Role
+	}
+	if upd.Status != nil {
+		if *upd.Status != models.UserStatusActive && *upd.Status != models.UserStatusDisabled {
+			return nil, errors.New("invalid status")
+		}
+		fields["status"] = *upd.Status
+	}
+	u, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return u, nil
+	}
+	if err := s.userRepo.UpdateUser(userID, fields); err != nil {
+		return nil, err
+	}
+	if upd.Status != nil && *upd.Status == models.UserStatusDisabled && u.Status != models.UserStatusDisabled {
+		if err := s.userRepo.RevokeAllRefreshTokens(userID); err != nil {
+			return nil, err
+		}
+	}
+	s.guard.Forget(userID)
+	return s.userRepo.FindByID(userID)
+}
+
+func (s *adminService) GetTopic(topicID uint) (*models.Topic, error) {
+	return s.chatRepo.GetTopicWithTags(topicID)
+}
+
+func (s *adminService) ListTopicMessages(topicID uint, limit int, cursor string) ([]models.Message, string, string, error) {
+	if _, err := s.chatRepo.GetTopicByID(topicID); err != nil {
+		return nil, "", "", err
+	}
+	return pageTopicMessages(s.chatRepo, topicID, limit, cursor)
+}
+
+func (s *adminService) ListAudit(q repository.AuditQuery, cursor string) ([]models.AuditLog, string, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	limit := pageLimit(q.Limit, defaultAdminPage, maxAdminPage)
+	q.BeforeID = c.Before
+	q.Limit = limit + 1
+	entries, err := s.auditRepo.List(q)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(entries) <= limit {
+		return entries, "", nil
+	}
+	entries = entries[:limit]
+	return entries, encodeCursor(pageCursor{Before: entries[len(entries)-1].ID}), nil
+}
@@ -2,35 +2,87 @@ package service
 
 import (
 	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
 	"rolechat_back/internal/models"
 	"rolechat_back/internal/repository"
 	"rolechat_back/pkg/ai"
+	"rolechat_back/pkg/logger"
 )
 
 type AIService interface {
-	GenerateRoleReply(userID uint, topicID uint, persona *models.RolePersona, userMessage string) (replyText string, audioBase64 string, err error)
-	StreamRoleReply(userID uint, topicID uint, persona *models.RolePersona, userMessage string) (<-chan string, <-chan error, error)
+	GenerateRoleReply(userID uint, topicID uint, persona *models.RolePersona, userMessage string) (replyText string, audioBase64 string, model string, err error)
+	// StreamRoleReply starts generating a reply in the background and returns
+	// the generation to subscribe to. The reply is saved when it ends.
+	StreamRoleReply(req StreamRequest) (*Generation, error)
+	GenerateTopicTitle(topicID uint) error
+	// StreamModel is the model StreamRoleReply generates with.
+	StreamModel() string
+}
+
+// StreamRequest is a user message, already saved, to be answered by a
+// streamed reply.
+type StreamRequest struct {
+	UserID      uint
+	TopicID     uint
+	NewTopic    bool
+	PersonaKey  string
+	UserMessage *models.Message
+	// Chunking overrides the persona's chunking strategy when set.
+	Chunking ChunkOptions
 }
 
 type aiService struct {
-	chatRepo repository.ChatRepository
-	client   *ai.ZhipuClient
+	chatRepo    repository.ChatRepository
+	client      *ai.ZhipuClient
+	generations *GenerationRegistry
+	notifier    *Notifier
+}
+
+func NewAIService(chatRepo repository.ChatRepository, client *ai.ZhipuClient, generations *GenerationRegistry, notifier *Notifier) AIService {
+	return &aiService{chatRepo: chatRepo, client: client, generations: generations, notifier: notifier}
+}
+
+// historyMessages is how many earlier messages of the topic are sent with a
+// prompt. They are the most recent ones: before cursors the first 30 were
+// sent, so in a long conversation the model never saw the recent turns it
+// was asked to continue.
+const historyMessages = 30
+
+// withoutPending drops the user message being answered from the stored
+// history, since callers save it before asking for a reply and it is
+// appended to the prompt separately.
+func withoutPending(msgs []models.Message, userMessage string) []models.Message {
+	if n := len(msgs); n > 0 && msgs[n-1].Role == "user" && msgs[n-1].Content == userMessage {
+		return msgs[:n-1]
+	}
+	return msgs
 }
 
-func NewAIService(chatRepo repository.ChatRepository, client *ai.ZhipuClient) AIService {
-	return &aiService{chatRepo: chatRepo, client: client}
+// inHistory reports whether m is sent to the model as context. Replies still
+// being generated and ones that failed are left out, so the model does not
+// continue a broken answer.
+func inHistory(m models.Message) bool {
+	return m.Status != models.MessageStatusGenerating && m.Status != models.MessageStatusFailed && m.Content != ""
 }
 
-func (s *aiService) GenerateRoleReply(userID, topicID uint, persona *models.RolePersona, userMessage string) (string, string, error) {
-	msgs, err := s.chatRepo.ListMessagesByTopic(topicID, 30, 0)
+func (s *aiService) GenerateRoleReply(userID, topicID uint, persona *models.RolePersona, userMessage string) (string, string, string, error) {
+	msgs, err := s.chatRepo.ListMessagesByTopic(topicID, historyMessages, repository.MessageCursor{})
 	if err != nil {
-		return "", "", err
+		return "", "", "", err
 	}
+	msgs = withoutPending(msgs, userMessage)
 	chatMsgs := make([]ai.ChatMessage, 0, len(msgs)+3)
 	if persona != nil && persona.SystemPrompt != "" {
 		chatMsgs = append(chatMsgs, ai.ChatMessage{Role: "system", Content: persona.SystemPrompt})
 	}
 	for _, m := range msgs {
+		if !inHistory(m) {
+			continue
+		}
 		role := m.Role
 		if role == "" {
 			role = "user"
@@ -41,12 +93,12 @@ func (s *aiService) GenerateRoleReply(userID, topicID uint, persona *models.Role
 	if persona != nil && persona.Voice != "" {
 		text, audio, err := s.client.ChatVoice(chatMsgs)
 		if err == nil && text != "" {
-			return text, audio, nil
+			return text, audio, s.client.VoiceModel(), nil
 		}
 	}
 	text, err := s.client.Chat(chatMsgs)
 	if err != nil {
-		return "", "", fmt.Errorf("chat generation failed: %w", err)
+		return "", "", "", fmt.Errorf("chat generation failed: %w", err)
 	}
 	voice := "default"
 	if persona != nil && persona.Voice != "" {
@@ -54,21 +106,39 @@ func (s *aiService) GenerateRoleReply(userID, topicID uint, persona *models.Role
 	}
 	audio, err := s.client.TextToSpeech(text, voice)
 	if err != nil {
-		return text, "", fmt.Errorf("tts failed: %w", err)
+		return text, "", s.client.ChatModel(), fmt.Errorf("tts failed: %w", err)
 	}
-	return text, audio, nil
+	return text, audio, s.client.ChatModel(), nil
+}
+
+func (s *aiService) StreamModel() string {
+	return s.client.ChatModel()
 }
 
-func (s *aiService) StreamRoleReply(userID uint, topicID uint, persona *models.RolePersona, userMessage string) (<-chan string, <-chan error, error) {
-	msgs, err := s.chatRepo.ListMessagesByTopic(topicID, 30, 0)
+func (s *aiService) StreamRoleReply(req StreamRequest) (*Generation, error) {
+	persona := LookupPersona(req.PersonaKey)
+	chunkOpts := req.Chunking
+	if chunkOpts.Strategy == "" && persona != nil {
+		chunkOpts.Strategy = persona.Chunking
+	}
+	chunker, err := NewChunker(chunkOpts)
+	if err != nil {
+		return nil, err
+	}
+	userMessage := req.UserMessage.Content
+	msgs, err := s.chatRepo.ListMessagesByTopic(req.TopicID, historyMessages, repository.MessageCursor{})
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	msgs = withoutPending(msgs, userMessage)
 	chatMsgs := make([]ai.ChatMessage, 0, len(msgs)+3)
 	if persona != nil && persona.SystemPrompt != "" {
 		chatMsgs = append(chatMsgs, ai.ChatMessage{Role: "system", Content: persona.SystemPrompt})
 	}
 	for _, m := range msgs {
+		if !inHistory(m) {
+			continue
+		}
 		role := m.Role
 		if role == "" {
 			role = "user"
@@ -76,6 +146,248 @@ func (s *aiService) StreamRoleReply(userID uint, topicID uint, persona *models.R
 		chatMsgs = append(chatMsgs, ai.ChatMessage{Role: role, Content: m.Content})
 	}
 	chatMsgs = append(chatMsgs, ai.ChatMessage{Role: "user", Content: userMessage})
-	tokenCh, errCh := s.client.ChatStream(chatMsgs)
-	return tokenCh, errCh, nil
+	reply := &models.Message{TopicID: req.TopicID, Role: "assistant", Persona: req.PersonaKey, Model: s.StreamModel()}
+	if err := s.chatRepo.CreateReply(reply); err != nil {
+		return nil, err
+	}
+	g, err := s.generations.Start(req.UserID, req.TopicID, GenerationMeta{
+		NewTopic:       req.NewTopic,
+		UserMessageID:  req.UserMessage.ID,
+		ReplyMessageID: reply.ID,
+		Persona:        req.PersonaKey,
+		Model:          reply.Model,
+	})
+	if err != nil {
+		if derr := s.chatRepo.DeleteMessage(reply.ID); derr != nil {
+			logger.Warnf("delete unstarted reply %d: %v", reply.ID, derr)
+		}
+		return nil, err
+	}
+	chunkCh, errCh := s.client.ChatStream(g.Context(), chatMsgs)
+	s.notifier.Publish(req.UserID, Notification{Type: NotifyTyping, TopicID: req.TopicID, Role: "assistant", Typing: true})
+	go s.runGeneration(g, chunker, chunkCh, errCh)
+	return g, nil
+}
+
+// replyCheckpointInterval is how often a generating reply's content is saved,
+// bounding what a crash can lose.
+const replyCheckpointInterval = 2 * time.Second
+
+// runGeneration turns the model stream into chunk events, checkpoints the
+// reply row as it grows and finalises it once the stream ends or is stopped,
+// whether or not anyone is listening.
+func (s *aiService) runGeneration(g *Generation, chunker Chunker, chunkCh <-chan ai.StreamChunk, errCh <-chan error) {
+	defer s.generations.finish(g)
+	defer s.notifier.Publish(g.UserID, Notification{Type: NotifyTyping, TopicID: g.TopicID, Role: "assistant", Typing: false})
+	var builder strings.Builder
+	lastFlushed := 0
+	saved := 0
+	finishReason := ""
+	replyID := g.Meta.ReplyMessageID
+	checkpoint := time.NewTicker(replyCheckpointInterval)
+	defer checkpoint.Stop()
+	save := func(status string) bool {
+		if err := s.chatRepo.UpdateReply(replyID, builder.String(), status); err != nil {
+			logger.Warnf("save reply %d for topic %d: %v", replyID, g.TopicID, err)
+			return false
+		}
+		saved = builder.Len()
+		return true
+	}
+	// pendingSince is when the oldest unsent text arrived; delay fires when
+	// it has waited as long as the chunker allows.
+	var (
+		pendingSince time.Time
+		delay        *time.Timer
+		delayC       <-chan time.Time
+	)
+	stopDelay := func() {
+		if delay != nil {
+			delay.Stop()
+			delay, delayC = nil, nil
+		}
+	}
+	flush := func(force bool) {
+		current := builder.String()
+		if len(current) == lastFlushed {
+			return
+		}
+		segment := current[lastFlushed:]
+		if !force && !chunker.Ready(segment, time.Since(pendingSince)) {
+			if d := chunker.MaxDelay(); d > 0 && delay == nil {
+				delay = time.NewTimer(d - time.Since(pendingSince))
+				delayC = delay.C
+			}
+			return
+		}
+		stopDelay()
+		g.publish(GenerationEvent{Type: GenerationChunk, Text: segment})
+		lastFlushed = len(current)
+	}
+	defer stopDelay()
+	finish := func(status string) {
+		flush(true)
+		done := GenerationEvent{Type: GenerationDone, Status: status, FinishReason: finishReason}
+		if status == models.MessageStatusTruncated {
+			done.FinishReason = FinishInterrupted
+			if g.Stopped() {
+				done.FinishReason = FinishStopped
+			}
+		}
+		if builder.Len() == 0 {
+			// Nothing to keep; drop the placeholder row.
+			if err := s.chatRepo.DeleteMessage(replyID); err != nil {
+				logger.Warnf("delete empty reply %d: %v", replyID, err)
+			}
+		} else if save(status) {
+			done.MessageID = replyID
+		}
+		g.publish(done)
+		if done.MessageID != 0 && status == models.MessageStatusComplete {
+			// The title is a separate model call; the generation is over and
+			// must not hold up shutdown or the next reply while it runs.
+			go func() {
+				if err := s.GenerateTopicTitle(g.TopicID); err != nil {
+					logger.Warnf("generate title for topic %d: %v", g.TopicID, err)
+				}
+			}()
+		}
+	}
+	fail := func(e error) {
+		flush(true)
+		if builder.Len() == 0 {
+			if err := s.chatRepo.DeleteMessage(replyID); err != nil {
+				logger.Warnf("delete empty reply %d: %v", replyID, err)
+			}
+		} else {
+			save(models.MessageStatusFailed)
+		}
+		g.publish(GenerationEvent{Type: GenerationError, Code: "upstream_error", Text: e.Error()})
+	}
+
+	for {
+		select {
+		case ch, ok := <-chunkCh:
+			if !ok {
+				// The stream may close both channels before the error is
+				// selected; a buffered error still means the reply failed.
+				if errCh != nil {
+					if e, ok := <-errCh; ok && e != nil {
+						fail(e)
+						return
+					}
+				}
+				if g.ctx.Err() != nil {
+					finish(models.MessageStatusTruncated)
+				} else {
+					finish(models.MessageStatusComplete)
+				}
+				return
+			}
+			if ch.Usage != nil {
+				flush(true)
+				g.publish(GenerationEvent{Type: GenerationUsage, Usage: ch.Usage})
+			}
+			if ch.FinishReason != "" {
+				finishReason = ch.FinishReason
+			}
+			if ch.Content == "" {
+				continue
+			}
+			if builder.Len() == lastFlushed {
+				pendingSince = time.Now()
+			}
+			builder.WriteString(ch.Content)
+			flush(false)
+		case <-delayC:
+			delay, delayC = nil, nil
+			flush(false)
+		case e, ok := <-errCh:
+			if !ok {
+				// Closed without an error; keep reading the remaining chunks.
+				errCh = nil
+				continue
+			}
+			if e != nil {
+				fail(e)
+				return
+			}
+		case <-checkpoint.C:
+			if builder.Len() != saved {
+				save(models.MessageStatusGenerating)
+			}
+		case <-g.ctx.Done():
+			finish(models.MessageStatusTruncated)
+			return
+		}
+	}
+}
+
+const titlePrompt = "根据下面的对话为它起一个简短的标题。标题必须使用对话所用的语言（中文对话不超过12个字，其他语言不超过6个词），不要加引号、书名号或结尾标点，只输出标题本身。\n" +
+	"Write a short title for the conversation below in the language the conversation is written in. Output only the title."
+
+// GenerateTopicTitle asks the model for a title when the topic gets its first
+// complete reply. Topics whose title was already generated or renamed are left
+// alone, and if that attempt fails later replies do not try again.
+func (s *aiService) GenerateTopicTitle(topicID uint) error {
+	t, err := s.chatRepo.GetTopicByID(topicID)
+	if err != nil {
+		return err
+	}
+	if t.TitleSource != models.TitleSourceAuto {
+		return nil
+	}
+	if n, err := s.chatRepo.CountReplies(topicID); err != nil || n != 1 {
+		return err
+	}
+	// The opening of the conversation says best what it is about.
+	msgs, err := s.chatRepo.ListMessagesByTopic(topicID, 4, repository.MessageCursor{FromStart: true})
+	if err != nil {
+		return err
+	}
+	var transcript strings.Builder
+	for _, m := range msgs {
+		if !inHistory(m) {
+			continue
+		}
+		content := m.Content
+		if utf8.RuneCountInString(content) > 500 {
+			content = string([]rune(content)[:500])
+		}
+		fmt.Fprintf(&transcript, "%s: %s\n", m.Role, content)
+	}
+	if transcript.Len() == 0 {
+		return nil
+	}
+	text, err := s.client.Chat([]ai.ChatMessage{
+		{Role: "system", Content: titlePrompt},
+		{Role: "user", Content: transcript.String()},
+	})
+	if err != nil {
+		return fmt.Errorf("title generation failed: %w", err)
+	}
+	title := cleanTitle(text)
+	if title == "" {
+		return nil
+	}
+	changed, err := s.chatRepo.SetGeneratedTitle(topicID, title)
+	if err != nil || !changed {
+		return err
+	}
+	if t, err = s.chatRepo.GetTopicWithTags(topicID); err == nil {
+		s.notifier.Publish(t.UserID, Notification{Type: NotifyTopic, TopicID: topicID, Topic: t})
+	}
+	return nil
+}
+
+func cleanTitle(text string) string {
+	text = strings.TrimSpace(text)
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		text = text[:i]
+	}
+	text = strings.TrimPrefix(text, "标题：")
+	text = strings.TrimPrefix(text, "Title:")
+	return strings.TrimFunc(text, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsPunct(r)
+	})
 }
@@ -0,0 +1,26 @@
+package service
+
+import (
+	"testing"
+
+	"rolechat_back/internal/models"
+)
+
+func TestInHistory(t *testing.T) {
+	tests := []struct {
+		status, content string
+		want            bool
+	}{
+		{models.MessageStatusComplete, "hi", true},
+		{models.MessageStatusTruncated, "partial", true},
+		{"", "before statuses existed", true},
+		{models.MessageStatusGenerating, "checkpoint", false},
+		{models.MessageStatusFailed, "partial", false},
+		{models.MessageStatusComplete, "", false},
+	}
+	for _, tt := range tests {
+		if got := inHistory(models.Message{Status: tt.status, Content: tt.content}); got != tt.want {
+			t.Errorf("inHistory(%q, %q) = %v, want %v", tt.status, tt.content, got, tt.want)
+		}
+	}
+}
@@ -2,31 +2,79 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
 	"rolechat_back/internal/models"
 	"rolechat_back/internal/repository"
+	"rolechat_back/pkg/utils"
 )
 
 type ChatService interface {
-	AddMessage(userID uint, topicID uint, role, content string) (topic *models.Topic, msg *models.Message, newTopic bool, err error)
-	ListUserTopics(userID uint, limit, offset int) ([]models.Topic, error)
-	ListTopicMessages(userID uint, topicID uint, limit, offset int) ([]models.Message, error)
+	AddMessage(userID uint, topicID uint, role, content, persona string) (topic *models.Topic, msg *models.Message, newTopic bool, err error)
+	AddReply(userID uint, topicID uint, reply *models.Message) error
+	ListUserTopics(userID uint, filter TopicFilter, limit int, cursor string) (topics []models.Topic, nextCursor string, err error)
+	ListTopicMessages(userID uint, topicID uint, limit int, cursor string) (msgs []models.Message, nextCursor, prevCursor string, err error)
+	RenameTopic(userID uint, topicID uint, title string) (*models.Topic, error)
+	UpdateTopicMeta(userID uint, topicID uint, upd TopicMetaUpdate) (*models.Topic, error)
+	ListFolders(userID uint) ([]repository.LabelCount, error)
+	ListTags(userID uint) ([]repository.LabelCount, error)
+	Search(userID uint, opts SearchOptions) (results []SearchResult, nextCursor string, err error)
+	ExportTopic(userID uint, topicID uint) (*TopicExport, error)
+	ExportAll(userID uint, w io.Writer) error
+	Import(userID uint, source string, convs []ImportedConversation) []ImportResult
+}
+
+type TopicFilter = repository.TopicFilter
+
+// TopicMetaUpdate holds the organisational fields to change; nil fields are
+// left as they are.
+type TopicMetaUpdate struct {
+	Pinned   *bool
+	Favorite *bool
+	Folder   *string
+	Tags     *[]string
+}
+
+type SearchOptions struct {
+	Query    string
+	Persona  string
+	From     *time.Time
+	To       *time.Time
+	Cursor   string
+	PageSize int
+}
+
+type SearchResult struct {
+	Type       string
+	TopicID    uint
+	TopicTitle string
+	MessageID  uint
+	Role       string
+	Persona    string
+	Snippet    string
+	CreatedAt  time.Time
+	Rank       float64
 }
 
 type chatService struct {
 	chatRepo repository.ChatRepository
+	notifier *Notifier
 }
 
-func NewChatService(r repository.ChatRepository) ChatService {
-	return &chatService{chatRepo: r}
+func NewChatService(r repository.ChatRepository, notifier *Notifier) ChatService {
+	return &chatService{chatRepo: r, notifier: notifier}
 }
 
-func (s *chatService) AddMessage(userID uint, topicID uint, role, content string) (*models.Topic, *models.Message, bool, error) {
+func (s *chatService) AddMessage(userID uint, topicID uint, role, content, persona string) (*models.Topic, *models.Message, bool, error) {
 	if role == "" {
 		role = "user"
 	}
 	var (
 		t        *models.Topic
-		m        *models.Message
 		err      error
 		newTopic bool
 	)
@@ -45,18 +93,66 @@ func (s *chatService) AddMessage(userID uint, topicID uint, role, content string
 			return nil, nil, false, errors.New("forbidden")
 		}
 	}
-	m, err = s.chatRepo.CreateMessage(t.ID, role, content)
-	if err != nil {
+	m := &models.Message{TopicID: t.ID, Role: role, Content: content, Persona: persona}
+	if err := s.chatRepo.CreateMessage(m); err != nil {
 		return nil, nil, newTopic, err
 	}
+	if newTopic {
+		s.notifier.Publish(userID, Notification{Type: NotifyTopic, TopicID: t.ID, Topic: t})
+	}
 	return t, m, newTopic, nil
 }
 
-func (s *chatService) ListUserTopics(userID uint, limit, offset int) ([]models.Topic, error) {
-	return s.chatRepo.ListTopicsByUser(userID, limit, offset)
+// AddReply stores an assistant message in an existing topic. Unlike
+// AddMessage it keeps the generation details set on reply, such as the model.
+func (s *chatService) AddReply(userID uint, topicID uint, reply *models.Message) error {
+	t, err := s.chatRepo.GetTopicByID(topicID)
+	if err != nil {
+		return err
+	}
+	if t.UserID != userID {
+		return errors.New("forbidden")
+	}
+	reply.TopicID = t.ID
+	reply.Role = "assistant"
+	return s.chatRepo.CreateMessage(reply)
 }
 
-func (s *chatService) ListTopicMessages(userID uint, topicID uint, limit, offset int) ([]models.Message, error) {
+func (s *chatService) ListUserTopics(userID uint, filter TopicFilter, limit int, cursor string) ([]models.Topic, string, error) {
+	limit = TopicPageLimit(limit)
+	after, err := topicCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	topics, err := s.chatRepo.ListTopicsByUser(userID, filter, limit+1, after)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(topics) <= limit {
+		return topics, "", nil
+	}
+	topics = topics[:limit]
+	last := topics[len(topics)-1]
+	return topics, encodeCursor(pageCursor{Pinned: last.Pinned, UpdatedAt: last.UpdatedAt.UnixNano(), ID: last.ID}), nil
+}
+
+const (
+	maxTags       = 20
+	maxLabelRunes = 32
+	maxFolder     = 64
+)
+
+var ErrInvalidTopicMeta = errors.New("invalid topic metadata")
+
+func normalizeLabel(s string, maxRunes int) (string, error) {
+	s = strings.Join(strings.Fields(s), " ")
+	if utf8.RuneCountInString(s) > maxRunes {
+		return "", fmt.Errorf("%w: %q is longer than %d characters", ErrInvalidTopicMeta, s, maxRunes)
+	}
+	return s, nil
+}
+
+func (s *chatService) UpdateTopicMeta(userID uint, topicID uint, upd TopicMetaUpdate) (*models.Topic, error) {
 	t, err := s.chatRepo.GetTopicByID(topicID)
 	if err != nil {
 		return nil, err
@@ -64,5 +160,176 @@ func (s *chatService) ListTopicMessages(userID uint, topicID uint, limit, offset
 	if t.UserID != userID {
 		return nil, errors.New("forbidden")
 	}
-	return s.chatRepo.ListMessagesByTopic(topicID, limit, offset)
+	fields := map[string]any{}
+	if upd.Pinned != nil {
+		fields["pinned"] = *upd.Pinned
+	}
+	if upd.Favorite != nil {
+		fields["favorite"] = *upd.Favorite
+	}
+	if upd.Folder != nil {
+		folder, err := normalizeLabel(*upd.Folder, maxFolder)
+		if err != nil {
+			return nil, err
+		}
+		fields["folder"] = folder
+	}
+	var tags []string
+	if upd.Tags != nil {
+		seen := map[string]bool{}
+		for _, raw := range *upd.Tags {
+			tag, err := normalizeLabel(raw, maxLabelRunes)
+			if err != nil {
+				return nil, err
+			}
+			if tag == "" || seen[tag] {
+				continue
+			}
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+		if len(tags) > maxTags {
+			return nil, fmt.Errorf("%w: at most %d tags per topic", ErrInvalidTopicMeta, maxTags)
+		}
+	}
+	if len(fields) > 0 {
+		if err := s.chatRepo.UpdateTopicMeta(topicID, fields); err != nil {
+			return nil, err
+		}
+	}
+	if upd.Tags != nil {
+		if err := s.chatRepo.SetTopicTags(topicID, userID, tags); err != nil {
+			return nil, err
+		}
+	}
+	updated, err := s.chatRepo.GetTopicWithTags(topicID)
+	if err != nil {
+		return nil, err
+	}
+	s.notifier.Publish(userID, Notification{Type: NotifyTopic, TopicID: topicID, Topic: updated})
+	return updated, nil
+}
+
+func (s *chatService) ListFolders(userID uint) ([]repository.LabelCount, error) {
+	return s.chatRepo.ListFolders(userID)
+}
+
+func (s *chatService) ListTags(userID uint) ([]repository.LabelCount, error) {
+	return s.chatRepo.ListTags(userID)
+}
+
+// ListTopicMessages pages backwards from the newest message unless the cursor
+// says otherwise. nextCursor continues in the same direction; prevCursor
+// pages the other way, e.g. to pick up messages newer than the first page.
+func (s *chatService) ListTopicMessages(userID uint, topicID uint, limit int, cursor string) ([]models.Message, string, string, error) {
+	t, err := s.chatRepo.GetTopicByID(topicID)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if t.UserID != userID {
+		return nil, "", "", errors.New("forbidden")
+	}
+	return pageTopicMessages(s.chatRepo, topicID, limit, cursor)
+}
+
+// pageTopicMessages returns a page of the topic's messages with the cursors
+// for older and newer pages, without checking who owns the topic.
+func pageTopicMessages(chatRepo repository.ChatRepository, topicID uint, limit int, cursor string) ([]models.Message, string, string, error) {
+	limit = pageLimit(limit, defaultMessagePage, maxMessagePage)
+	mc, err := messageCursor(cursor)
+	if err != nil {
+		return nil, "", "", err
+	}
+	msgs, err := chatRepo.ListMessagesByTopic(topicID, limit+1, mc)
+	if err != nil {
+		return nil, "", "", err
+	}
+	hasMore := len(msgs) > limit
+	if hasMore {
+		if mc.AfterID > 0 {
+			msgs = msgs[:limit]
+		} else {
+			msgs = msgs[1:]
+		}
+	}
+	if len(msgs) == 0 {
+		return msgs, "", "", nil
+	}
+	older := encodeCursor(pageCursor{Before: msgs[0].ID})
+	newer := encodeCursor(pageCursor{After: msgs[len(msgs)-1].ID})
+	next, prev := older, newer
+	if mc.AfterID > 0 {
+		next, prev = newer, older
+	}
+	if !hasMore {
+		next = ""
+	}
+	return msgs, next, prev, nil
+}
+
+func (s *chatService) RenameTopic(userID uint, topicID uint, title string) (*models.Topic, error) {
+	t, err := s.chatRepo.GetTopicByID(topicID)
+	if err != nil {
+		return nil, err
+	}
+	if t.UserID != userID {
+		return nil, errors.New("forbidden")
+	}
+	if strings.TrimSpace(title) == "" {
+		return nil, errors.New("title required")
+	}
+	if err := s.chatRepo.RenameTopic(topicID, title); err != nil {
+		return nil, err
+	}
+	updated, err := s.chatRepo.GetTopicWithTags(topicID)
+	if err != nil {
+		return nil, err
+	}
+	s.notifier.Publish(userID, Notification{Type: NotifyTopic, TopicID: topicID, Topic: updated})
+	return updated, nil
+}
+
+// Search returns one page of ranked hits and the cursor of the next page.
+func (s *chatService) Search(userID uint, opts SearchOptions) ([]SearchResult, string, error) {
+	tsquery, terms := utils.SearchQuery(opts.Query)
+	if tsquery == "" {
+		return nil, "", errors.New("query required")
+	}
+	opts.PageSize = pageLimit(opts.PageSize, defaultSearchPage, maxSearchPage)
+	offset, err := searchOffset(opts.Cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	hits, err := s.chatRepo.Search(repository.SearchParams{
+		UserID:  userID,
+		Query:   tsquery,
+		Persona: opts.Persona,
+		From:    opts.From,
+		To:      opts.To,
+		Limit:   opts.PageSize + 1,
+		Offset:  offset,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	next := ""
+	if len(hits) > opts.PageSize {
+		hits = hits[:opts.PageSize]
+		next = encodeCursor(pageCursor{Offset: offset + opts.PageSize})
+	}
+	res := make([]SearchResult, 0, len(hits))
+	for _, h := range hits {
+		res = append(res, SearchResult{
+			Type:       h.Kind,
+			TopicID:    h.TopicID,
+			TopicTitle: h.TopicTitle,
+			MessageID:  h.MessageID,
+			Role:       h.Role,
+			Persona:    h.Persona,
+			Snippet:    utils.HighlightSnippet(h.Text, terms, 40),
+			CreatedAt:  h.CreatedAt,
+			Rank:       h.Rank,
+		})
+	}
+	return res, next, nil
 }
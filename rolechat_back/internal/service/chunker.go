@@ -0,0 +1,90 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Chunking strategies for streamed replies.
+const (
+	ChunkDefault  = "default"  // 12 runes or a punctuation boundary
+	ChunkToken    = "token"    // every token as it arrives
+	ChunkSentence = "sentence" // whole sentences only, e.g. for TTS
+	ChunkTime     = "time"     // coalesce tokens, but wait at most MaxLatency
+)
+
+const defaultChunkLatency = 150 * time.Millisecond
+
+var ErrInvalidChunking = errors.New("invalid chunking strategy")
+
+// ChunkOptions selects how a streamed reply is cut into chunk events.
+type ChunkOptions struct {
+	Strategy   string
+	MaxLatency time.Duration // ChunkTime only; 0 uses the default
+}
+
+// Chunker decides when text buffered since the last chunk is sent.
+type Chunker interface {
+	// Ready reports whether pending, buffered for waited, should be sent now.
+	Ready(pending string, waited time.Duration) bool
+	// MaxDelay is how long pending text may wait for more tokens before it
+	// is checked again without one; 0 means it waits for the next token.
+	MaxDelay() time.Duration
+}
+
+// NewChunker returns the chunker for opts; an empty strategy is the default.
+func NewChunker(opts ChunkOptions) (Chunker, error) {
+	switch opts.Strategy {
+	case "", ChunkDefault:
+		return defaultChunker{}, nil
+	case ChunkToken:
+		return tokenChunker{}, nil
+	case ChunkSentence:
+		return sentenceChunker{}, nil
+	case ChunkTime:
+		latency := opts.MaxLatency
+		if latency <= 0 {
+			latency = defaultChunkLatency
+		}
+		return timeChunker{maxLatency: latency}, nil
+	}
+	return nil, ErrInvalidChunking
+}
+
+type defaultChunker struct{}
+
+func (defaultChunker) Ready(pending string, _ time.Duration) bool {
+	if utf8.RuneCountInString(pending) >= 12 {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(pending)
+	return strings.ContainsRune("。！？!?，,；;\n", r)
+}
+
+func (defaultChunker) MaxDelay() time.Duration { return 0 }
+
+type tokenChunker struct{}
+
+func (tokenChunker) Ready(string, time.Duration) bool { return true }
+func (tokenChunker) MaxDelay() time.Duration          { return 0 }
+
+type sentenceChunker struct{}
+
+// Ready holds text back until it ends a sentence. Closing quotes and
+// brackets after the terminator belong to the sentence.
+func (sentenceChunker) Ready(pending string, _ time.Duration) bool {
+	trimmed := strings.TrimRight(pending, " \t\"'”’」』）)")
+	r, _ := utf8.DecodeLastRuneInString(trimmed)
+	return strings.ContainsRune("。！？!?.…\n", r)
+}
+
+func (sentenceChunker) MaxDelay() time.Duration { return 0 }
+
+type timeChunker struct {
+	maxLatency time.Duration
+}
+
+func (c timeChunker) Ready(_ string, waited time.Duration) bool { return waited >= c.maxLatency }
+func (c timeChunker) MaxDelay() time.Duration                   { return c.maxLatency }
@@ -0,0 +1,102 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"rolechat_back/internal/repository"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Page sizes of the cursor-paged lists. A larger requested limit is cut down
+// to the maximum rather than ignored.
+const (
+	defaultTopicPage   = 100
+	maxTopicPage       = 100
+	defaultMessagePage = 200
+	maxMessagePage     = 200
+	defaultSearchPage  = 20
+	maxSearchPage      = 50
+	defaultAdminPage   = 50
+	maxAdminPage       = 100
+)
+
+// pageLimit returns limit clamped to [1, max], or def if none was asked for.
+func pageLimit(limit, def, max int) int {
+	if limit <= 0 {
+		return def
+	}
+	return min(limit, max)
+}
+
+// TopicPageLimit is the number of topics a page requested with limit holds.
+func TopicPageLimit(limit int) int {
+	return pageLimit(limit, defaultTopicPage, maxTopicPage)
+}
+
+// pageCursor is serialised into the opaque next_cursor strings handed to
+// clients. Only the fields relevant to the list being paged are set.
+type pageCursor struct {
+	Pinned    bool  `json:"p,omitempty"` // topics: pinned
+	UpdatedAt int64 `json:"u,omitempty"` // topics: unix nanos of updated_at
+	ID        uint  `json:"i,omitempty"` // topics: id
+	Before    uint  `json:"b,omitempty"` // messages: older than this id
+	After     uint  `json:"a,omitempty"` // messages: newer than this id
+	Offset    int   `json:"o,omitempty"` // search: rank offset
+}
+
+func encodeCursor(c pageCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(s string) (pageCursor, error) {
+	var c pageCursor
+	if s == "" {
+		return c, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, errInvalidCursor
+	}
+	return c, nil
+}
+
+func topicCursor(s string) (*repository.TopicCursor, error) {
+	c, err := decodeCursor(s)
+	if err != nil || s == "" {
+		return nil, err
+	}
+	if c.ID == 0 {
+		return nil, errInvalidCursor
+	}
+	return &repository.TopicCursor{Pinned: c.Pinned, UpdatedAt: time.Unix(0, c.UpdatedAt).UTC(), ID: c.ID}, nil
+}
+
+func messageCursor(s string) (repository.MessageCursor, error) {
+	c, err := decodeCursor(s)
+	if err != nil {
+		return repository.MessageCursor{}, err
+	}
+	if s != "" && c.Before == 0 && c.After == 0 {
+		return repository.MessageCursor{}, errInvalidCursor
+	}
+	return repository.MessageCursor{BeforeID: c.Before, AfterID: c.After}, nil
+}
+
+func searchOffset(s string) (int, error) {
+	c, err := decodeCursor(s)
+	if err != nil {
+		return 0, err
+	}
+	if c.Offset < 0 {
+		return 0, errInvalidCursor
+	}
+	return c.Offset, nil
+}
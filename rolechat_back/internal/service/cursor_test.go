@@ -0,0 +1,108 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"rolechat_back/internal/repository"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	tests := []pageCursor{
+		{},
+		{Pinned: true, UpdatedAt: time.Date(2026, 3, 4, 5, 6, 7, 890123456, time.UTC).UnixNano(), ID: 42},
+		{Before: 17},
+		{After: 99},
+		{Offset: 40},
+	}
+	for _, c := range tests {
+		got, err := decodeCursor(encodeCursor(c))
+		if err != nil {
+			t.Fatalf("decode(encode(%+v)): %v", c, err)
+		}
+		if got != c {
+			t.Fatalf("decode(encode(%+v)) = %+v", c, got)
+		}
+	}
+}
+
+func TestDecodeCursorInvalid(t *testing.T) {
+	for _, s := range []string{"!!!", "bm90IGpzb24", "e30=", "WzEsMl0"} {
+		if _, err := decodeCursor(s); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("decodeCursor(%q) err = %v, want errInvalidCursor", s, err)
+		}
+	}
+}
+
+func TestTopicCursor(t *testing.T) {
+	at := time.Date(2026, 3, 4, 5, 6, 7, 890123456, time.UTC)
+	tests := []struct {
+		name    string
+		cursor  string
+		want    *repository.TopicCursor
+		wantErr bool
+	}{
+		{"first page", "", nil, false},
+		{"next page", encodeCursor(pageCursor{Pinned: true, UpdatedAt: at.UnixNano(), ID: 5}), &repository.TopicCursor{Pinned: true, UpdatedAt: at, ID: 5}, false},
+		{"message cursor", encodeCursor(pageCursor{Before: 5}), nil, true},
+		{"garbage", "garbage!", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := topicCursor(tt.cursor)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if (got == nil) != (tt.want == nil) || got != nil && (*got != *tt.want) {
+				t.Fatalf("topicCursor() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		cursor  string
+		want    repository.MessageCursor
+		wantErr bool
+	}{
+		{"newest", "", repository.MessageCursor{}, false},
+		{"older", encodeCursor(pageCursor{Before: 10}), repository.MessageCursor{BeforeID: 10}, false},
+		{"newer", encodeCursor(pageCursor{After: 10}), repository.MessageCursor{AfterID: 10}, false},
+		{"topic cursor", encodeCursor(pageCursor{ID: 10}), repository.MessageCursor{}, true},
+		{"garbage", "garbage!", repository.MessageCursor{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := messageCursor(tt.cursor)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("messageCursor() = %+v, %v; want %+v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSearchOffset(t *testing.T) {
+	if got, err := searchOffset(""); got != 0 || err != nil {
+		t.Fatalf("searchOffset(\"\") = %d, %v", got, err)
+	}
+	if got, err := searchOffset(encodeCursor(pageCursor{Offset: 20})); got != 20 || err != nil {
+		t.Fatalf("searchOffset = %d, %v; want 20", got, err)
+	}
+	if _, err := searchOffset(encodeCursor(pageCursor{Offset: -1})); err == nil {
+		t.Fatal("negative offset accepted")
+	}
+}
+
+func TestPageLimit(t *testing.T) {
+	tests := []struct{ limit, want int }{
+		{-1, 50}, {0, 50}, {1, 1}, {99, 99}, {100, 100}, {101, 100}, {1 << 20, 100},
+	}
+	for _, tt := range tests {
+		if got := pageLimit(tt.limit, 50, 100); got != tt.want {
+			t.Errorf("pageLimit(%d, 50, 100) = %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
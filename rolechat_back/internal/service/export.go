@@ -0,0 +1,252 @@
+package service
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"rolechat_back/internal/models"
+)
+
+const (
+	ExportMarkdown = "md"
+	ExportJSON     = "json"
+	ExportText     = "txt"
+)
+
+var errUnsupportedFormat = errors.New("unsupported format")
+
+type TopicExport struct {
+	Topic    models.Topic
+	Messages []models.Message
+}
+
+type exportPersona struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type exportMessage struct {
+	ID        uint      `json:"id"`
+	Role      string    `json:"role"`
+	Persona   string    `json:"persona,omitempty"`
+	Content   string    `json:"content"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportTopic struct {
+	ID        uint            `json:"id"`
+	Title     string          `json:"title"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Personas  []exportPersona `json:"personas"`
+	Messages  []exportMessage `json:"messages"`
+}
+
+func (e *TopicExport) personas() []exportPersona {
+	seen := map[string]bool{}
+	res := []exportPersona{}
+	for _, m := range e.Messages {
+		if m.Persona == "" || seen[m.Persona] {
+			continue
+		}
+		seen[m.Persona] = true
+		res = append(res, exportPersona{ID: m.Persona, Name: PersonaName(m.Persona)})
+	}
+	return res
+}
+
+func (e *TopicExport) toJSON() exportTopic {
+	msgs := make([]exportMessage, 0, len(e.Messages))
+	for _, m := range e.Messages {
+		msgs = append(msgs, exportMessage{ID: m.ID, Role: m.Role, Persona: m.Persona, Content: m.Content, CreatedAt: m.CreatedAt})
+	}
+	return exportTopic{
+		ID:        e.Topic.ID,
+		Title:     e.Topic.Title,
+		CreatedAt: e.Topic.CreatedAt,
+		UpdatedAt: e.Topic.UpdatedAt,
+		Personas:  e.personas(),
+		Messages:  msgs,
+	}
+}
+
+func speaker(m models.Message) string {
+	switch m.Role {
+	case "user":
+		return "我"
+	case "assistant":
+		if m.Persona != "" {
+			return PersonaName(m.Persona)
+		}
+		return "AI"
+	}
+	return m.Role
+}
+
+const exportTimeLayout = "2006-01-02 15:04:05"
+
+// Render writes the transcript in one of the Export* formats.
+func (e *TopicExport) Render(w io.Writer, format string) error {
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e.toJSON())
+	case ExportMarkdown:
+		var b strings.Builder
+		fmt.Fprintf(&b, "# %s\n\n", e.Topic.Title)
+		fmt.Fprintf(&b, "- 创建时间: %s\n- 更新时间: %s\n", e.Topic.CreatedAt.Format(exportTimeLayout), e.Topic.UpdatedAt.Format(exportTimeLayout))
+		if ps := e.personas(); len(ps) > 0 {
+			names := make([]string, 0, len(ps))
+			for _, p := range ps {
+				names = append(names, p.Name)
+			}
+			fmt.Fprintf(&b, "- 角色: %s\n", strings.Join(names, ", "))
+		}
+		for _, m := range e.Messages {
+			fmt.Fprintf(&b, "\n### %s · %s\n\n%s\n", speaker(m), m.CreatedAt.Format(exportTimeLayout), m.Content)
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	case ExportText:
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s\n\n", e.Topic.Title)
+		for _, m := range e.Messages {
+			fmt.Fprintf(&b, "[%s] %s: %s\n", m.CreatedAt.Format(exportTimeLayout), speaker(m), m.Content)
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+	return errUnsupportedFormat
+}
+
+// FileName is a filesystem-safe name for the export, keeping non-ASCII
+// titles intact.
+func (e *TopicExport) FileName(format string) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`/\:*?"<>|`, r) || r < 0x20 {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(e.Topic.Title))
+	if utf8.RuneCountInString(name) > 40 {
+		name = string([]rune(name)[:40])
+	}
+	return fmt.Sprintf("%d-%s.%s", e.Topic.ID, name, format)
+}
+
+func (s *chatService) ExportTopic(userID uint, topicID uint) (*TopicExport, error) {
+	t, err := s.chatRepo.GetTopicByID(topicID)
+	if err != nil {
+		return nil, err
+	}
+	if t.UserID != userID {
+		return nil, errors.New("forbidden")
+	}
+	msgs, err := s.chatRepo.ListAllMessagesByTopic(topicID)
+	if err != nil {
+		return nil, err
+	}
+	return &TopicExport{Topic: *t, Messages: msgs}, nil
+}
+
+// exportBatch is how many topics have their messages loaded per query when
+// exporting everything.
+const exportBatch = 100
+
+// ExportAll writes a zip holding every topic of the user as a readable
+// Markdown file plus one topics.json with the complete data. Messages are
+// loaded a batch of topics at a time, and topics.json is collected in a
+// temporary file, so the whole history is never held in memory. The zip is
+// only complete once ExportAll returns nil.
+func (s *chatService) ExportAll(userID uint, w io.Writer) error {
+	topics, err := s.chatRepo.ListAllTopicsByUser(userID)
+	if err != nil {
+		return err
+	}
+	all, err := os.CreateTemp("", "rolechat-export-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(all.Name())
+	defer all.Close()
+
+	zw := zip.NewWriter(w)
+	for start := 0; start < len(topics); start += exportBatch {
+		batch := topics[start:min(start+exportBatch, len(topics))]
+		ids := make([]uint, len(batch))
+		for i, t := range batch {
+			ids[i] = t.ID
+		}
+		msgs, err := s.chatRepo.ListMessagesByTopics(ids)
+		if err != nil {
+			return err
+		}
+		byTopic := make(map[uint][]models.Message, len(batch))
+		for _, m := range msgs {
+			byTopic[m.TopicID] = append(byTopic[m.TopicID], m)
+		}
+		for i, t := range batch {
+			e := &TopicExport{Topic: t, Messages: byTopic[t.ID]}
+			f, err := zw.Create("markdown/" + e.FileName(ExportMarkdown))
+			if err != nil {
+				return err
+			}
+			if err := e.Render(f, ExportMarkdown); err != nil {
+				return err
+			}
+			if err := writeExportTopic(all, e, start+i == 0); err != nil {
+				return err
+			}
+		}
+	}
+
+	f, err := zw.Create("topics.json")
+	if err != nil {
+		return err
+	}
+	exportedAt, _ := json.Marshal(time.Now().UTC())
+	if _, err := fmt.Fprintf(f, "{\n  \"exported_at\": %s,\n  \"topics\": [", exportedAt); err != nil {
+		return err
+	}
+	if len(topics) > 0 {
+		if _, err := all.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, all); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, "\n  "); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(f, "]\n}\n"); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeExportTopic appends one element of the topics array of topics.json,
+// indented as it sits in the file.
+func writeExportTopic(w io.Writer, e *TopicExport, first bool) error {
+	data, err := json.MarshalIndent(e.toJSON(), "    ", "  ")
+	if err != nil {
+		return err
+	}
+	sep := ",\n    "
+	if first {
+		sep = "\n    "
+	}
+	if _, err := io.WriteString(w, sep); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
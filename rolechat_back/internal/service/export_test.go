@@ -0,0 +1,114 @@
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+)
+
+// exportRepo serves topics and messages from memory and counts the message
+// queries.
+type exportRepo struct {
+	repository.ChatRepository
+	topics  []models.Topic
+	msgs    []models.Message
+	queries int
+	fail    bool
+}
+
+func (r *exportRepo) ListAllTopicsByUser(uint) ([]models.Topic, error) { return r.topics, nil }
+
+func (r *exportRepo) ListMessagesByTopics(ids []uint) ([]models.Message, error) {
+	r.queries++
+	if r.fail {
+		return nil, errors.New("db down")
+	}
+	var res []models.Message
+	for _, id := range ids {
+		for _, m := range r.msgs {
+			if m.TopicID == id {
+				res = append(res, m)
+			}
+		}
+	}
+	return res, nil
+}
+
+func TestExportAll(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	repo := &exportRepo{}
+	for i := uint(1); i <= exportBatch+1; i++ {
+		repo.topics = append(repo.topics, models.Topic{ID: i, Title: "话题", CreatedAt: now, UpdatedAt: now})
+		repo.msgs = append(repo.msgs,
+			models.Message{ID: 2*i - 1, TopicID: i, Role: "user", Content: "hi", CreatedAt: now},
+			models.Message{ID: 2 * i, TopicID: i, Role: "assistant", Persona: "assistant", Content: "hello", CreatedAt: now})
+	}
+	s := &chatService{chatRepo: repo}
+	var buf bytes.Buffer
+	if err := s.ExportAll(1, &buf); err != nil {
+		t.Fatal(err)
+	}
+	if repo.queries != 2 {
+		t.Errorf("message queries = %d, want 2", repo.queries)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(repo.topics)+1 {
+		t.Fatalf("zip has %d files, want %d", len(zr.File), len(repo.topics)+1)
+	}
+	f, err := zr.Open("topics.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	var doc struct {
+		ExportedAt time.Time     `json:"exported_at"`
+		Topics     []exportTopic `json:"topics"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("topics.json: %v\n%s", err, data)
+	}
+	if len(doc.Topics) != len(repo.topics) || len(doc.Topics[exportBatch].Messages) != 2 {
+		t.Fatalf("topics.json holds %d topics", len(doc.Topics))
+	}
+}
+
+func TestExportAllEmpty(t *testing.T) {
+	s := &chatService{chatRepo: &exportRepo{}}
+	var buf bytes.Buffer
+	if err := s.ExportAll(1, &buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := zr.Open("topics.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc map[string]json.RawMessage
+	if err := json.NewDecoder(f).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if string(doc["topics"]) != "[]" {
+		t.Fatalf("topics = %s, want []", doc["topics"])
+	}
+}
+
+func TestExportAllFails(t *testing.T) {
+	repo := &exportRepo{topics: []models.Topic{{ID: 1}}, fail: true}
+	s := &chatService{chatRepo: repo}
+	if err := s.ExportAll(1, io.Discard); err == nil {
+		t.Fatal("ExportAll succeeded with a failing repository")
+	}
+}
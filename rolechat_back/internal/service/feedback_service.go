@@ -0,0 +1,103 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+)
+
+const maxFeedbackReason = 1000
+
+type FeedbackService interface {
+	Rate(userID, messageID uint, rating int, reason string) (*models.MessageFeedback, error)
+	Clear(userID, messageID uint) error
+	Stats(from, to *time.Time) ([]repository.FeedbackStat, error)
+	List(q repository.FeedbackQuery, cursor string) (items []models.MessageFeedback, nextCursor string, err error)
+}
+
+type feedbackService struct {
+	feedbackRepo repository.FeedbackRepository
+	chatRepo     repository.ChatRepository
+}
+
+func NewFeedbackService(feedbackRepo repository.FeedbackRepository, chatRepo repository.ChatRepository) FeedbackService {
+	return &feedbackService{feedbackRepo: feedbackRepo, chatRepo: chatRepo}
+}
+
+func (s *feedbackService) ratableMessage(userID, messageID uint) (*models.Message, error) {
+	m, err := s.chatRepo.GetMessageByID(messageID)
+	if err != nil {
+		return nil, err
+	}
+	t, err := s.chatRepo.GetTopicByID(m.TopicID)
+	if err != nil {
+		return nil, err
+	}
+	if t.UserID != userID {
+		return nil, errors.New("forbidden")
+	}
+	if m.Role != "assistant" {
+		return nil, errors.New("only assistant messages can be rated")
+	}
+	return m, nil
+}
+
+func (s *feedbackService) Rate(userID, messageID uint, rating int, reason string) (*models.MessageFeedback, error) {
+	if rating != 1 && rating != -1 {
+		return nil, errors.New("invalid rating")
+	}
+	reason = strings.TrimSpace(reason)
+	if utf8.RuneCountInString(reason) > maxFeedbackReason {
+		return nil, errors.New("reason too long")
+	}
+	m, err := s.ratableMessage(userID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	f := &models.MessageFeedback{
+		MessageID: m.ID,
+		UserID:    userID,
+		Rating:    rating,
+		Reason:    reason,
+		Persona:   m.Persona,
+		Model:     m.Model,
+	}
+	if err := s.feedbackRepo.Upsert(f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (s *feedbackService) Clear(userID, messageID uint) error {
+	if _, err := s.ratableMessage(userID, messageID); err != nil {
+		return err
+	}
+	return s.feedbackRepo.Delete(messageID, userID)
+}
+
+func (s *feedbackService) Stats(from, to *time.Time) ([]repository.FeedbackStat, error) {
+	return s.feedbackRepo.Stats(from, to)
+}
+
+func (s *feedbackService) List(q repository.FeedbackQuery, cursor string) ([]models.MessageFeedback, string, error) {
+	c, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	limit := pageLimit(q.Limit, defaultAdminPage, maxAdminPage)
+	q.BeforeID = c.Before
+	q.Limit = limit + 1
+	items, err := s.feedbackRepo.List(q)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(items) <= limit {
+		return items, "", nil
+	}
+	items = items[:limit]
+	return items, encodeCursor(pageCursor{Before: items[len(items)-1].ID}), nil
+}
@@ -0,0 +1,64 @@
+package service
+
+import (
+	"testing"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+)
+
+// feedbackList serves n feedback rows with descending ids and records the
+// queries it got.
+type feedbackList struct {
+	repository.FeedbackRepository
+	n       int
+	queries []repository.FeedbackQuery
+}
+
+func (r *feedbackList) List(q repository.FeedbackQuery) ([]models.MessageFeedback, error) {
+	r.queries = append(r.queries, q)
+	var res []models.MessageFeedback
+	for id := r.n; id > 0 && len(res) < q.Limit; id-- {
+		if q.BeforeID == 0 || uint(id) < q.BeforeID {
+			res = append(res, models.MessageFeedback{ID: uint(id)})
+		}
+	}
+	return res, nil
+}
+
+func TestFeedbackListPages(t *testing.T) {
+	tests := []struct {
+		limit, want int
+	}{
+		{0, defaultAdminPage},
+		{-5, defaultAdminPage},
+		{10, 10},
+		{maxAdminPage + 1, maxAdminPage},
+	}
+	for _, tt := range tests {
+		repo := &feedbackList{n: 500}
+		s := &feedbackService{feedbackRepo: repo}
+		items, next, err := s.List(repository.FeedbackQuery{Limit: tt.limit}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// One extra row is fetched to tell whether there is a next page.
+		if len(items) != tt.want || repo.queries[0].Limit != tt.want+1 || next == "" {
+			t.Fatalf("limit %d: %d items, asked repo for %d, next %q", tt.limit, len(items), repo.queries[0].Limit, next)
+		}
+	}
+
+	repo := &feedbackList{n: 15}
+	s := &feedbackService{feedbackRepo: repo}
+	first, next, err := s.List(repository.FeedbackQuery{Limit: 10}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, last, err := s.List(repository.FeedbackQuery{Limit: 10}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 10 || len(rest) != 5 || last != "" || rest[0].ID != first[9].ID-1 {
+		t.Fatalf("pages of %d and %d items, last cursor %q", len(first), len(rest), last)
+	}
+}
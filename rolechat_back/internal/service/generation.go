@@ -0,0 +1,215 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rolechat_back/pkg/ai"
+
+	"github.com/google/uuid"
+)
+
+var (
+	errGenerationNotFound = errors.New("generation not found")
+	ErrShuttingDown       = errors.New("server is shutting down")
+)
+
+// generationRetention is how long a finished generation stays buffered for
+// clients reconnecting after it ended.
+const generationRetention = 2 * time.Minute
+
+const (
+	GenerationStart = "start"
+	GenerationChunk = "chunk"
+	GenerationUsage = "usage"
+	GenerationDone  = "done"
+	GenerationError = "error"
+)
+
+// Finish reasons besides the ones reported by the model, such as "stop" and
+// "length".
+const (
+	FinishStopped     = "stopped"     // the owner stopped the generation
+	FinishInterrupted = "interrupted" // the server shut down first
+)
+
+// GenerationEvent is one numbered step of a streamed reply. Seq starts at 1
+// and is what clients send back as Last-Event-ID.
+type GenerationEvent struct {
+	Seq          int
+	Type         string
+	Text         string    // chunk: reply text; error: message
+	Usage        *ai.Usage // usage: token counts reported by the model
+	Status       string    // done: status of the saved reply
+	FinishReason string    // done
+	MessageID    uint      // done: saved reply, 0 if nothing was generated and the row was dropped
+	Code         string    // error: machine-readable error code
+}
+
+// GenerationMeta describes what a generation answers; it is sent to clients
+// when they subscribe.
+type GenerationMeta struct {
+	NewTopic       bool
+	UserMessageID  uint
+	ReplyMessageID uint // row of the reply, saved with status generating
+	Persona        string
+	Model          string
+}
+
+// Generation is one streamed reply. It runs as a background job independent
+// of any request and always runs to completion unless its owner stops it.
+// Its events stay buffered until it is dropped from the registry, so
+// subscribers can join late and replay what they missed.
+type Generation struct {
+	ID      string
+	UserID  uint
+	TopicID uint
+	Meta    GenerationMeta
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stopped atomic.Bool
+
+	mu       sync.Mutex
+	events   []GenerationEvent
+	notify   chan struct{} // closed and replaced on every new event
+	finished bool
+}
+
+func (g *Generation) Context() context.Context { return g.ctx }
+
+// Stopped reports whether the owner asked for the generation to stop, as
+// opposed to it being cut short by a server shutdown.
+func (g *Generation) Stopped() bool { return g.stopped.Load() }
+
+func (g *Generation) publish(ev GenerationEvent) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.finished {
+		return
+	}
+	ev.Seq = len(g.events) + 1
+	g.events = append(g.events, ev)
+	close(g.notify)
+	g.notify = make(chan struct{})
+	if ev.Type == GenerationDone || ev.Type == GenerationError {
+		g.finished = true
+	}
+}
+
+// EventsAfter returns the events after seq, a channel that is closed when the
+// next event arrives, and whether the generation has ended.
+func (g *Generation) EventsAfter(seq int) ([]GenerationEvent, <-chan struct{}, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if seq < 0 {
+		seq = 0
+	}
+	var evs []GenerationEvent
+	if seq < len(g.events) {
+		evs = append(evs, g.events[seq:]...)
+	}
+	return evs, g.notify, g.finished
+}
+
+// GenerationRegistry keeps the generations of this process so they can be
+// stopped and resumed from other requests.
+type GenerationRegistry struct {
+	mu      sync.Mutex
+	gens    map[string]*Generation
+	closed  bool // set by Drain; no generation may start after it
+	running sync.WaitGroup
+}
+
+func NewGenerationRegistry() *GenerationRegistry {
+	return &GenerationRegistry{gens: map[string]*Generation{}}
+}
+
+// Start registers a new generation. It fails with ErrShuttingDown once Drain
+// has been called, so Drain never misses one.
+func (r *GenerationRegistry) Start(userID, topicID uint, meta GenerationMeta) (*Generation, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &Generation{
+		ID:      uuid.NewString(),
+		UserID:  userID,
+		TopicID: topicID,
+		Meta:    meta,
+		ctx:     ctx,
+		cancel:  cancel,
+		notify:  make(chan struct{}),
+	}
+	g.publish(GenerationEvent{Type: GenerationStart})
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		cancel()
+		return nil, ErrShuttingDown
+	}
+	r.running.Add(1)
+	r.gens[g.ID] = g
+	return g, nil
+}
+
+// Get returns a generation owned by userID. Other users' generations are
+// reported as not found.
+func (r *GenerationRegistry) Get(userID uint, id string) (*Generation, error) {
+	r.mu.Lock()
+	g, ok := r.gens[id]
+	r.mu.Unlock()
+	if !ok || g.UserID != userID {
+		return nil, errGenerationNotFound
+	}
+	return g, nil
+}
+
+func (r *GenerationRegistry) Stop(userID uint, id string) error {
+	g, err := r.Get(userID, id)
+	if err != nil {
+		return err
+	}
+	g.stopped.Store(true)
+	g.cancel()
+	return nil
+}
+
+// finish releases the generation's resources and drops its buffer after the
+// retention period.
+func (r *GenerationRegistry) finish(g *Generation) {
+	g.cancel()
+	r.running.Done()
+	time.AfterFunc(generationRetention, func() {
+		r.mu.Lock()
+		delete(r.gens, g.ID)
+		r.mu.Unlock()
+	})
+}
+
+// Drain refuses new generations and waits for running ones to finish so
+// their replies are saved. When ctx ends first the remaining ones are
+// cancelled, which saves what they have generated as truncated, and Drain
+// waits for that instead.
+func (r *GenerationRegistry) Drain(ctx context.Context) error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	r.mu.Lock()
+	for _, g := range r.gens {
+		g.cancel()
+	}
+	r.mu.Unlock()
+	<-done
+	return ctx.Err()
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGenerationEventsAfter(t *testing.T) {
+	r := NewGenerationRegistry()
+	g, err := r.Start(1, 2, GenerationMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs, next, finished := g.EventsAfter(0)
+	if len(evs) != 1 || evs[0].Type != GenerationStart || evs[0].Seq != 1 || finished {
+		t.Fatalf("EventsAfter(0) = %+v, finished %v", evs, finished)
+	}
+	g.publish(GenerationEvent{Type: GenerationChunk, Text: "a"})
+	select {
+	case <-next:
+	default:
+		t.Fatal("subscriber not woken by a new event")
+	}
+	g.publish(GenerationEvent{Type: GenerationChunk, Text: "b"})
+	g.publish(GenerationEvent{Type: GenerationDone})
+	g.publish(GenerationEvent{Type: GenerationChunk, Text: "after the end"})
+
+	// A client resuming after the first chunk gets the rest, in order.
+	evs, _, finished = g.EventsAfter(2)
+	if len(evs) != 2 || evs[0].Seq != 3 || evs[0].Text != "b" || evs[1].Type != GenerationDone || !finished {
+		t.Fatalf("EventsAfter(2) = %+v, finished %v", evs, finished)
+	}
+	if evs, _, _ := g.EventsAfter(4); len(evs) != 0 {
+		t.Fatalf("EventsAfter(last) = %+v, want none", evs)
+	}
+	if evs, _, _ := g.EventsAfter(-1); len(evs) != 4 {
+		t.Fatalf("EventsAfter(-1) = %d events, want all 4", len(evs))
+	}
+}
+
+func TestGenerationRegistryOwnership(t *testing.T) {
+	r := NewGenerationRegistry()
+	g, err := r.Start(1, 2, GenerationMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Get(2, g.ID); !errors.Is(err, errGenerationNotFound) {
+		t.Fatalf("other user's Get: err = %v", err)
+	}
+	if err := r.Stop(2, g.ID); !errors.Is(err, errGenerationNotFound) || g.Context().Err() != nil {
+		t.Fatalf("other user's Stop: err = %v, ctx %v", err, g.Context().Err())
+	}
+	if err := r.Stop(1, g.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !g.Stopped() || g.Context().Err() == nil {
+		t.Fatal("Stop did not cancel the generation")
+	}
+}
+
+func TestGenerationRegistryDrain(t *testing.T) {
+	r := NewGenerationRegistry()
+	quick, err := r.Start(1, 1, GenerationMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := r.Start(1, 2, GenerationMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.finish(quick)
+	}()
+	// slow only ends when cancelled, as a reply saved as truncated would.
+	go func() {
+		<-slow.Context().Done()
+		r.finish(slow)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := r.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Drain = %v, want the deadline", err)
+	}
+	if slow.Stopped() {
+		t.Fatal("a generation cut short by shutdown reports being stopped by its owner")
+	}
+	if _, err := r.Start(1, 3, GenerationMeta{}); !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("Start after Drain: err = %v, want ErrShuttingDown", err)
+	}
+}
+
+func TestGenerationRegistryDrainWaits(t *testing.T) {
+	r := NewGenerationRegistry()
+	g, err := r.Start(1, 1, GenerationMeta{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.finish(g)
+	}()
+	if err := r.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain = %v", err)
+	}
+	if g.Context().Err() == nil {
+		t.Fatal("finished generation not released")
+	}
+	// The buffer stays for clients reconnecting after the end.
+	if _, err := r.Get(1, g.ID); err != nil {
+		t.Fatalf("Get after finish: %v", err)
+	}
+}
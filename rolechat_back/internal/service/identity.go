@@ -0,0 +1,127 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"rolechat_back/internal/models"
+
+	"gorm.io/gorm"
+)
+
+var errIdentityEmailUnverified = errors.New("provider did not return a verified email")
+
+// ExternalIdentity is a user as vouched for by an OpenID Connect provider.
+type ExternalIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// LoginWithIdentity signs in the user linked to id. An identity seen for
+// the first time is linked to the account with the same email if the
+// provider verified it, or else becomes a new account. Like Login, it
+// returns a *MFARequiredError for accounts with two-factor authentication.
+func (s *userService) LoginWithIdentity(id ExternalIdentity, client ClientInfo) (string, string, error) {
+	user, err := s.identityUser(id)
+	if err != nil {
+		return "", "", err
+	}
+	if user.Status != models.UserStatusActive {
+		return "", "", ErrAccountDisabled
+	}
+	if user.TOTPEnabled {
+		return "", "", s.mfaChallenge(user)
+	}
+	return s.issueTokenPair(user, nil, client)
+}
+
+func (s *userService) identityUser(id ExternalIdentity) (*models.User, error) {
+	link, err := s.repo.FindIdentity(id.Provider, id.Subject)
+	if err == nil {
+		return s.repo.FindByID(link.UserID)
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	email := strings.TrimSpace(id.Email)
+	if email == "" || !id.EmailVerified {
+		return nil, errIdentityEmailUnverified
+	}
+	link = &models.UserIdentity{Provider: id.Provider, Subject: id.Subject, Email: email}
+
+	user, err := s.repo.FindByEmail(email)
+	if err == nil {
+		if user.EmailVerifiedAt == nil {
+			if err := s.claimUnverified(user); err != nil {
+				return nil, err
+			}
+		}
+		link.UserID = user.ID
+		if err := s.repo.CreateIdentity(link); err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+
+	nickname := strings.TrimSpace(id.Name)
+	if nickname == "" {
+		nickname, _, _ = strings.Cut(email, "@")
+	}
+	now := time.Now()
+	user = &models.User{
+		Email:           email,
+		Nickname:        nickname,
+		Role:            models.RoleUser,
+		Status:          models.UserStatusActive,
+		EmailVerifiedAt: &now,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err := s.repo.CreateUserWithIdentity(user, link); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// claimUnverified hands an account whose address was never verified to the
+// owner of the address, as vouched for by the provider. Whoever registered
+// it may not be that person, so their password, second factor and sessions
+// stop working.
+func (s *userService) claimUnverified(user *models.User) error {
+	if err := s.repo.RevokeAllRefreshTokens(user.ID); err != nil {
+		return err
+	}
+	if err := s.guard.RevokeAll(user.ID); err != nil {
+		return err
+	}
+	if err := s.repo.ReplaceRecoveryCodes(user.ID, nil); err != nil {
+		return err
+	}
+	now := time.Now()
+	fields := map[string]any{
+		"password_hash":     "",
+		"totp_enabled":      false,
+		"totp_secret":       "",
+		"totp_last_step":    0,
+		"email_verified_at": now,
+	}
+	if user.Status == models.UserStatusPending {
+		fields["status"] = models.UserStatusActive
+	}
+	if err := s.repo.UpdateUser(user.ID, fields); err != nil {
+		return err
+	}
+	user.PasswordHash, user.TOTPEnabled, user.TOTPSecret, user.TOTPLastStep = "", false, "", 0
+	user.EmailVerifiedAt = &now
+	if status, ok := fields["status"].(string); ok {
+		user.Status = status
+	}
+	return nil
+}
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"rolechat_back/internal/models"
+)
+
+const (
+	ImportChatGPT     = "chatgpt"
+	ImportSillyTavern = "sillytavern"
+)
+
+// ImportedConversation is the tool-neutral form every parser produces.
+type ImportedConversation struct {
+	Title     string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Messages  []models.Message
+	Err       error // set when this conversation could not be parsed
+}
+
+type ImportResult struct {
+	Index    int
+	Source   string
+	Title    string
+	TopicID  uint
+	Messages int
+	Error    string
+}
+
+// DetectImportFormat tells the source tool from the structure of data. A
+// ChatGPT export is one JSON document: the conversations.json array, or a
+// single conversation object with a "mapping". A SillyTavern log holds one
+// JSON object per line, which as a whole is not valid JSON, unless it is
+// only its header line.
+func DetectImportFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || !json.Valid(trimmed) {
+		return ImportSillyTavern
+	}
+	if trimmed[0] == '[' {
+		return ImportChatGPT
+	}
+	var probe map[string]json.RawMessage
+	if json.Unmarshal(trimmed, &probe) == nil {
+		if _, ok := probe["mapping"]; ok {
+			return ImportChatGPT
+		}
+	}
+	return ImportSillyTavern
+}
+
+func ParseImport(format string, data []byte) ([]ImportedConversation, error) {
+	switch format {
+	case ImportChatGPT:
+		return parseChatGPT(data)
+	case ImportSillyTavern:
+		conv, err := parseSillyTavern(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return []ImportedConversation{conv}, nil
+	}
+	return nil, errUnsupportedFormat
+}
+
+type chatGPTNode struct {
+	Parent  string `json:"parent"`
+	Message *struct {
+		Author struct {
+			Role string `json:"role"`
+		} `json:"author"`
+		Content struct {
+			ContentType string            `json:"content_type"`
+			Parts       []json.RawMessage `json:"parts"`
+			Text        string            `json:"text"`
+		} `json:"content"`
+		CreateTime *float64 `json:"create_time"`
+		Metadata   struct {
+			IsVisuallyHidden bool `json:"is_visually_hidden_from_conversation"`
+		} `json:"metadata"`
+	} `json:"message"`
+}
+
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	UpdateTime  float64                `json:"update_time"`
+	CurrentNode string                 `json:"current_node"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+}
+
+func unixSeconds(f float64) time.Time {
+	if f <= 0 {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)).UTC()
+}
+
+func parseChatGPT(data []byte) ([]ImportedConversation, error) {
+	var convs []json.RawMessage
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		convs = []json.RawMessage{trimmed}
+	} else if err := json.Unmarshal(data, &convs); err != nil {
+		return nil, fmt.Errorf("invalid conversations.json: %w", err)
+	}
+	res := make([]ImportedConversation, 0, len(convs))
+	for _, raw := range convs {
+		var c chatGPTConversation
+		if err := json.Unmarshal(raw, &c); err != nil {
+			res = append(res, ImportedConversation{Err: err})
+			continue
+		}
+		res = append(res, convertChatGPT(c))
+	}
+	return res, nil
+}
+
+// convertChatGPT follows current_node back to the root, which yields the
+// branch the user last saw and skips abandoned regenerations.
+func convertChatGPT(c chatGPTConversation) ImportedConversation {
+	conv := ImportedConversation{Title: c.Title, CreatedAt: unixSeconds(c.CreateTime), UpdatedAt: unixSeconds(c.UpdateTime)}
+	if len(c.Mapping) == 0 {
+		conv.Err = errors.New("conversation has no messages")
+		return conv
+	}
+	var chain []chatGPTNode
+	seen := map[string]bool{}
+	for id := c.CurrentNode; id != "" && !seen[id]; {
+		seen[id] = true
+		node, ok := c.Mapping[id]
+		if !ok {
+			break
+		}
+		chain = append(chain, node)
+		id = node.Parent
+	}
+	last := conv.CreatedAt
+	for i := len(chain) - 1; i >= 0; i-- {
+		m := chain[i].Message
+		if m == nil || m.Metadata.IsVisuallyHidden {
+			continue
+		}
+		role := m.Author.Role
+		if role != "user" && role != "assistant" {
+			continue
+		}
+		var parts []string
+		for _, p := range m.Content.Parts {
+			var s string
+			if json.Unmarshal(p, &s) == nil && strings.TrimSpace(s) != "" {
+				parts = append(parts, s)
+			}
+		}
+		if len(parts) == 0 && m.Content.Text != "" {
+			parts = append(parts, m.Content.Text)
+		}
+		content := strings.TrimSpace(strings.Join(parts, "\n"))
+		if content == "" {
+			continue
+		}
+		at := last
+		if m.CreateTime != nil {
+			if t := unixSeconds(*m.CreateTime); !t.IsZero() {
+				at = t
+			}
+		}
+		last = at
+		conv.Messages = append(conv.Messages, models.Message{Role: role, Content: content, CreatedAt: at, UpdatedAt: at})
+	}
+	if len(conv.Messages) == 0 {
+		conv.Err = errors.New("conversation has no user or assistant messages")
+	}
+	return conv
+}
+
+type sillyTavernLine struct {
+	UserName      string          `json:"user_name"`
+	CharacterName string          `json:"character_name"`
+	CreateDate    json.RawMessage `json:"create_date"`
+	Name          string          `json:"name"`
+	IsUser        bool            `json:"is_user"`
+	IsSystem      bool            `json:"is_system"`
+	SendDate      json.RawMessage `json:"send_date"`
+	Mes           *string         `json:"mes"`
+}
+
+var sillyTavernLayouts = []string{
+	time.RFC3339Nano,
+	"January 2, 2006 3:04pm",
+	"January 2, 2006 3:04:05pm",
+	"2006-01-02 @15h 04m 05s",
+	"2006-01-02@15h04m05s",
+	"2006-01-02 15:04:05",
+}
+
+// parseSillyTavernDate handles the several date formats SillyTavern has
+// written over time: unix milliseconds, ISO strings and humanized dates.
+func parseSillyTavernDate(raw json.RawMessage) (time.Time, bool) {
+	if len(raw) == 0 {
+		return time.Time{}, false
+	}
+	var ms float64
+	if json.Unmarshal(raw, &ms) == nil && ms > 0 {
+		return time.UnixMilli(int64(ms)).UTC(), true
+	}
+	var s string
+	if json.Unmarshal(raw, &s) != nil {
+		return time.Time{}, false
+	}
+	s = strings.TrimSpace(s)
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(n).UTC(), true
+	}
+	// Go layouts only read fractional seconds after a dot, so the
+	// milliseconds of "2024-05-06 @12h 45m 10s 250ms" are split off here.
+	var frac time.Duration
+	if rest, ok := strings.CutSuffix(s, "ms"); ok {
+		if i := strings.LastIndexByte(rest, ' '); i >= 0 {
+			if n, err := strconv.Atoi(rest[i+1:]); err == nil {
+				s, frac = rest[:i], time.Duration(n)*time.Millisecond
+			}
+		}
+	}
+	for _, layout := range sillyTavernLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Add(frac).UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func parseSillyTavern(r io.Reader) (ImportedConversation, error) {
+	var conv ImportedConversation
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	character := ""
+	lineNo := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		lineNo++
+		var l sillyTavernLine
+		if err := json.Unmarshal(line, &l); err != nil {
+			return conv, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		if l.Mes == nil {
+			// The header line carries the chat metadata instead of a message.
+			character = l.CharacterName
+			if t, ok := parseSillyTavernDate(l.CreateDate); ok {
+				conv.CreatedAt = t
+			}
+			continue
+		}
+		if l.IsSystem || strings.TrimSpace(*l.Mes) == "" {
+			continue
+		}
+		role := "assistant"
+		if l.IsUser {
+			role = "user"
+		}
+		if character == "" && !l.IsUser {
+			character = l.Name
+		}
+		at, ok := parseSillyTavernDate(l.SendDate)
+		if !ok {
+			at = conv.CreatedAt
+			if n := len(conv.Messages); n > 0 {
+				at = conv.Messages[n-1].CreatedAt
+			}
+		}
+		conv.Messages = append(conv.Messages, models.Message{Role: role, Content: strings.TrimSpace(*l.Mes), CreatedAt: at, UpdatedAt: at})
+	}
+	if err := scanner.Err(); err != nil {
+		return conv, err
+	}
+	if len(conv.Messages) == 0 {
+		return conv, errors.New("chat log has no messages")
+	}
+	if character != "" {
+		conv.Title = "与" + character + "的对话"
+	}
+	return conv, nil
+}
+
+// finalizeImport fills in timestamps the source left out and keeps message
+// times monotonic, since the transcript order is what matters when reading.
+func finalizeImport(conv *ImportedConversation) {
+	now := time.Now().UTC()
+	if conv.CreatedAt.IsZero() {
+		conv.CreatedAt = now
+		for _, m := range conv.Messages {
+			if !m.CreatedAt.IsZero() {
+				conv.CreatedAt = m.CreatedAt
+				break
+			}
+		}
+	}
+	prev := conv.CreatedAt
+	for i := range conv.Messages {
+		m := &conv.Messages[i]
+		if m.CreatedAt.IsZero() || m.CreatedAt.Before(prev) {
+			m.CreatedAt = prev
+		}
+		m.UpdatedAt = m.CreatedAt
+		prev = m.CreatedAt
+	}
+	if conv.UpdatedAt.Before(prev) {
+		conv.UpdatedAt = prev
+	}
+}
+
+// Import stores each parsed conversation as its own topic; one bad
+// conversation does not stop the rest.
+func (s *chatService) Import(userID uint, source string, convs []ImportedConversation) []ImportResult {
+	results := make([]ImportResult, 0, len(convs))
+	for i := range convs {
+		conv := &convs[i]
+		r := ImportResult{Index: i, Source: source, Title: conv.Title}
+		if conv.Err != nil {
+			r.Error = conv.Err.Error()
+			results = append(results, r)
+			continue
+		}
+		finalizeImport(conv)
+		titleSource := models.TitleSourceUser
+		if strings.TrimSpace(conv.Title) == "" {
+			conv.Title = conv.Messages[0].Content
+			titleSource = models.TitleSourceAuto
+		}
+		t := &models.Topic{
+			UserID:      userID,
+			Title:       conv.Title,
+			TitleSource: titleSource,
+			CreatedAt:   conv.CreatedAt,
+			UpdatedAt:   conv.UpdatedAt,
+		}
+		if err := s.chatRepo.ImportTopic(t, conv.Messages); err != nil {
+			r.Error = err.Error()
+		} else {
+			r.Title = t.Title
+			r.TopicID = t.ID
+			r.Messages = len(conv.Messages)
+		}
+		results = append(results, r)
+	}
+	return results
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"rolechat_back/internal/models"
+)
+
+func TestDetectImportFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"chatgpt export", `[{"title":"a","mapping":{}}]`, ImportChatGPT},
+		{"empty chatgpt export", `[]`, ImportChatGPT},
+		{"single conversation", `{"title":"a","mapping":{}}`, ImportChatGPT},
+		{"pretty-printed conversation", "{\n  \"title\": \"a\",\n  \"mapping\": {\n    \"n1\": {\"parent\": null}\n  }\n}\n", ImportChatGPT},
+		{"mapping after other keys", "{\n  \"title\": \"a\",\n  \"create_time\": 1,\n  \"current_node\": \"n1\",\n  \"mapping\": {}\n}", ImportChatGPT},
+		{"sillytavern log", "{\"user_name\":\"me\",\"character_name\":\"Bot\"}\n{\"name\":\"me\",\"is_user\":true,\"mes\":\"hi\"}\n", ImportSillyTavern},
+		{"sillytavern header only", `{"user_name":"me","character_name":"Bot"}`, ImportSillyTavern},
+		{"sillytavern message mentioning mapping", "{\"user_name\":\"me\"}\n{\"mes\":\"\\\"mapping\\\": {}\"}\n", ImportSillyTavern},
+		{"empty", "", ImportSillyTavern},
+		{"not json", "hello", ImportSillyTavern},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := DetectImportFormat([]byte(tt.data)); got != tt.want {
+				t.Errorf("DetectImportFormat() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type wantMessage struct {
+	Role, Content string
+	At            time.Time
+}
+
+func messagesOf(conv ImportedConversation) []wantMessage {
+	var got []wantMessage
+	for _, m := range conv.Messages {
+		got = append(got, wantMessage{m.Role, m.Content, m.CreatedAt})
+	}
+	return got
+}
+
+const chatGPTBranches = `{
+  "title": "Branches",
+  "create_time": 1700000000.5,
+  "update_time": 1700000100,
+  "current_node": "a2",
+  "mapping": {
+    "root": {"parent": null, "message": null},
+    "sys": {"parent": "root", "message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": ["be nice"]}}},
+    "u1": {"parent": "sys", "message": {"author": {"role": "user"}, "content": {"content_type": "text", "parts": ["hello"]}, "create_time": 1700000010}},
+    "hidden": {"parent": "u1", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["ctx"]}, "metadata": {"is_visually_hidden_from_conversation": true}}},
+    "a1": {"parent": "hidden", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["first try"]}, "create_time": 1700000020}},
+    "a2": {"parent": "hidden", "message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["second", {"asset": "image"}, "try"]}}},
+    "tool": {"parent": "a2", "message": {"author": {"role": "tool"}, "content": {"content_type": "text", "parts": ["out"]}}}
+  }
+}`
+
+func TestParseChatGPT(t *testing.T) {
+	convs, err := ParseImport(ImportChatGPT, []byte(chatGPTBranches))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 1 {
+		t.Fatalf("got %d conversations, want 1", len(convs))
+	}
+	conv := convs[0]
+	if conv.Err != nil {
+		t.Fatal(conv.Err)
+	}
+	if conv.Title != "Branches" || !conv.CreatedAt.Equal(time.Unix(1700000000, 5e8)) || !conv.UpdatedAt.Equal(time.Unix(1700000100, 0)) {
+		t.Fatalf("conversation = %q %v %v", conv.Title, conv.CreatedAt, conv.UpdatedAt)
+	}
+	// The current branch only, without system, hidden or tool messages; a2
+	// has no time of its own and inherits the one before it.
+	want := []wantMessage{
+		{"user", "hello", time.Unix(1700000010, 0).UTC()},
+		{"assistant", "second\ntry", time.Unix(1700000010, 0).UTC()},
+	}
+	if got := messagesOf(conv); !reflect.DeepEqual(got, want) {
+		t.Fatalf("messages = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseChatGPTArray(t *testing.T) {
+	data := `[` + chatGPTBranches + `, {"title": "Empty", "mapping": {}}, {"title": 5}, {"title": "Only system", "current_node": "s", "mapping": {"s": {"message": {"author": {"role": "system"}, "content": {"parts": ["x"]}}}}}]`
+	convs, err := ParseImport(ImportChatGPT, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(convs) != 4 {
+		t.Fatalf("got %d conversations, want 4", len(convs))
+	}
+	if convs[0].Err != nil || len(convs[0].Messages) != 2 {
+		t.Fatalf("first conversation = %d messages, %v", len(convs[0].Messages), convs[0].Err)
+	}
+	for i, conv := range convs[1:] {
+		if conv.Err == nil {
+			t.Errorf("conversation %d parsed, want an error", i+1)
+		}
+	}
+	if _, err := ParseImport(ImportChatGPT, []byte(`[{`)); err == nil {
+		t.Fatal("truncated export accepted")
+	}
+}
+
+func TestParseSillyTavern(t *testing.T) {
+	data := strings.Join([]string{
+		`{"user_name":"me","character_name":"Seraphina","create_date":"2024-05-06@12h30m00s","chat_metadata":{}}`,
+		`{"name":"Seraphina","is_user":false,"send_date":"May 6, 2024 12:31pm","mes":" Welcome. "}`,
+		``,
+		`{"name":"me","is_user":true,"send_date":1715000000000,"mes":"hi"}`,
+		`{"name":"System","is_system":true,"send_date":"2024-05-06T12:40:00Z","mes":"note"}`,
+		`{"name":"me","is_user":true,"send_date":"1715000600000","mes":"   "}`,
+		`{"name":"Seraphina","is_user":false,"send_date":"2024-05-06 @12h 45m 10s 250ms","mes":"Hello"}`,
+		`{"name":"me","is_user":true,"send_date":"someday","mes":"later"}`,
+	}, "\n")
+	convs, err := ParseImport(ImportSillyTavern, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv := convs[0]
+	if conv.Title != "与Seraphina的对话" || !conv.CreatedAt.Equal(time.Date(2024, 5, 6, 12, 30, 0, 0, time.UTC)) {
+		t.Fatalf("conversation = %q %v", conv.Title, conv.CreatedAt)
+	}
+	hello := time.Date(2024, 5, 6, 12, 45, 10, 250e6, time.UTC)
+	want := []wantMessage{
+		{"assistant", "Welcome.", time.Date(2024, 5, 6, 12, 31, 0, 0, time.UTC)},
+		{"user", "hi", time.UnixMilli(1715000000000).UTC()},
+		{"assistant", "Hello", hello},
+		{"user", "later", hello},
+	}
+	if got := messagesOf(conv); !reflect.DeepEqual(got, want) {
+		t.Fatalf("messages = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseSillyTavernErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"bad line", "{\"user_name\":\"me\"}\n{oops}\n", "line 2"},
+		{"header only", `{"user_name":"me","character_name":"Bot"}`, "no messages"},
+		{"system only", "{\"mes\":\"x\",\"is_system\":true}\n", "no messages"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseImport(ImportSillyTavern, []byte(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSillyTavernTitleFromFirstReply(t *testing.T) {
+	data := "{\"name\":\"me\",\"is_user\":true,\"mes\":\"hi\"}\n{\"name\":\"Bot\",\"mes\":\"yo\"}\n"
+	convs, err := ParseImport(ImportSillyTavern, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if convs[0].Title != "与Bot的对话" {
+		t.Fatalf("title = %q", convs[0].Title)
+	}
+}
+
+func TestFinalizeImport(t *testing.T) {
+	t0 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	conv := ImportedConversation{Messages: []models.Message{
+		{Content: "a"},
+		{Content: "b", CreatedAt: t0.Add(time.Hour)},
+		{Content: "c", CreatedAt: t0},
+		{Content: "d"},
+	}}
+	finalizeImport(&conv)
+	// The topic starts at the first known time; out-of-order or missing
+	// times are clamped to the previous message.
+	if !conv.CreatedAt.Equal(t0.Add(time.Hour)) || !conv.UpdatedAt.Equal(t0.Add(time.Hour)) {
+		t.Fatalf("topic times = %v, %v", conv.CreatedAt, conv.UpdatedAt)
+	}
+	for _, m := range conv.Messages {
+		if !m.CreatedAt.Equal(t0.Add(time.Hour)) || !m.UpdatedAt.Equal(m.CreatedAt) {
+			t.Fatalf("message %s at %v/%v", m.Content, m.CreatedAt, m.UpdatedAt)
+		}
+	}
+
+	empty := ImportedConversation{Messages: []models.Message{{Content: "a"}}}
+	before := time.Now().UTC()
+	finalizeImport(&empty)
+	if empty.CreatedAt.Before(before) || !empty.Messages[0].CreatedAt.Equal(empty.CreatedAt) {
+		t.Fatalf("undated import = %v, message %v", empty.CreatedAt, empty.Messages[0].CreatedAt)
+	}
+}
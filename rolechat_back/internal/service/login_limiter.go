@@ -0,0 +1,180 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/pkg/logger"
+)
+
+// Login throttling. Every failure past loginFreeFailures doubles the wait
+// before the next attempt, up to loginMaxDelay; maxFailures in a row lock
+// the account, and ipFailureFactor times as many lock the IP address.
+// Failures are forgotten after a lockout period without new ones.
+const (
+	loginFreeFailures = 3
+	loginMaxDelay     = 30 * time.Second
+	ipFailureFactor   = 3
+)
+
+// LoginThrottledError is returned while logins for an account or from an
+// address are being delayed or are locked out.
+type LoginThrottledError struct {
+	RetryAfter time.Duration
+	Locked     bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return "too many failed logins; try again later"
+	}
+	return "too many login attempts; slow down"
+}
+
+type loginAttempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// LoginLimiter tracks failed logins per account and per IP address in this
+// process.
+type LoginLimiter struct {
+	audit       repository.AuditRepository
+	maxFailures int
+	lockout     time.Duration
+	now         func() time.Time
+
+	mu        sync.Mutex
+	attempts  map[string]*loginAttempts
+	lastSweep time.Time
+}
+
+// NewLoginLimiter locks an account for lockout after maxFailures failed
+// logins in a row; zero values use 10 failures and 15 minutes. Lockouts are
+// written to audit.
+func NewLoginLimiter(audit repository.AuditRepository, maxFailures int, lockout time.Duration) *LoginLimiter {
+	if maxFailures <= 0 {
+		maxFailures = 10
+	}
+	if lockout <= 0 {
+		lockout = 15 * time.Minute
+	}
+	return &LoginLimiter{audit: audit, maxFailures: maxFailures, lockout: lockout, now: time.Now, attempts: map[string]*loginAttempts{}}
+}
+
+func accountKey(email string) string { return "account:" + strings.ToLower(strings.TrimSpace(email)) }
+func ipKey(ip string) string         { return "ip:" + ip }
+
+// Allow returns a *LoginThrottledError if a login for email from ip must
+// not be attempted yet.
+func (l *LoginLimiter) Allow(email, ip string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+	var worst *LoginThrottledError
+	for _, key := range []string{accountKey(email), ipKey(ip)} {
+		a := l.attempts[key]
+		if a == nil {
+			continue
+		}
+		e := &LoginThrottledError{}
+		if now.Before(a.lockedUntil) {
+			e.RetryAfter, e.Locked = a.lockedUntil.Sub(now), true
+		} else if wait := loginDelay(a.failures) - now.Sub(a.lastFailure); wait > 0 {
+			e.RetryAfter = wait
+		} else {
+			continue
+		}
+		if worst == nil || e.RetryAfter > worst.RetryAfter {
+			worst = e
+		}
+	}
+	if worst == nil {
+		return nil
+	}
+	return worst
+}
+
+func loginDelay(failures int) time.Duration {
+	if failures <= loginFreeFailures {
+		return 0
+	}
+	d := time.Second << min(failures-loginFreeFailures-1, 10)
+	return min(d, loginMaxDelay)
+}
+
+// Fail records a failed login. userID is 0 when email is not registered.
+func (l *LoginLimiter) Fail(userID uint, email, ip string) {
+	if l == nil {
+		return
+	}
+	var lockouts []models.AuditLog
+	l.mu.Lock()
+	now := l.now()
+	for _, key := range []string{accountKey(email), ipKey(ip)} {
+		a := l.attempts[key]
+		if a == nil || now.Sub(a.lastFailure) > l.lockout {
+			a = &loginAttempts{}
+			l.attempts[key] = a
+		}
+		a.failures++
+		a.lastFailure = now
+		limit := l.maxFailures
+		target := "account"
+		if strings.HasPrefix(key, "ip:") {
+			limit *= ipFailureFactor
+			target = "ip"
+		}
+		if a.failures >= limit {
+			a.lockedUntil = now.Add(l.lockout)
+			lockouts = append(lockouts, models.AuditLog{
+				Event:  models.AuditLoginLockout,
+				UserID: userID,
+				Email:  email,
+				IP:     ip,
+				Detail: fmt.Sprintf("%s locked for %s after %d failed logins", target, l.lockout, a.failures),
+			})
+			// Count afresh once the lockout ends.
+			a.failures = 0
+		}
+	}
+	l.mu.Unlock()
+	for i := range lockouts {
+		if err := l.audit.Create(&lockouts[i]); err != nil {
+			logger.Warnf("write login lockout audit for %s: %v", email, err)
+		}
+	}
+}
+
+// Succeed clears the account's failures. The IP address's are kept, so a
+// valid login does not hide a spray from the same address.
+func (l *LoginLimiter) Succeed(email string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	delete(l.attempts, accountKey(email))
+	l.mu.Unlock()
+}
+
+// sweep drops entries that no longer delay or lock anything.
+func (l *LoginLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, a := range l.attempts {
+		if now.After(a.lockedUntil) && now.Sub(a.lastFailure) > l.lockout {
+			delete(l.attempts, key)
+		}
+	}
+}
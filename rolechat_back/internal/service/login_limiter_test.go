@@ -0,0 +1,149 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+)
+
+type auditLog struct {
+	repository.AuditRepository
+	entries []models.AuditLog
+}
+
+func (a *auditLog) Create(entry *models.AuditLog) error {
+	a.entries = append(a.entries, *entry)
+	return nil
+}
+
+// fakeClock is the limiter's time, moved forward by the test.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(maxFailures int, lockout time.Duration) (*LoginLimiter, *fakeClock, *auditLog) {
+	audit := &auditLog{}
+	clock := &fakeClock{t: time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)}
+	l := NewLoginLimiter(audit, maxFailures, lockout)
+	l.now = clock.now
+	return l, clock, audit
+}
+
+func throttled(t *testing.T, err error) *LoginThrottledError {
+	t.Helper()
+	var te *LoginThrottledError
+	if !errors.As(err, &te) {
+		t.Fatalf("Allow = %v, want a *LoginThrottledError", err)
+	}
+	return te
+}
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0}, {loginFreeFailures, 0},
+		{loginFreeFailures + 1, time.Second},
+		{loginFreeFailures + 2, 2 * time.Second},
+		{loginFreeFailures + 5, 16 * time.Second},
+		{loginFreeFailures + 6, loginMaxDelay},
+		{1000, loginMaxDelay},
+	}
+	for _, tt := range tests {
+		if got := loginDelay(tt.failures); got != tt.want {
+			t.Errorf("loginDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLimiterAccountLockout(t *testing.T) {
+	l, clock, audit := newTestLimiter(5, 10*time.Minute)
+	for range loginFreeFailures {
+		l.Fail(1, "a@example.com", "1.1.1.1")
+	}
+	if err := l.Allow("a@example.com", "1.1.1.1"); err != nil {
+		t.Fatalf("after %d failures: %v", loginFreeFailures, err)
+	}
+
+	l.Fail(1, "a@example.com", "1.1.1.1")
+	e := throttled(t, l.Allow("A@Example.com ", "2.2.2.2"))
+	if e.Locked || e.RetryAfter != time.Second {
+		t.Fatalf("after 4 failures: %+v, want a 1s delay", e)
+	}
+	clock.advance(time.Second)
+	if err := l.Allow("a@example.com", "2.2.2.2"); err != nil {
+		t.Fatalf("after the delay: %v", err)
+	}
+
+	l.Fail(1, "a@example.com", "1.1.1.1")
+	e = throttled(t, l.Allow("a@example.com", "2.2.2.2"))
+	if !e.Locked || e.RetryAfter != 10*time.Minute {
+		t.Fatalf("after 5 failures: %+v, want locked for 10m", e)
+	}
+	if len(audit.entries) != 1 || audit.entries[0].Event != models.AuditLoginLockout || audit.entries[0].UserID != 1 ||
+		!strings.HasPrefix(audit.entries[0].Detail, "account locked") {
+		t.Fatalf("audit = %+v", audit.entries)
+	}
+
+	clock.advance(10 * time.Minute)
+	if err := l.Allow("a@example.com", "2.2.2.2"); err != nil {
+		t.Fatalf("after the lockout: %v", err)
+	}
+	// Failures are counted afresh after a lockout.
+	l.Fail(1, "a@example.com", "2.2.2.2")
+	if err := l.Allow("a@example.com", "3.3.3.3"); err != nil {
+		t.Fatalf("first failure after the lockout: %v", err)
+	}
+}
+
+func TestLoginLimiterIPLockout(t *testing.T) {
+	const maxFailures = 5
+	l, clock, audit := newTestLimiter(maxFailures, 10*time.Minute)
+	// One guess per account, as in a password spray: no account gets near
+	// its limit, the address does at ipFailureFactor times it.
+	for i := range maxFailures*ipFailureFactor - 1 {
+		clock.advance(time.Minute)
+		l.Fail(0, string(rune('a'+i))+"@example.com", "6.6.6.6")
+	}
+	e := throttled(t, l.Allow("new@example.com", "6.6.6.6"))
+	if e.Locked {
+		t.Fatalf("after %d failures: %+v, want only a delay", maxFailures*ipFailureFactor-1, e)
+	}
+	l.Fail(0, "last@example.com", "6.6.6.6")
+	e = throttled(t, l.Allow("new@example.com", "6.6.6.6"))
+	if !e.Locked || e.RetryAfter != 10*time.Minute {
+		t.Fatalf("after %d failures: %+v, want the address locked", maxFailures*ipFailureFactor, e)
+	}
+	if err := l.Allow("new@example.com", "7.7.7.7"); err != nil {
+		t.Fatalf("another address: %v", err)
+	}
+	if len(audit.entries) != 1 || !strings.HasPrefix(audit.entries[0].Detail, "ip locked") || audit.entries[0].IP != "6.6.6.6" {
+		t.Fatalf("audit = %+v", audit.entries)
+	}
+}
+
+func TestLoginLimiterSucceed(t *testing.T) {
+	l, clock, _ := newTestLimiter(5, 10*time.Minute)
+	for range loginFreeFailures + 1 {
+		l.Fail(1, "a@example.com", "1.1.1.1")
+	}
+	l.Succeed("a@example.com")
+	if err := l.Allow("a@example.com", "2.2.2.2"); err != nil {
+		t.Fatalf("account after a successful login: %v", err)
+	}
+	// The address keeps its failures.
+	throttled(t, l.Allow("b@example.com", "1.1.1.1"))
+
+	// Failures older than the lockout period are forgotten.
+	clock.advance(10*time.Minute + time.Second)
+	l.Fail(2, "b@example.com", "1.1.1.1")
+	if err := l.Allow("b@example.com", "1.1.1.1"); err != nil {
+		t.Fatalf("after the failures expired: %v", err)
+	}
+}
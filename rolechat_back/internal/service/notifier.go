@@ -0,0 +1,81 @@
+package service
+
+import (
+	"sync"
+
+	"rolechat_back/internal/models"
+)
+
+const (
+	NotifyTopic  = "topic"  // a topic was created, renamed or reorganised
+	NotifyTyping = "typing" // someone started or stopped writing in a topic
+)
+
+// Notification is a change pushed to a user's open connections, so other
+// devices and tabs of the same user stay current.
+type Notification struct {
+	Type    string
+	TopicID uint
+	Topic   *models.Topic // NotifyTopic
+	Role    string        // NotifyTyping: "user" or "assistant"
+	Typing  bool          // NotifyTyping
+	Source  string        // connection that caused it; it is not sent back there
+}
+
+type subscription struct {
+	ch     chan Notification
+	source string
+}
+
+// Notifier fans notifications out to the subscribers of each user. A nil
+// Notifier drops everything, so services work without one.
+type Notifier struct {
+	mu   sync.Mutex
+	subs map[uint]map[*subscription]struct{}
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{subs: map[uint]map[*subscription]struct{}{}}
+}
+
+// Subscribe returns the notifications for userID not caused by source and
+// the function that ends the subscription.
+func (n *Notifier) Subscribe(userID uint, source string) (<-chan Notification, func()) {
+	sub := &subscription{ch: make(chan Notification, 16), source: source}
+	n.mu.Lock()
+	if n.subs[userID] == nil {
+		n.subs[userID] = map[*subscription]struct{}{}
+	}
+	n.subs[userID][sub] = struct{}{}
+	n.mu.Unlock()
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			n.mu.Lock()
+			delete(n.subs[userID], sub)
+			if len(n.subs[userID]) == 0 {
+				delete(n.subs, userID)
+			}
+			n.mu.Unlock()
+		})
+	}
+}
+
+// Publish never blocks: a subscriber that is not keeping up misses the
+// notification rather than holding up the sender.
+func (n *Notifier) Publish(userID uint, note Notification) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for sub := range n.subs[userID] {
+		if note.Source != "" && sub.source == note.Source {
+			continue
+		}
+		select {
+		case sub.ch <- note:
+		default:
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+
+	"gorm.io/gorm"
+)
+
+// demoPersonas are the built-in personas. They are stored in the database the
+// first time it has none, after which admins manage them there.
+var demoPersonas = map[string]*models.RolePersona{
+	"导师":       {Name: "导师", SystemPrompt: "你是一个耐心的中文导师, 给出循序渐进的讲解, 语言温和。", Voice: "mentor"},
+	"搞笑":       {Name: "搞笑", SystemPrompt: "你是一名幽默搞笑的朋友, 回答要轻松, 可以加表情, 但保持有用信息。", Voice: "fun"},
+	"严肃":       {Name: "严肃", SystemPrompt: "你是一位严谨专业的顾问, 用正式语气回答, 避免多余的感叹。", Voice: "serious"},
+	"hermione": {Name: "赫敏", SystemPrompt: "你就是赫敏·格兰杰本人。请始终用第一人称'我'来回答，绝不使用第三人称。我是格兰芬多学院的学生，哈利和罗恩是我最好的朋友。我聪明博学，热爱学习，来自麻瓜家庭。", Voice: "hermione"},
+	"harry":    {Name: "哈利", SystemPrompt: "你就是哈利·波特本人。请始终用第一人称'我'来回答，绝不使用第三人称。我是哈利·波特，被称为'大难不死的男孩'，格兰芬多学院学生。赫敏和罗恩是我最好的朋友。我在德思礼家长大，经历过很多冒险。", Voice: "harry"},
+	"ron":      {Name: "罗恩", SystemPrompt: "你就是罗恩·韦斯莱本人。请始终用第一人称'我'来回答，绝不使用第三人称。我是罗恩·韦斯莱，来自韦斯莱家族，格兰芬多学院学生。哈利和赫敏是我最好的朋友。我有很多兄弟姐妹，擅长巫师棋。", Voice: "ron"},
+}
+
+// personas is what LookupPersona resolves against: the built-ins until
+// PersonaService.Load replaces them with the stored personas.
+var (
+	personaMu sync.RWMutex
+	personas  = demoPersonas
+)
+
+// LookupPersona resolves a role_id / persona_name sent by the client.
+func LookupPersona(key string) *models.RolePersona {
+	personaMu.RLock()
+	defer personaMu.RUnlock()
+	return personas[key]
+}
+
+// PersonaName is the display name for a stored persona key.
+func PersonaName(key string) string {
+	if p := LookupPersona(key); p != nil {
+		return p.Name
+	}
+	return key
+}
+
+var (
+	errPersonaNotFound = errors.New("persona not found")
+	errPersonaExists   = errors.New("persona already exists")
+)
+
+// PersonaService manages the global personas. Changes apply to this process
+// at once; other instances pick them up when they next load.
+type PersonaService interface {
+	// Load stores the built-in personas if there are none yet and makes the
+	// stored ones the ones LookupPersona sees.
+	Load() error
+	List() ([]models.RolePersona, error)
+	Create(p *models.RolePersona) error
+	Update(key string, upd PersonaUpdate) (*models.RolePersona, error)
+	Delete(key string) error
+}
+
+// PersonaUpdate holds the persona fields to change; nil fields are left as
+// they are.
+type PersonaUpdate struct {
+	Name         *string
+	SystemPrompt *string
+	Voice        *string
+	Chunking     *string
+}
+
+type personaService struct {
+	repo repository.PersonaRepository
+}
+
+func NewPersonaService(repo repository.PersonaRepository) PersonaService {
+	return &personaService{repo: repo}
+}
+
+func (s *personaService) Load() error {
+	list, err := s.repo.List()
+	if err != nil {
+		return err
+	}
+	if len(list) == 0 {
+		for key, p := range demoPersonas {
+			stored := *p
+			stored.Key = key
+			if err := s.repo.Create(&stored); err != nil {
+				return err
+			}
+		}
+	}
+	return s.reload()
+}
+
+func (s *personaService) reload() error {
+	list, err := s.repo.List()
+	if err != nil {
+		return err
+	}
+	loaded := make(map[string]*models.RolePersona, len(list))
+	for i := range list {
+		if list[i].Key != "" {
+			loaded[list[i].Key] = &list[i]
+		}
+	}
+	personaMu.Lock()
+	personas = loaded
+	personaMu.Unlock()
+	return nil
+}
+
+func (s *personaService) List() ([]models.RolePersona, error) {
+	return s.repo.List()
+}
+
+func validatePersona(p *models.RolePersona) error {
+	p.Key = strings.TrimSpace(p.Key)
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Key == "" || utf8.RuneCountInString(p.Key) > 50 {
+		return errors.New("key must be 1-50 characters")
+	}
+	if p.Name == "" {
+		p.Name = p.Key
+	}
+	if utf8.RuneCountInString(p.Name) > 50 {
+		return errors.New("name too long")
+	}
+	if strings.TrimSpace(p.SystemPrompt) == "" {
+		return errors.New("system prompt required")
+	}
+	if _, err := NewChunker(ChunkOptions{Strategy: p.Chunking}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *personaService) Create(p *models.RolePersona) error {
+	if err := validatePersona(p); err != nil {
+		return err
+	}
+	if _, err := s.repo.FindByKey(p.Key); err == nil {
+		return errPersonaExists
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	if err := s.repo.Create(p); err != nil {
+		return err
+	}
+	return s.reload()
+}
+
+func (s *personaService) Update(key string, upd PersonaUpdate) (*models.RolePersona, error) {
+	p, err := s.repo.FindByKey(key)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, errPersonaNotFound
+		}
+		return nil, err
+	}
+	if upd.Name != nil {
+		p.Name = *upd.Name
+	}
+	if upd.SystemPrompt != nil {
+		p.SystemPrompt = *upd.SystemPrompt
+	}
+	if upd.Voice != nil {
+		p.Voice = *upd.Voice
+	}
+	if upd.Chunking != nil {
+		p.Chunking = *upd.Chunking
+	}
+	if err := validatePersona(p); err != nil {
+		return nil, err
+	}
+	if err := s.repo.Save(p); err != nil {
+		return nil, err
+	}
+	return p, s.reload()
+}
+
+// Delete removes a persona. Messages keep its key, which is then shown as
+// is in place of the name.
+func (s *personaService) Delete(key string) error {
+	p, err := s.repo.FindByKey(key)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return errPersonaNotFound
+		}
+		return err
+	}
+	if err := s.repo.Delete(p.ID); err != nil {
+		return err
+	}
+	return s.reload()
+}
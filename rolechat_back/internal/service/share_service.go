@@ -0,0 +1,145 @@
+package service
+
+import (
+	"errors"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/pkg/utils"
+)
+
+var errShareNotFound = errors.New("share not found")
+
+type ShareService interface {
+	CreateShare(userID, topicID uint, opts ShareOptions) (share *models.TopicShare, token string, err error)
+	ListShares(userID, topicID uint) ([]models.TopicShare, error)
+	RevokeShare(userID, shareID uint) error
+	GetSharedTranscript(token string) (*SharedTranscript, error)
+}
+
+type ShareOptions struct {
+	Snapshot          bool // freeze the link at the current last message
+	SnapshotMessageID uint // freeze the link at this message
+	ExpiresIn         time.Duration
+}
+
+type SharedTranscript struct {
+	Share    *models.TopicShare
+	Topic    *models.Topic
+	Messages []models.Message
+}
+
+type shareService struct {
+	shareRepo repository.ShareRepository
+	chatRepo  repository.ChatRepository
+}
+
+func NewShareService(shareRepo repository.ShareRepository, chatRepo repository.ChatRepository) ShareService {
+	return &shareService{shareRepo: shareRepo, chatRepo: chatRepo}
+}
+
+func (s *shareService) ownedTopic(userID, topicID uint) (*models.Topic, error) {
+	t, err := s.chatRepo.GetTopicByID(topicID)
+	if err != nil {
+		return nil, err
+	}
+	if t.UserID != userID {
+		return nil, errors.New("forbidden")
+	}
+	return t, nil
+}
+
+func (s *shareService) CreateShare(userID, topicID uint, opts ShareOptions) (*models.TopicShare, string, error) {
+	if _, err := s.ownedTopic(userID, topicID); err != nil {
+		return nil, "", err
+	}
+	snapshot := opts.SnapshotMessageID
+	if snapshot != 0 || opts.Snapshot {
+		msgs, err := s.chatRepo.ListAllMessagesByTopic(topicID)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(msgs) == 0 {
+			return nil, "", errors.New("topic has no messages")
+		}
+		if snapshot == 0 {
+			snapshot = msgs[len(msgs)-1].ID
+		} else if !containsMessage(msgs, snapshot) {
+			return nil, "", errors.New("snapshot message not in topic")
+		}
+	}
+	token, err := utils.RandomToken(32)
+	if err != nil {
+		return nil, "", err
+	}
+	share := &models.TopicShare{
+		TopicID:           topicID,
+		UserID:            userID,
+		TokenHash:         utils.HashToken(token),
+		SnapshotMessageID: snapshot,
+	}
+	if opts.ExpiresIn > 0 {
+		exp := time.Now().Add(opts.ExpiresIn)
+		share.ExpiresAt = &exp
+	}
+	if err := s.shareRepo.Create(share); err != nil {
+		return nil, "", err
+	}
+	return share, token, nil
+}
+
+func containsMessage(msgs []models.Message, id uint) bool {
+	for _, m := range msgs {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *shareService) ListShares(userID, topicID uint) ([]models.TopicShare, error) {
+	if _, err := s.ownedTopic(userID, topicID); err != nil {
+		return nil, err
+	}
+	return s.shareRepo.ListByTopic(topicID)
+}
+
+func (s *shareService) RevokeShare(userID, shareID uint) error {
+	share, err := s.shareRepo.GetByID(shareID)
+	if err != nil {
+		return errShareNotFound
+	}
+	if share.UserID != userID {
+		return errors.New("forbidden")
+	}
+	return s.shareRepo.Revoke(shareID)
+}
+
+// GetSharedTranscript reports revoked, expired and unknown tokens alike so
+// the public endpoint reveals nothing about links it will not serve.
+func (s *shareService) GetSharedTranscript(token string) (*SharedTranscript, error) {
+	share, err := s.shareRepo.GetByTokenHash(utils.HashToken(token))
+	if err != nil {
+		return nil, errShareNotFound
+	}
+	if share.Revoked || (share.ExpiresAt != nil && time.Now().After(*share.ExpiresAt)) {
+		return nil, errShareNotFound
+	}
+	t, err := s.chatRepo.GetTopicByID(share.TopicID)
+	if err != nil {
+		return nil, errShareNotFound
+	}
+	msgs, err := s.chatRepo.ListAllMessagesByTopic(share.TopicID)
+	if err != nil {
+		return nil, err
+	}
+	if share.SnapshotMessageID != 0 {
+		n := 0
+		for n < len(msgs) && msgs[n].ID <= share.SnapshotMessageID {
+			n++
+		}
+		msgs = msgs[:n]
+	}
+	return &SharedTranscript{Share: share, Topic: t, Messages: msgs}, nil
+}
@@ -0,0 +1,166 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/pkg/logger"
+	"rolechat_back/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTokenRevoked    = errors.New("token revoked")
+	ErrAccountDisabled = errors.New("account disabled")
+)
+
+// tokenGuardTTL bounds how long a change made by another instance, such as a
+// ban or a logout, takes to reach this one. Changes made through this
+// process apply immediately.
+const tokenGuardTTL = 15 * time.Second
+
+type guardedUser struct {
+	role        string
+	status      string
+	validAfter  time.Time
+	missing     bool
+	refreshedAt time.Time
+}
+
+// TokenGuard decides whether a validly signed access token is still honoured:
+// its jti and session must not be denylisted, it must be issued after the
+// user's TokensValidAfter and the user must be active. Users and the
+// denylist are cached in process so the check rarely hits the database.
+type TokenGuard struct {
+	repo      repository.UserRepository
+	accessTTL time.Duration
+
+	mu            sync.Mutex
+	users         map[uint]*guardedUser
+	revoked       map[string]time.Time // token or session id -> expiry
+	revokedLoaded time.Time
+}
+
+// NewTokenGuard returns a guard for access tokens that live for accessTTL.
+func NewTokenGuard(repo repository.UserRepository, accessTTL time.Duration) *TokenGuard {
+	if accessTTL <= 0 {
+		accessTTL = 15 * time.Minute
+	}
+	return &TokenGuard{repo: repo, accessTTL: accessTTL, users: map[uint]*guardedUser{}, revoked: map[string]time.Time{}}
+}
+
+// Check returns the user's current role, which may differ from the one in
+// the token, or why the token is rejected.
+func (g *TokenGuard) Check(claims *utils.JWTClaims) (string, error) {
+	if g == nil {
+		return claims.Role, nil
+	}
+	if g.isRevoked(claims.ID) || (claims.SessionID != "" && g.isRevoked(claims.SessionID)) {
+		return "", ErrTokenRevoked
+	}
+	u, err := g.user(claims.UserID)
+	if err != nil {
+		return "", err
+	}
+	if u.missing {
+		return "", ErrTokenRevoked
+	}
+	if u.status != models.UserStatusActive {
+		return "", ErrAccountDisabled
+	}
+	// iat has second precision, so compare at that precision.
+	if claims.IssuedAt == nil || claims.IssuedAt.Time.Before(u.validAfter.Truncate(time.Second)) {
+		return "", ErrTokenRevoked
+	}
+	return u.role, nil
+}
+
+func (g *TokenGuard) isRevoked(id string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if time.Since(g.revokedLoaded) > tokenGuardTTL {
+		tokens, err := g.repo.ListRevokedTokens()
+		if err != nil {
+			// Keep the stale list rather than failing every request.
+			logger.Warnf("load revoked tokens: %v", err)
+		} else {
+			g.revoked = make(map[string]time.Time, len(tokens))
+			for _, t := range tokens {
+				g.revoked[t.TokenID] = t.ExpiresAt
+			}
+		}
+		g.revokedLoaded = time.Now()
+	}
+	exp, ok := g.revoked[id]
+	return ok && time.Now().Before(exp)
+}
+
+func (g *TokenGuard) user(userID uint) (*guardedUser, error) {
+	g.mu.Lock()
+	u, ok := g.users[userID]
+	g.mu.Unlock()
+	if ok && time.Since(u.refreshedAt) < tokenGuardTTL {
+		return u, nil
+	}
+	user, err := g.repo.FindByID(userID)
+	u = &guardedUser{refreshedAt: time.Now()}
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		u.missing = true
+	case err != nil:
+		return nil, err
+	default:
+		u.role = user.Role
+		u.status = user.Status
+		if user.TokensValidAfter != nil {
+			u.validAfter = *user.TokensValidAfter
+		}
+	}
+	g.mu.Lock()
+	g.users[userID] = u
+	g.mu.Unlock()
+	return u, nil
+}
+
+// RevokeToken denylists an access token jti or a session id until every
+// access token it can match has expired.
+func (g *TokenGuard) RevokeToken(userID uint, id string) error {
+	if g == nil || id == "" {
+		return nil
+	}
+	exp := time.Now().Add(g.accessTTL)
+	if err := g.repo.RevokeAccessToken(&models.RevokedToken{TokenID: id, UserID: userID, ExpiresAt: exp}); err != nil {
+		return err
+	}
+	g.mu.Lock()
+	g.revoked[id] = exp
+	g.mu.Unlock()
+	return nil
+}
+
+// RevokeAll rejects every access token of the user issued until now.
+func (g *TokenGuard) RevokeAll(userID uint) error {
+	if g == nil {
+		return nil
+	}
+	if err := g.repo.SetTokensValidAfter(userID, time.Now()); err != nil {
+		return err
+	}
+	g.Forget(userID)
+	return nil
+}
+
+// Forget drops the cached user so the next request sees changes to their
+// role or status.
+func (g *TokenGuard) Forget(userID uint) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	delete(g.users, userID)
+	g.mu.Unlock()
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/pkg/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// guardRepo is the user and denylist storage shared by several instances.
+type guardRepo struct {
+	repository.UserRepository
+	mu      sync.Mutex
+	users   map[uint]models.User
+	revoked []models.RevokedToken
+	lookups int
+}
+
+func (r *guardRepo) FindByID(id uint) (*models.User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	u, ok := r.users[id]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &u, nil
+}
+
+func (r *guardRepo) SetTokensValidAfter(userID uint, t time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := r.users[userID]
+	u.TokensValidAfter = &t
+	r.users[userID] = u
+	return nil
+}
+
+func (r *guardRepo) RevokeAccessToken(t *models.RevokedToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.revoked = append(r.revoked, *t)
+	return nil
+}
+
+func (r *guardRepo) ListRevokedTokens() ([]models.RevokedToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]models.RevokedToken(nil), r.revoked...), nil
+}
+
+func (r *guardRepo) update(id uint, f func(*models.User)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u := r.users[id]
+	f(&u)
+	r.users[id] = u
+}
+
+func newGuardRepo() *guardRepo {
+	return &guardRepo{users: map[uint]models.User{1: {ID: 1, Role: "user", Status: models.UserStatusActive}}}
+}
+
+func accessClaims(jti, sid string, iat time.Time) *utils.JWTClaims {
+	return &utils.JWTClaims{UserID: 1, Role: "user", TokenType: "access", SessionID: sid, RegisteredClaims: jwt.RegisteredClaims{
+		ID:       jti,
+		IssuedAt: jwt.NewNumericDate(iat),
+	}}
+}
+
+func TestTokenGuardRevokeAll(t *testing.T) {
+	repo := newGuardRepo()
+	g := NewTokenGuard(repo, time.Minute)
+	if _, err := g.Check(accessClaims("a", "s", time.Now().Add(-2*time.Second))); err != nil {
+		t.Fatalf("before RevokeAll: %v", err)
+	}
+	if err := g.RevokeAll(1); err != nil {
+		t.Fatal(err)
+	}
+	revokedAt := *repo.users[1].TokensValidAfter
+	// iat has second precision: a token issued right after RevokeAll, such
+	// as the new pair of the login that caused it, has an iat in the same
+	// second and must still be accepted.
+	tests := []struct {
+		name string
+		iat  time.Time
+		want error
+	}{
+		{"previous second", revokedAt.Truncate(time.Second).Add(-time.Second), ErrTokenRevoked},
+		{"same second", revokedAt, nil},
+		{"later", revokedAt.Add(time.Second), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := g.Check(accessClaims("a", "s", tt.iat)); !errors.Is(err, tt.want) {
+				t.Fatalf("Check = %v, want %v", err, tt.want)
+			}
+		})
+	}
+	claims := accessClaims("a", "s", revokedAt)
+	claims.IssuedAt = nil
+	if _, err := g.Check(claims); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("token without iat: %v", err)
+	}
+}
+
+func TestTokenGuardSameSecondValidAfter(t *testing.T) {
+	repo := newGuardRepo()
+	base := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	repo.update(1, func(u *models.User) {
+		at := base.Add(700 * time.Millisecond)
+		u.TokensValidAfter = &at
+	})
+	g := NewTokenGuard(repo, time.Minute)
+	if _, err := g.Check(accessClaims("a", "", base)); err != nil {
+		t.Fatalf("iat in the second of TokensValidAfter: %v", err)
+	}
+	if _, err := g.Check(accessClaims("a", "", base.Add(-time.Second))); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("iat a second earlier: %v", err)
+	}
+}
+
+func TestTokenGuardDenylist(t *testing.T) {
+	repo := newGuardRepo()
+	g := NewTokenGuard(repo, time.Minute)
+	now := time.Now()
+	if err := g.RevokeToken(1, "session"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Check(accessClaims("other", "session", now)); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("token of a revoked session: %v", err)
+	}
+	if _, err := g.Check(accessClaims("jti", "another", now)); err != nil {
+		t.Fatalf("token of another session: %v", err)
+	}
+
+	// Another instance revokes a token; this one sees it once its cached
+	// list is older than tokenGuardTTL.
+	other := NewTokenGuard(repo, time.Minute)
+	if err := other.RevokeToken(1, "jti"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Check(accessClaims("jti", "another", now)); err != nil {
+		t.Fatalf("within the cache period: %v", err)
+	}
+	g.mu.Lock()
+	g.revokedLoaded = time.Now().Add(-tokenGuardTTL - time.Second)
+	g.mu.Unlock()
+	if _, err := g.Check(accessClaims("jti", "another", now)); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("after the cache period: %v", err)
+	}
+
+	// Entries end with the access tokens they can match.
+	g.mu.Lock()
+	g.revoked["jti"] = time.Now().Add(-time.Second)
+	g.mu.Unlock()
+	if _, err := g.Check(accessClaims("jti", "another", now)); err != nil {
+		t.Fatalf("expired denylist entry: %v", err)
+	}
+}
+
+func TestTokenGuardUserCache(t *testing.T) {
+	repo := newGuardRepo()
+	g := NewTokenGuard(repo, time.Minute)
+	now := time.Now()
+	if role, err := g.Check(accessClaims("a", "", now)); err != nil || role != "user" {
+		t.Fatalf("Check = %q, %v", role, err)
+	}
+	repo.update(1, func(u *models.User) { u.Role = "admin"; u.Status = models.UserStatusDisabled })
+	if _, err := g.Check(accessClaims("a", "", now)); err != nil || repo.lookups != 1 {
+		t.Fatalf("cached user: %v after %d lookups", err, repo.lookups)
+	}
+	g.Forget(1)
+	if _, err := g.Check(accessClaims("a", "", now)); !errors.Is(err, ErrAccountDisabled) {
+		t.Fatalf("disabled user: %v", err)
+	}
+	repo.update(1, func(u *models.User) { u.Status = models.UserStatusActive })
+	g.Forget(1)
+	if role, err := g.Check(accessClaims("a", "", now)); err != nil || role != "admin" {
+		t.Fatalf("current role: %q, %v", role, err)
+	}
+	if _, err := g.Check(&utils.JWTClaims{UserID: 2, RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(now)}}); !errors.Is(err, ErrTokenRevoked) {
+		t.Fatalf("deleted user: %v", err)
+	}
+}
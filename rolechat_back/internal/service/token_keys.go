@@ -0,0 +1,62 @@
+package service
+
+import (
+	"errors"
+
+	"rolechat_back/pkg/config"
+	"rolechat_back/pkg/utils"
+)
+
+// TokenKeys are the keys tokens are signed with. Access tokens may be
+// verified by other services, so with asymmetric keys configured they are
+// signed with those. Refresh and MFA tokens are only ever read by RoleChat
+// and stay on the HS256 refresh secret.
+type TokenKeys struct {
+	Access   *utils.KeySet
+	Internal *utils.KeySet
+}
+
+// NewTokenKeys loads the keys in cfg. Without cfg.Keys, access tokens are
+// signed with AccessSecret as before.
+func NewTokenKeys(cfg config.JWTConfig) (*TokenKeys, error) {
+	if cfg.RefreshSecret == "" {
+		return nil, errors.New("jwt refresh_secret required")
+	}
+	internal, err := utils.NewKeySet("", utils.NewHMACKey("", cfg.RefreshSecret))
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Keys) == 0 {
+		if cfg.AccessSecret == "" {
+			return nil, errors.New("jwt access_secret or keys required")
+		}
+		access, err := utils.NewKeySet("", utils.NewHMACKey("", cfg.AccessSecret))
+		if err != nil {
+			return nil, err
+		}
+		return &TokenKeys{Access: access, Internal: internal}, nil
+	}
+
+	keys := make([]*utils.SigningKey, 0, len(cfg.Keys))
+	for _, kc := range cfg.Keys {
+		k, err := utils.LoadSigningKey(kc.ID, kc.PrivateKeyFile, kc.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if cfg.AccessSecret != "" {
+		// Access tokens signed before the switch keep working until they
+		// expire; a token is only accepted with its own key's algorithm.
+		keys = append(keys, utils.NewHMACKey("", cfg.AccessSecret))
+	}
+	active := cfg.ActiveKey
+	if active == "" {
+		active = cfg.Keys[0].ID
+	}
+	access, err := utils.NewKeySet(active, keys...)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenKeys{Access: access, Internal: internal}, nil
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/pkg/utils"
+
+	"github.com/google/uuid"
+)
+
+const (
+	totpIssuer        = "RoleChat"
+	mfaChallengeTTL   = 5 * time.Minute
+	recoveryCodeCount = 10
+)
+
+var (
+	errInvalidMFACode    = errors.New("invalid two-factor code")
+	errInvalidMFAToken   = errors.New("invalid or expired mfa token")
+	errTOTPAlreadyOn     = errors.New("two-factor authentication already enabled")
+	errTOTPNotOn         = errors.New("two-factor authentication not enabled")
+	errTOTPSetupRequired = errors.New("two-factor setup not started")
+)
+
+// MFARequiredError is returned by Login when the password is right but the
+// account has two-factor authentication enabled. Token is the challenge to
+// send back with a code to CompleteMFALogin.
+type MFARequiredError struct {
+	Token     string
+	ExpiresIn time.Duration
+}
+
+func (e *MFARequiredError) Error() string { return "two-factor code required" }
+
+// mfaChallenge returns the short-lived token that proves the password step
+// of a login succeeded.
+func (s *userService) mfaChallenge(user *models.User) error {
+	token, err := utils.GenerateToken(user.ID, user.Role, user.Status, "mfa", s.keys.Internal, uuid.NewString(), "", mfaChallengeTTL)
+	if err != nil {
+		return err
+	}
+	return &MFARequiredError{Token: token, ExpiresIn: mfaChallengeTTL}
+}
+
+func (s *userService) CompleteMFALogin(mfaToken, code string, client ClientInfo) (string, string, error) {
+	claims, err := utils.ValidateToken(mfaToken, s.keys.Internal)
+	if err != nil || claims.TokenType != "mfa" {
+		return "", "", errInvalidMFAToken
+	}
+	user, err := s.repo.FindByID(claims.UserID)
+	if err != nil || !user.TOTPEnabled {
+		return "", "", errInvalidMFAToken
+	}
+	if user.Status != models.UserStatusActive {
+		return "", "", ErrAccountDisabled
+	}
+	if err := s.limiter.Allow(user.Email, client.IP); err != nil {
+		return "", "", err
+	}
+	if err := s.checkSecondFactor(user, code, true); err != nil {
+		if errors.Is(err, errInvalidMFACode) {
+			s.limiter.Fail(user.ID, user.Email, client.IP)
+		}
+		return "", "", err
+	}
+	s.limiter.Succeed(user.Email)
+	return s.issueTokenPair(user, nil, client)
+}
+
+// checkSecondFactor accepts a current TOTP code not used before, or, if
+// allowRecovery, an unused recovery code, which is then spent.
+func (s *userService) checkSecondFactor(user *models.User, code string, allowRecovery bool) error {
+	if step, ok := utils.ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		fresh, err := s.repo.SetTOTPStep(user.ID, step)
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return errInvalidMFACode
+		}
+		return nil
+	}
+	if allowRecovery {
+		used, err := s.repo.UseRecoveryCode(user.ID, utils.HashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+		if used {
+			return nil
+		}
+	}
+	return errInvalidMFACode
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(strings.TrimSpace(code)))
+}
+
+// newRecoveryCodes replaces the user's recovery codes and returns the new
+// ones, formatted xxxx-xxxx.
+func (s *userService) newRecoveryCodes(userID uint) ([]string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for range recoveryCodeCount {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(enc.EncodeToString(b))
+		codes = append(codes, raw[:4]+"-"+raw[4:])
+		hashes = append(hashes, utils.HashToken(raw))
+	}
+	if err := s.repo.ReplaceRecoveryCodes(userID, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// SetupTOTP starts enrollment with a new secret. It takes effect once
+// EnableTOTP confirms the user's app produces matching codes.
+func (s *userService) SetupTOTP(userID uint) (string, string, error) {
+	user, err := s.repo.FindByID(userID)
+	if err != nil {
+		return "", "", err
+	}
+	if user.TOTPEnabled {
+		return "", "", errTOTPAlreadyOn
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.repo.UpdateUser(userID, map[string]any{"totp_secret": secret}); err != nil {
+		return "", "", err
+	}
+	return secret, utils.TOTPURI(totpIssuer, user.Email, secret), nil
+}
+
+func (s *userService) EnableTOTP(userID uint, code string) ([]string, error) {
+	user, err := s.repo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.TOTPEnabled {
+		return nil, errTOTPAlreadyOn
+	}
+	if user.TOTPSecret == "" {
+		return nil, errTOTPSetupRequired
+	}
+	if err := s.checkSecondFactor(user, code, false); err != nil {
+		return nil, err
+	}
+	if err := s.repo.UpdateUser(userID, map[string]any{"totp_enabled": true}); err != nil {
+		return nil, err
+	}
+	return s.newRecoveryCodes(userID)
+}
+
+func (s *userService) DisableTOTP(userID uint, sessionID, password, code string) error {
+	user, err := s.repo.FindByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.confirmIdentity(user, sessionID, password); err != nil {
+		return err
+	}
+	if !user.TOTPEnabled {
+		return errTOTPNotOn
+	}
+	if err := s.checkSecondFactor(user, code, true); err != nil {
+		return err
+	}
+	if err := s.repo.UpdateUser(userID, map[string]any{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}); err != nil {
+		return err
+	}
+	return s.repo.ReplaceRecoveryCodes(userID, nil)
+}
+
+func (s *userService) RegenerateRecoveryCodes(userID uint, code string) ([]string, error) {
+	user, err := s.repo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TOTPEnabled {
+		return nil, errTOTPNotOn
+	}
+	if err := s.checkSecondFactor(user, code, false); err != nil {
+		return nil, err
+	}
+	return s.newRecoveryCodes(userID)
+}
+
+func (s *userService) RecoveryCodesLeft(userID uint) (int64, error) {
+	return s.repo.CountRecoveryCodes(userID)
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/pkg/config"
+	"rolechat_back/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+// mfaRepo keeps a user's TOTP step and recovery codes in memory.
+type mfaRepo struct {
+	repository.UserRepository
+	mu       sync.Mutex
+	user     models.User
+	lastStep int64
+	codes    map[string]bool // hash -> used
+}
+
+func (r *mfaRepo) FindByID(id uint) (*models.User, error) {
+	if id != r.user.ID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	u := r.user
+	return &u, nil
+}
+
+func (r *mfaRepo) SetTOTPStep(userID uint, step int64) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if step <= r.lastStep {
+		return false, nil
+	}
+	r.lastStep = step
+	return true, nil
+}
+
+func (r *mfaRepo) UseRecoveryCode(userID uint, hash string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	used, ok := r.codes[hash]
+	if !ok || used {
+		return false, nil
+	}
+	r.codes[hash] = true
+	return true, nil
+}
+
+func (r *mfaRepo) SaveRefreshToken(t *models.RefreshToken) error { return nil }
+
+func newMFAService(t *testing.T) (*userService, *mfaRepo, string) {
+	t.Helper()
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &mfaRepo{
+		user:  models.User{ID: 1, Email: "a@example.com", Role: "user", Status: models.UserStatusActive, TOTPEnabled: true, TOTPSecret: secret},
+		codes: map[string]bool{utils.HashToken("abcd2345"): false},
+	}
+	keys, err := NewTokenKeys(config.JWTConfig{AccessSecret: "access", RefreshSecret: "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{JWT: config.JWTConfig{AccessExpiresMins: 15, RefreshExpiresHours: 24}}
+	return &userService{repo: repo, cfg: cfg, keys: keys}, repo, secret
+}
+
+func TestCheckSecondFactorTOTPReplay(t *testing.T) {
+	s, repo, secret := newMFAService(t)
+	now := time.Now()
+	code, err := utils.TOTPCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkSecondFactor(&repo.user, code, false); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := s.checkSecondFactor(&repo.user, code, true); !errors.Is(err, errInvalidMFACode) {
+		t.Fatalf("replay: err = %v, want errInvalidMFACode", err)
+	}
+	// The previous period's code is still within the skew, but older than
+	// the one just used.
+	prev, _ := utils.TOTPCode(secret, now.Add(-30*time.Second))
+	if err := s.checkSecondFactor(&repo.user, prev, false); !errors.Is(err, errInvalidMFACode) {
+		t.Fatalf("earlier code: err = %v, want errInvalidMFACode", err)
+	}
+	next, _ := utils.TOTPCode(secret, now.Add(30*time.Second))
+	if err := s.checkSecondFactor(&repo.user, next, false); err != nil {
+		t.Fatalf("next code: %v", err)
+	}
+}
+
+func TestCheckSecondFactorRecoveryCode(t *testing.T) {
+	s, repo, _ := newMFAService(t)
+	if err := s.checkSecondFactor(&repo.user, "ABCD-2345", false); !errors.Is(err, errInvalidMFACode) {
+		t.Fatalf("recovery code where not allowed: err = %v", err)
+	}
+	if err := s.checkSecondFactor(&repo.user, " ABCD-2345 ", true); err != nil {
+		t.Fatalf("recovery code: %v", err)
+	}
+	if err := s.checkSecondFactor(&repo.user, "abcd2345", true); !errors.Is(err, errInvalidMFACode) {
+		t.Fatalf("spent recovery code: err = %v, want errInvalidMFACode", err)
+	}
+}
+
+func TestCompleteMFALoginReplay(t *testing.T) {
+	s, repo, secret := newMFAService(t)
+	challenge := s.mfaChallenge(&repo.user)
+	var mfa *MFARequiredError
+	if !errors.As(challenge, &mfa) {
+		t.Fatalf("mfaChallenge() = %v", challenge)
+	}
+	code, _ := utils.TOTPCode(secret, time.Now())
+	if _, _, err := s.CompleteMFALogin(mfa.Token, code, ClientInfo{}); err != nil {
+		t.Fatalf("login: %v", err)
+	}
+	if _, _, err := s.CompleteMFALogin(mfa.Token, code, ClientInfo{}); !errors.Is(err, errInvalidMFACode) {
+		t.Fatalf("replayed login: err = %v, want errInvalidMFACode", err)
+	}
+	access, _, _ := s.issueTokenPair(&repo.user, nil, ClientInfo{})
+	if _, _, err := s.CompleteMFALogin(access, code, ClientInfo{}); !errors.Is(err, errInvalidMFAToken) {
+		t.Fatalf("access token as challenge: err = %v, want errInvalidMFAToken", err)
+	}
+}
@@ -6,11 +6,17 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"rolechat_back/internal/models"
 	"rolechat_back/internal/repository"
 	"rolechat_back/pkg/config"
+	"rolechat_back/pkg/logger"
 	"rolechat_back/pkg/utils"
 
 	"github.com/google/uuid"
@@ -20,17 +26,80 @@ import (
 type UserService interface {
 	Create(ctx context.Context, user *models.User) error
 	Register(ctx context.Context, email, password, nickname string) (*models.User, error)
-	Login(ctx context.Context, email, password string) (accessToken, refreshToken string, err error)
-	RefreshAccessToken(refreshToken string) (accessToken string, err error)
+	// Login returns a *MFARequiredError instead of tokens for accounts with
+	// two-factor authentication; CompleteMFALogin then finishes the login.
+	Login(ctx context.Context, email, password string, client ClientInfo) (accessToken, refreshToken string, err error)
+	CompleteMFALogin(mfaToken, code string, client ClientInfo) (accessToken, refreshToken string, err error)
+	LoginWithIdentity(id ExternalIdentity, client ClientInfo) (accessToken, refreshToken string, err error)
+	// RefreshAccessToken rotates refreshToken: the old token is revoked and a
+	// new pair issued in the same session.
+	RefreshAccessToken(refreshToken string, client ClientInfo) (accessToken, newRefreshToken string, err error)
+	Logout(refreshToken string) error
+	ListSessions(userID uint) ([]models.RefreshToken, error)
+	RevokeSession(userID uint, jti string) error
+	RevokeAllSessions(userID uint) error
+	GetProfile(userID uint) (*models.User, error)
+	UpdateProfile(userID uint, upd ProfileUpdate) (*models.User, error)
+	// SetAvatar stores an uploaded PNG, JPEG, GIF or WebP image as the
+	// user's avatar, replacing the previous one.
+	SetAvatar(userID uint, image []byte) (*models.User, error)
+	// ChangePassword also ends every session but keepSession. Users
+	// without a password set one this way after a fresh sign-in.
+	ChangePassword(userID uint, keepSession, current, newPassword string) error
+	// DeleteAccount deletes the user's conversations and anonymises the
+	// account after checking their password, or for users without one,
+	// that sessionID signed in recently.
+	DeleteAccount(userID uint, sessionID, password string) error
+	// SetupTOTP returns a new secret and its otpauth:// URI.
+	SetupTOTP(userID uint) (secret, uri string, err error)
+	// EnableTOTP turns two-factor authentication on once code matches the
+	// secret from SetupTOTP, and returns the recovery codes.
+	EnableTOTP(userID uint, code string) (recoveryCodes []string, err error)
+	DisableTOTP(userID uint, sessionID, password, code string) error
+	RegenerateRecoveryCodes(userID uint, code string) ([]string, error)
+	RecoveryCodesLeft(userID uint) (int64, error)
 }
 
+// ProfileUpdate holds the profile fields to change; nil fields are left as
+// they are.
+type ProfileUpdate struct {
+	Nickname *string
+}
+
+// ClientInfo identifies the device a session was created from.
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+var (
+	errSessionNotFound  = errors.New("session not found")
+	ErrEmailNotVerified = errors.New("email not verified")
+	errReauthRequired   = errors.New("sign in again to continue")
+)
+
+// refreshReuseLeeway is how long after a rotation the replaced token is
+// rejected without treating it as stolen, so two tabs refreshing at the
+// same time do not log the user out.
+const refreshReuseLeeway = 10 * time.Second
+
+// reauthWindow is how recently a user without a password must have signed
+// in, in the session making the request, to change security settings.
+const reauthWindow = 10 * time.Minute
+
 type userService struct {
-	repo repository.UserRepository
-	cfg  *config.Config
+	repo    repository.UserRepository
+	cfg     *config.Config
+	keys    *TokenKeys
+	guard   *TokenGuard
+	limiter *LoginLimiter
 }
 
-func NewUserService(r repository.UserRepository, cfg *config.Config) UserService {
-	return &userService{repo: r, cfg: cfg}
+// NewUserService returns the user service, which signs tokens with keys.
+// guard is told about revoked sessions so their access tokens stop working
+// before they expire, and limiter throttles password logins.
+func NewUserService(r repository.UserRepository, cfg *config.Config, keys *TokenKeys, guard *TokenGuard, limiter *LoginLimiter) UserService {
+	return &userService{repo: r, cfg: cfg, keys: keys, guard: guard, limiter: limiter}
 }
 
 func (s *userService) Create(ctx context.Context, user *models.User) error {
@@ -51,84 +120,351 @@ func (s *userService) Register(ctx context.Context, email, password, nickname st
 	if err != nil {
 		return nil, err
 	}
-	user := &models.User{Email: email, PasswordHash: hash, Nickname: nickname, Role: "user", Status: "active", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+	status := models.UserStatusActive
+	if s.cfg.Auth.RequireEmailVerification {
+		status = models.UserStatusPending
+	}
+	user := &models.User{Email: email, PasswordHash: hash, Nickname: nickname, Role: "user", Status: status, CreatedAt: time.Now(), UpdatedAt: time.Now()}
 	if err := s.repo.Create(user); err != nil {
 		return nil, err
 	}
 	return user, nil
 }
 
-func (s *userService) Login(ctx context.Context, email, password string) (string, string, error) {
+func (s *userService) Login(ctx context.Context, email, password string, client ClientInfo) (string, string, error) {
+	if err := s.limiter.Allow(email, client.IP); err != nil {
+		return "", "", err
+	}
 	user, err := s.repo.FindByEmail(email)
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
+			s.limiter.Fail(0, email, client.IP)
 			return "", "", errors.New("invalid credentials")
 		}
 		return "", "", err
 	}
 	if !utils.CheckPasswordHash(password, user.PasswordHash) {
+		s.limiter.Fail(user.ID, email, client.IP)
 		return "", "", errors.New("invalid credentials")
 	}
-	access, refresh, err := s.issueTokenPair(user, "")
+	if user.Status == models.UserStatusPending {
+		return "", "", ErrEmailNotVerified
+	}
+	if user.Status != models.UserStatusActive {
+		return "", "", ErrAccountDisabled
+	}
+	if user.TOTPEnabled {
+		// The failure count is only reset once the second factor passes,
+		// so a known password does not buy unlimited code guesses.
+		return "", "", s.mfaChallenge(user)
+	}
+	s.limiter.Succeed(email)
+	access, refresh, err := s.issueTokenPair(user, nil, client)
 	return access, refresh, err
 }
 
-func (s *userService) RefreshAccessToken(refreshToken string) (string, error) {
-	claims, err := utils.ValidateToken(refreshToken, s.cfg.JWT.RefreshSecret)
+func (s *userService) RefreshAccessToken(refreshToken string, client ClientInfo) (string, string, error) {
+	claims, err := utils.ValidateToken(refreshToken, s.keys.Internal)
 	if err != nil {
-		return "", errors.New("invalid refresh token")
+		return "", "", errors.New("invalid refresh token")
 	}
 	if claims.TokenType != "refresh" {
-		return "", errors.New("token is not refresh type")
+		return "", "", errors.New("token is not refresh type")
 	}
 	stored, err := s.repo.GetRefreshTokenByJTI(claims.ID)
 	if err != nil {
-		return "", errors.New("refresh token not found")
-	}
-	if stored.Revoked || time.Now().After(stored.ExpiresAt) {
-		return "", errors.New("refresh token expired or revoked")
+		return "", "", errors.New("refresh token not found")
 	}
 	sha := sha256.Sum256([]byte(refreshToken))
 	providedHash := hex.EncodeToString(sha[:])
 	if providedHash != stored.TokenHash {
-		return "", errors.New("invalid refresh token")
+		return "", "", errors.New("invalid refresh token")
 	}
-	accessJTI := uuid.NewString()
-	accessExp := time.Duration(s.cfg.JWT.AccessExpiresMins) * time.Minute
-	access, genErr := utils.GenerateToken(claims.UserID, claims.Role, claims.Status, "access", s.cfg.JWT.AccessSecret, accessJTI, accessExp)
-	if genErr != nil {
-		return "", genErr
+	if stored.Revoked {
+		return "", "", s.rejectRevoked(stored)
+	}
+	if time.Now().After(stored.ExpiresAt) {
+		return "", "", errors.New("refresh token expired or revoked")
+	}
+	user, err := s.repo.FindByID(stored.UserID)
+	if err != nil {
+		return "", "", errors.New("refresh token not found")
+	}
+	if user.Status != models.UserStatusActive {
+		return "", "", ErrAccountDisabled
+	}
+	return s.issueTokenPair(user, stored, client)
+}
+
+// rejectRevoked handles a revoked refresh token being presented. A token
+// that was rotated away is only ever sent again by whoever copied it, so
+// the whole session is revoked and its owner has to log in again.
+func (s *userService) rejectRevoked(stored *models.RefreshToken) error {
+	if stored.ReplacedBy == "" {
+		return errors.New("refresh token expired or revoked")
+	}
+	if stored.RevokedAt != nil && time.Since(*stored.RevokedAt) < refreshReuseLeeway {
+		return errors.New("refresh token already used")
+	}
+	if err := s.revokeFamily(stored); err != nil {
+		return err
 	}
-	return access, nil
+	return errors.New("refresh token reuse detected")
 }
 
-func (s *userService) issueTokenPair(user *models.User, prevJTI string) (string, string, error) {
+// Logout revokes the session of refreshToken.
+func (s *userService) Logout(refreshToken string) error {
+	claims, err := utils.ValidateToken(refreshToken, s.keys.Internal)
+	if err != nil || claims.TokenType != "refresh" {
+		return errors.New("invalid refresh token")
+	}
+	stored, err := s.repo.GetRefreshTokenByJTI(claims.ID)
+	if err != nil {
+		return errors.New("invalid refresh token")
+	}
+	return s.revokeFamily(stored)
+}
+
+// ListSessions returns the current token of each active session. CreatedAt
+// is set to when the session started rather than its last rotation.
+func (s *userService) ListSessions(userID uint) ([]models.RefreshToken, error) {
+	tokens, err := s.repo.ListActiveRefreshTokens(userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range tokens {
+		if family := tokens[i].Family(); family != tokens[i].TokenID {
+			if first, err := s.repo.GetRefreshTokenByJTI(family); err == nil {
+				tokens[i].CreatedAt = first.CreatedAt
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// RevokeSession ends the session that jti, the current token or the session
+// id, belongs to.
+func (s *userService) RevokeSession(userID uint, jti string) error {
+	stored, err := s.repo.GetRefreshTokenByJTI(jti)
+	if err != nil || stored.UserID != userID {
+		return errSessionNotFound
+	}
+	return s.revokeFamily(stored)
+}
+
+func (s *userService) RevokeAllSessions(userID uint) error {
+	if err := s.repo.RevokeAllRefreshTokens(userID); err != nil {
+		return err
+	}
+	return s.guard.RevokeAll(userID)
+}
+
+// revokeFamily ends the session of t, including the access tokens already
+// issued in it.
+func (s *userService) revokeFamily(t *models.RefreshToken) error {
+	if err := s.repo.RevokeRefreshTokenFamily(t.Family()); err != nil {
+		return err
+	}
+	return s.guard.RevokeToken(t.UserID, t.Family())
+}
+
+// issueTokenPair starts a session, or continues prev's session when
+// rotating. prev is revoked first so only one of two concurrent rotations
+// gets a new pair.
+func (s *userService) issueTokenPair(user *models.User, prev *models.RefreshToken, client ClientInfo) (string, string, error) {
 	accessJTI := uuid.NewString()
 	refreshJTI := uuid.NewString()
+	family := refreshJTI
+	if prev != nil {
+		family = prev.Family()
+		ok, err := s.repo.RevokeRefreshToken(prev.TokenID, refreshJTI)
+		if err != nil {
+			return "", "", err
+		}
+		if !ok {
+			return "", "", errors.New("refresh token already used")
+		}
+		if client.UserAgent == "" {
+			client.UserAgent = prev.UserAgent
+		}
+	}
 	accessExp := time.Duration(s.cfg.JWT.AccessExpiresMins) * time.Minute
 	refreshExp := time.Duration(s.cfg.JWT.RefreshExpiresHours) * time.Hour
-	access, err := utils.GenerateToken(user.ID, user.Role, user.Status, "access", s.cfg.JWT.AccessSecret, accessJTI, accessExp)
+	access, err := utils.GenerateToken(user.ID, user.Role, user.Status, "access", s.keys.Access, accessJTI, family, accessExp)
 	if err != nil {
 		return "", "", err
 	}
-	refresh, err := utils.GenerateToken(user.ID, user.Role, user.Status, "refresh", s.cfg.JWT.RefreshSecret, refreshJTI, refreshExp)
+	refresh, err := utils.GenerateToken(user.ID, user.Role, user.Status, "refresh", s.keys.Internal, refreshJTI, "", refreshExp)
 	if err != nil {
 		return "", "", err
 	}
 	sha := sha256.Sum256([]byte(refresh))
 	hash := hex.EncodeToString(sha[:])
+	userAgent := client.UserAgent
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
 	rt := &models.RefreshToken{
-		UserID:    user.ID,
-		TokenID:   refreshJTI,
-		TokenHash: hash,
-		ExpiresAt: time.Now().Add(refreshExp),
-		CreatedAt: time.Now(),
+		UserID:     user.ID,
+		TokenID:    refreshJTI,
+		FamilyID:   family,
+		TokenHash:  hash,
+		ExpiresAt:  time.Now().Add(refreshExp),
+		UserAgent:  userAgent,
+		IP:         client.IP,
+		LastUsedAt: time.Now(),
+		CreatedAt:  time.Now(),
 	}
 	if err := s.repo.SaveRefreshToken(rt); err != nil {
 		return "", "", fmt.Errorf("store refresh token: %w", err)
 	}
-	if prevJTI != "" {
-		_ = s.repo.RevokeRefreshToken(prevJTI, refreshJTI)
-	}
 	return access, refresh, nil
 }
+
+func (s *userService) GetProfile(userID uint) (*models.User, error) {
+	return s.repo.FindByID(userID)
+}
+
+func (s *userService) UpdateProfile(userID uint, upd ProfileUpdate) (*models.User, error) {
+	fields := map[string]any{}
+	if upd.Nickname != nil {
+		nickname := strings.TrimSpace(*upd.Nickname)
+		if utf8.RuneCountInString(nickname) > 50 {
+			return nil, errors.New("nickname too long")
+		}
+		fields["nickname"] = nickname
+	}
+	if len(fields) > 0 {
+		if err := s.repo.UpdateUser(userID, fields); err != nil {
+			return nil, err
+		}
+	}
+	return s.repo.FindByID(userID)
+}
+
+const maxAvatarBytes = 2 << 20
+
+var avatarExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// avatarDir is where avatars are written; they are served from
+// /uploads/avatars.
+func (s *userService) avatarDir() string {
+	dir := s.cfg.App.UploadDir
+	if dir == "" {
+		dir = "uploads"
+	}
+	return filepath.Join(dir, "avatars")
+}
+
+func (s *userService) SetAvatar(userID uint, image []byte) (*models.User, error) {
+	if len(image) > maxAvatarBytes {
+		return nil, errors.New("avatar too large")
+	}
+	ext, ok := avatarExtensions[http.DetectContentType(image)]
+	if !ok {
+		return nil, errors.New("unsupported image type")
+	}
+	user, err := s.repo.FindByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	name, err := utils.RandomToken(12)
+	if err != nil {
+		return nil, err
+	}
+	dir := s.avatarDir()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	name = fmt.Sprintf("%d-%s%s", userID, name, ext)
+	if err := os.WriteFile(filepath.Join(dir, name), image, 0o644); err != nil {
+		return nil, err
+	}
+	if err := s.repo.UpdateUser(userID, map[string]any{"avatar_url": "/uploads/avatars/" + name}); err != nil {
+		return nil, err
+	}
+	s.removeAvatar(user.AvatarURL)
+	return s.repo.FindByID(userID)
+}
+
+func (s *userService) removeAvatar(avatarURL string) {
+	name := strings.TrimPrefix(avatarURL, "/uploads/avatars/")
+	if name == avatarURL || name == "" || strings.ContainsAny(name, `/\`) {
+		return
+	}
+	if err := os.Remove(filepath.Join(s.avatarDir(), name)); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("remove avatar %s: %v", name, err)
+	}
+}
+
+// confirmIdentity checks the current password before a sensitive change.
+// Accounts created through an OpenID Connect provider have none; they
+// confirm by having signed in within reauthWindow in session sessionID.
+func (s *userService) confirmIdentity(user *models.User, sessionID, password string) error {
+	if user.PasswordHash != "" {
+		if !utils.CheckPasswordHash(password, user.PasswordHash) {
+			return errors.New("current password is incorrect")
+		}
+		return nil
+	}
+	if sessionID == "" {
+		return errReauthRequired
+	}
+	first, err := s.repo.GetRefreshTokenByJTI(sessionID)
+	if err != nil || first.UserID != user.ID || time.Since(first.CreatedAt) > reauthWindow {
+		return errReauthRequired
+	}
+	return nil
+}
+
+func (s *userService) ChangePassword(userID uint, keepSession, current, newPassword string) error {
+	if len(newPassword) < 6 {
+		return errors.New("password must be at least 6 characters")
+	}
+	user, err := s.repo.FindByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.confirmIdentity(user, keepSession, current); err != nil {
+		return err
+	}
+	hash, err := utils.HashPassword(newPassword)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.UpdateUser(userID, map[string]any{"password_hash": hash}); err != nil {
+		return err
+	}
+	tokens, err := s.repo.ListActiveRefreshTokens(userID)
+	if err != nil {
+		return err
+	}
+	for i := range tokens {
+		if tokens[i].Family() != keepSession {
+			if err := s.revokeFamily(&tokens[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *userService) DeleteAccount(userID uint, sessionID, password string) error {
+	user, err := s.repo.FindByID(userID)
+	if err != nil {
+		return err
+	}
+	if err := s.confirmIdentity(user, sessionID, password); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteUser(userID); err != nil {
+		return err
+	}
+	s.removeAvatar(user.AvatarURL)
+	return s.guard.RevokeAll(userID)
+}
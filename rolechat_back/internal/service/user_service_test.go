@@ -0,0 +1,212 @@
+package service
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"rolechat_back/internal/models"
+	"rolechat_back/internal/repository"
+	"rolechat_back/pkg/config"
+	"rolechat_back/pkg/utils"
+
+	"gorm.io/gorm"
+)
+
+// sessionRepo keeps refresh tokens and the access token denylist in memory.
+type sessionRepo struct {
+	repository.UserRepository
+	mu      sync.Mutex
+	user    models.User
+	tokens  map[string]*models.RefreshToken
+	revoked []models.RevokedToken
+}
+
+func (r *sessionRepo) FindByID(id uint) (*models.User, error) {
+	if id != r.user.ID {
+		return nil, gorm.ErrRecordNotFound
+	}
+	u := r.user
+	return &u, nil
+}
+
+func (r *sessionRepo) SaveRefreshToken(t *models.RefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	saved := *t
+	r.tokens[t.TokenID] = &saved
+	return nil
+}
+
+func (r *sessionRepo) GetRefreshTokenByJTI(jti string) (*models.RefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tokens[jti]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	copy := *t
+	return &copy, nil
+}
+
+func (r *sessionRepo) RevokeRefreshToken(jti, replacedBy string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tokens[jti]
+	if !ok || t.Revoked {
+		return false, nil
+	}
+	now := time.Now()
+	t.Revoked, t.RevokedAt, t.ReplacedBy = true, &now, replacedBy
+	return true, nil
+}
+
+func (r *sessionRepo) RevokeRefreshTokenFamily(familyID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, t := range r.tokens {
+		if (t.FamilyID == familyID || t.TokenID == familyID) && !t.Revoked {
+			t.Revoked, t.RevokedAt = true, &now
+		}
+	}
+	return nil
+}
+
+func (r *sessionRepo) RevokeAccessToken(t *models.RevokedToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.revoked = append(r.revoked, *t)
+	return nil
+}
+
+func (r *sessionRepo) ListRevokedTokens() ([]models.RevokedToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]models.RevokedToken(nil), r.revoked...), nil
+}
+
+// age moves the rotation of jti back in time, past the reuse leeway.
+func (r *sessionRepo) age(jti string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	at := r.tokens[jti].RevokedAt.Add(-2 * refreshReuseLeeway)
+	r.tokens[jti].RevokedAt = &at
+}
+
+func newSessionService(t *testing.T) (*userService, *sessionRepo) {
+	t.Helper()
+	repo := &sessionRepo{
+		user:   models.User{ID: 1, Email: "a@example.com", Role: "user", Status: models.UserStatusActive},
+		tokens: map[string]*models.RefreshToken{},
+	}
+	keys, err := NewTokenKeys(config.JWTConfig{AccessSecret: "access", RefreshSecret: "refresh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{JWT: config.JWTConfig{AccessExpiresMins: 15, RefreshExpiresHours: 24}}
+	guard := NewTokenGuard(repo, 15*time.Minute)
+	return &userService{repo: repo, cfg: cfg, keys: keys, guard: guard}, repo
+}
+
+func refreshJTI(t *testing.T, s *userService, token string) string {
+	t.Helper()
+	claims, err := utils.ValidateToken(token, s.keys.Internal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return claims.ID
+}
+
+func TestRefreshRotatesWithinSession(t *testing.T) {
+	s, repo := newSessionService(t)
+	access, refresh, err := s.issueTokenPair(&repo.user, nil, ClientInfo{UserAgent: "browser"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access2, refresh2, err := s.RefreshAccessToken(refresh, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := repo.tokens[refreshJTI(t, s, refresh)], repo.tokens[refreshJTI(t, s, refresh2)]
+	if !first.Revoked || first.ReplacedBy != second.TokenID {
+		t.Fatalf("old token revoked=%v replaced_by=%q, want replaced by %q", first.Revoked, first.ReplacedBy, second.TokenID)
+	}
+	if second.Family() != first.Family() || second.UserAgent != "browser" {
+		t.Fatalf("new token family %q agent %q, want %q %q", second.Family(), second.UserAgent, first.Family(), "browser")
+	}
+	for _, tok := range []string{access, access2} {
+		claims, err := utils.ValidateToken(tok, s.keys.Access)
+		if err != nil || claims.SessionID != first.Family() {
+			t.Fatalf("access token session = %v, %v; want %q", claims, err, first.Family())
+		}
+	}
+}
+
+func TestRefreshReuse(t *testing.T) {
+	tests := []struct {
+		name         string
+		aged         bool
+		want         string
+		sessionEnded bool
+	}{
+		// Two tabs refreshing with the same token at once.
+		{"within leeway", false, "already used", false},
+		{"after leeway", true, "reuse detected", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, repo := newSessionService(t)
+			_, refresh, err := s.issueTokenPair(&repo.user, nil, ClientInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			access2, refresh2, err := s.RefreshAccessToken(refresh, ClientInfo{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.aged {
+				repo.age(refreshJTI(t, s, refresh))
+			}
+			if _, _, err := s.RefreshAccessToken(refresh, ClientInfo{}); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("replay: err = %v, want %q", err, tt.want)
+			}
+
+			_, _, err = s.RefreshAccessToken(refresh2, ClientInfo{})
+			if ended := err != nil; ended != tt.sessionEnded {
+				t.Fatalf("refresh with the current token: err = %v, want session ended %v", err, tt.sessionEnded)
+			}
+			claims, err := utils.ValidateToken(access2, s.keys.Access)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.guard.Check(claims); (err != nil) != tt.sessionEnded {
+				t.Fatalf("access token check: err = %v, want session ended %v", err, tt.sessionEnded)
+			}
+		})
+	}
+}
+
+func TestRefreshRejects(t *testing.T) {
+	s, repo := newSessionService(t)
+	access, refresh, err := s.issueTokenPair(&repo.user, nil, ClientInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.RefreshAccessToken(access, ClientInfo{}); err == nil {
+		t.Fatal("access token accepted as refresh token")
+	}
+	if err := s.Logout(refresh); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.RefreshAccessToken(refresh, ClientInfo{}); err == nil || !strings.Contains(err.Error(), "expired or revoked") {
+		t.Fatalf("logged out token: err = %v", err)
+	}
+
+	_, refresh, _ = s.issueTokenPair(&repo.user, nil, ClientInfo{})
+	repo.user.Status = models.UserStatusDisabled
+	if _, _, err := s.RefreshAccessToken(refresh, ClientInfo{}); err != ErrAccountDisabled {
+		t.Fatalf("disabled user: err = %v, want ErrAccountDisabled", err)
+	}
+}
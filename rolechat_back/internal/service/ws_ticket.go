@@ -0,0 +1,65 @@
+package service
+
+import (
+	"sync"
+	"time"
+
+	"rolechat_back/pkg/utils"
+)
+
+// wsTicketTTL is how long a client has to open the socket after asking for
+// a ticket.
+const wsTicketTTL = 30 * time.Second
+
+// WSTickets hands out the tickets browsers open /api/chat/ws with, since
+// they cannot set headers on the handshake and an access token in the URL
+// ends up in proxy and server logs. A ticket stands for the access token it
+// was issued for, is short-lived and works once. Tickets are kept in
+// process, so the socket must reach the instance that issued the ticket.
+type WSTickets struct {
+	mu      sync.Mutex
+	tickets map[string]wsTicket
+}
+
+type wsTicket struct {
+	claims  *utils.JWTClaims
+	expires time.Time
+}
+
+func NewWSTickets() *WSTickets {
+	return &WSTickets{tickets: map[string]wsTicket{}}
+}
+
+// Issue returns a ticket for the access token claims were read from.
+func (t *WSTickets) Issue(claims *utils.JWTClaims) (string, time.Duration, error) {
+	ticket, err := utils.RandomToken(32)
+	if err != nil {
+		return "", 0, err
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k, v := range t.tickets {
+		if now.After(v.expires) {
+			delete(t.tickets, k)
+		}
+	}
+	t.tickets[ticket] = wsTicket{claims: claims, expires: now.Add(wsTicketTTL)}
+	return ticket, wsTicketTTL, nil
+}
+
+// Redeem returns the claims of the token ticket was issued for and forgets
+// the ticket.
+func (t *WSTickets) Redeem(ticket string) (*utils.JWTClaims, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.tickets[ticket]
+	if !ok {
+		return nil, false
+	}
+	delete(t.tickets, ticket)
+	if time.Now().After(v.expires) {
+		return nil, false
+	}
+	return v.claims, true
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"rolechat_back/pkg/utils"
+)
+
+func TestWSTicketsRedeemOnce(t *testing.T) {
+	tickets := NewWSTickets()
+	claims := &utils.JWTClaims{UserID: 7, TokenType: "access"}
+	ticket, ttl, err := tickets.Issue(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != wsTicketTTL {
+		t.Fatalf("ttl = %v, want %v", ttl, wsTicketTTL)
+	}
+	got, ok := tickets.Redeem(ticket)
+	if !ok || got != claims {
+		t.Fatalf("Redeem = %v, %v; want the issued claims", got, ok)
+	}
+	if _, ok := tickets.Redeem(ticket); ok {
+		t.Fatal("ticket redeemed twice")
+	}
+	if _, ok := tickets.Redeem("unknown"); ok {
+		t.Fatal("unknown ticket redeemed")
+	}
+}
+
+func TestWSTicketsExpire(t *testing.T) {
+	tickets := NewWSTickets()
+	ticket, _, err := tickets.Issue(&utils.JWTClaims{UserID: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := tickets.tickets[ticket]
+	v.expires = time.Now().Add(-time.Second)
+	tickets.tickets[ticket] = v
+	if _, ok := tickets.Redeem(ticket); ok {
+		t.Fatal("expired ticket redeemed")
+	}
+}
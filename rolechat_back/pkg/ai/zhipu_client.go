@@ -3,6 +3,7 @@ package ai
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -15,6 +16,7 @@ type ZhipuClient struct {
 	apiKey     string
 	baseURL    string
 	chatModel  string
+	voiceModel string
 	ttsModel   string
 }
 
@@ -24,10 +26,14 @@ func NewZhipuClient(apiKey string) *ZhipuClient {
 		apiKey:     apiKey,
 		baseURL:    "https://open.bigmodel.cn/api/paas/v4",
 		chatModel:  "glm-4",
+		voiceModel: "glm-4-voice",
 		ttsModel:   "audio-01",
 	}
 }
 
+func (c *ZhipuClient) ChatModel() string  { return c.chatModel }
+func (c *ZhipuClient) VoiceModel() string { return c.voiceModel }
+
 type ChatMessage struct {
 	Role    string
 	Content string
@@ -102,9 +108,8 @@ func (c *ZhipuClient) Chat(messages []ChatMessage) (string, error) {
 }
 
 func (c *ZhipuClient) ChatVoice(messages []ChatMessage) (string, string, error) {
-	model := "glm-4-voice"
 	doSample := true
-	body, _ := json.Marshal(chatReq{Model: model, Messages: messages, Temperature: 0.8, TopP: 0.6, MaxTokens: 1024, DoSample: &doSample})
+	body, _ := json.Marshal(chatReq{Model: c.voiceModel, Messages: messages, Temperature: 0.8, TopP: 0.6, MaxTokens: 1024, DoSample: &doSample})
 	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/chat/completions", c.baseURL), bytes.NewReader(body))
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
@@ -135,28 +140,48 @@ func (c *ZhipuClient) ChatVoice(messages []ChatMessage) (string, string, error)
 	return msg.Content, audio, nil
 }
 
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// StreamChunk is one piece of a streamed reply. The last chunks usually carry
+// the finish reason and the token usage instead of content.
+type StreamChunk struct {
+	Content      string
+	FinishReason string
+	Usage        *Usage
+}
+
 type chatStreamResp struct {
 	Choices []struct {
 		Delta struct {
 			Content string `json:"content"`
 		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	Usage *Usage `json:"usage,omitempty"`
 }
 
-func (c *ZhipuClient) ChatStream(messages []ChatMessage) (<-chan string, <-chan error) {
-	tokens := make(chan string, 8)
+// ChatStream sends the reply as it arrives. Cancelling ctx aborts the
+// upstream request; no error is reported for a cancelled stream.
+func (c *ZhipuClient) ChatStream(ctx context.Context, messages []ChatMessage) (<-chan StreamChunk, <-chan error) {
+	chunks := make(chan StreamChunk, 8)
 	errCh := make(chan error, 1)
 	go func() {
-		defer close(tokens)
+		defer close(chunks)
 		defer close(errCh)
 		body, _ := json.Marshal(chatReq{Model: c.chatModel, Messages: messages, Temperature: 0.7, Stream: true})
-		req, _ := http.NewRequest("POST", fmt.Sprintf("%s/chat/completions", c.baseURL), bytes.NewReader(body))
+		req, _ := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%s/chat/completions", c.baseURL), bytes.NewReader(body))
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Accept", "text/event-stream")
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
 		resp, err := c.httpClient.Do(req)
 		if err != nil {
-			errCh <- err
+			if ctx.Err() == nil {
+				errCh <- err
+			}
 			return
 		}
 		defer resp.Body.Close()
@@ -165,6 +190,14 @@ func (c *ZhipuClient) ChatStream(messages []ChatMessage) (<-chan string, <-chan
 			errCh <- fmt.Errorf("chat stream http %d: %s", resp.StatusCode, string(data))
 			return
 		}
+		send := func(ch StreamChunk) bool {
+			select {
+			case chunks <- ch:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
 		scanner := bufio.NewScanner(resp.Body)
 		for scanner.Scan() {
 			line := scanner.Text()
@@ -180,20 +213,28 @@ func (c *ZhipuClient) ChatStream(messages []ChatMessage) (<-chan string, <-chan
 			}
 			var chunk chatStreamResp
 			if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
-				tokens <- payload
+				if !send(StreamChunk{Content: payload}) {
+					return
+				}
 				continue
 			}
 			for _, ch := range chunk.Choices {
-				if ch.Delta.Content != "" {
-					tokens <- ch.Delta.Content
+				if ch.Delta.Content == "" && ch.FinishReason == "" {
+					continue
+				}
+				if !send(StreamChunk{Content: ch.Delta.Content, FinishReason: ch.FinishReason}) {
+					return
 				}
 			}
+			if chunk.Usage != nil && !send(StreamChunk{Usage: chunk.Usage}) {
+				return
+			}
 		}
-		if err := scanner.Err(); err != nil && err != io.EOF {
+		if err := scanner.Err(); err != nil && err != io.EOF && ctx.Err() == nil {
 			errCh <- err
 		}
 	}()
-	return tokens, errCh
+	return chunks, errCh
 }
 
 type ttsReq struct {
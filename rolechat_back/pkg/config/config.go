@@ -13,11 +13,19 @@ type Config struct {
 	Log      LogConfig
 	JWT      JWTConfig
 	APIKey   APIKeyConfig `mapstructure:"api_key"`
+	App      AppConfig
+	Auth     AuthConfig
+	Mail     MailConfig
+	OIDC     []OIDCProviderConfig `mapstructure:"oidc"`
 }
 
 type ServerConfig struct {
 	Port string
 	Mode string
+	// TrustedProxies are the addresses (IPs or CIDRs) of reverse proxies
+	// whose X-Forwarded-For is believed. Empty trusts none, so the client
+	// IP is the peer address.
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
 }
 
 type DatabaseConfig struct {
@@ -38,12 +46,68 @@ type JWTConfig struct {
 	RefreshSecret       string `mapstructure:"refresh_secret"`
 	AccessExpiresMins   int    `mapstructure:"access_expires_mins"`
 	RefreshExpiresHours int    `mapstructure:"refresh_expires_hours"`
+	// Keys, when set, sign access tokens with RS256 or EdDSA instead of
+	// AccessSecret and are published at /.well-known/jwks.json. ActiveKey
+	// names the key that signs; the others only verify, for rotation.
+	Keys      []JWTKeyConfig `mapstructure:"keys"`
+	ActiveKey string         `mapstructure:"active_key"`
+}
+
+// JWTKeyConfig is an RSA or Ed25519 key in PEM files. A key with only a
+// public key file verifies tokens but cannot be active.
+type JWTKeyConfig struct {
+	ID             string `mapstructure:"id"`
+	PrivateKeyFile string `mapstructure:"private_key_file"`
+	PublicKeyFile  string `mapstructure:"public_key_file"`
 }
 
 type APIKeyConfig struct {
 	ZhipuAI string `mapstructure:"zhipuai_api_key"`
 }
 
+type AppConfig struct {
+	BaseURL   string `mapstructure:"base_url"`   // frontend URL used in links sent by email
+	UploadDir string `mapstructure:"upload_dir"` // where uploaded avatars are stored, served under /uploads
+	// ImportMaxMB bounds the size of one chat history import request; 0
+	// uses 32.
+	ImportMaxMB int `mapstructure:"import_max_mb"`
+}
+
+type AuthConfig struct {
+	// RequireEmailVerification keeps new accounts from logging in until their
+	// address is verified.
+	RequireEmailVerification bool `mapstructure:"require_email_verification"`
+	// LoginMaxFailures failed logins in a row lock an account for
+	// LoginLockoutMins; 0 uses 10 and 15.
+	LoginMaxFailures int `mapstructure:"login_max_failures"`
+	LoginLockoutMins int `mapstructure:"login_lockout_mins"`
+}
+
+// MailConfig selects how mail is sent: "smtp", or "file" to write each mail
+// to Dir (or the log when Dir is empty) during development.
+type MailConfig struct {
+	Driver   string
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	Dir      string
+}
+
+// OIDCProviderConfig is an OpenID Connect provider users can sign in with.
+// Name identifies it in URLs; RedirectURL must be registered with the
+// provider and point at /api/auth/oidc/{name}/callback.
+type OIDCProviderConfig struct {
+	Name         string
+	DisplayName  string `mapstructure:"display_name"`
+	Issuer       string
+	ClientID     string   `mapstructure:"client_id"`
+	ClientSecret string   `mapstructure:"client_secret"`
+	RedirectURL  string   `mapstructure:"redirect_url"`
+	Scopes       []string // defaults to openid, email and profile
+}
+
 func LoadConfig(path string) (*Config, error) {
 	viper.SetConfigFile(path)
 	viper.AutomaticEnv()
@@ -82,5 +146,8 @@ func LoadConfig(path string) (*Config, error) {
 	if v := os.Getenv("ZHIPU_API_KEY"); v != "" {
 		cfg.APIKey.ZhipuAI = v
 	}
+	if v := os.Getenv("SMTP_PASSWORD"); v != "" {
+		cfg.Mail.Password = v
+	}
 	return &cfg, nil
 }
@@ -0,0 +1,94 @@
+package mailer
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"rolechat_back/pkg/config"
+	"rolechat_back/pkg/logger"
+
+	"github.com/google/uuid"
+)
+
+// Mailer sends plain-text mail.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// New returns the mailer selected by cfg.Driver. An empty driver writes mail
+// to the log, so development setups need no configuration.
+func New(cfg config.MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		if cfg.Host == "" || cfg.From == "" {
+			return nil, fmt.Errorf("smtp mailer needs host and from")
+		}
+		return &SMTPMailer{cfg: cfg}, nil
+	case "", "file":
+		return &FileMailer{Dir: cfg.Dir, From: cfg.From}, nil
+	}
+	return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer sends through an SMTP server, using STARTTLS when offered and
+// PLAIN authentication when a username is configured.
+type SMTPMailer struct {
+	cfg config.MailConfig
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	from, err := mail.ParseAddress(m.cfg.From)
+	if err != nil {
+		return fmt.Errorf("invalid from address: %w", err)
+	}
+	port := m.cfg.Port
+	if port == 0 {
+		port = 587
+	}
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(port))
+	var auth smtp.Auth
+	if m.cfg.Username != "" {
+		auth = smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)
+	}
+	return smtp.SendMail(addr, auth, from.Address, []string{to}, buildMessage(m.cfg.From, to, subject, body))
+}
+
+// FileMailer writes each mail to an .eml file in Dir, or to the log when
+// Dir is empty. It is meant for development.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	if m.Dir == "" {
+		logger.Infof("mail to %s: %s\n%s", to, subject, body)
+		return nil
+	}
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+	name := time.Now().Format("20060102-150405") + "-" + uuid.NewString()[:8] + ".eml"
+	return os.WriteFile(filepath.Join(m.Dir, name), buildMessage(m.From, to, subject, body), 0o644)
+}
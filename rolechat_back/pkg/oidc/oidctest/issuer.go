@@ -0,0 +1,166 @@
+// Package oidctest runs a fake OpenID Connect issuer for tests. It serves
+// discovery, its signing keys and a token endpoint that checks the PKCE
+// verifier, and signs ID tokens with claims the test chooses.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+
+	"rolechat_back/pkg/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Issuer is a running fake provider. Close it when done.
+type Issuer struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	mu    sync.Mutex
+	key   *rsa.PrivateKey
+	kid   string
+	codes map[string]grant
+}
+
+type grant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+// NewIssuer starts an issuer that accepts the given client.
+func NewIssuer(clientID, clientSecret string) *Issuer {
+	iss := &Issuer{ClientID: clientID, ClientSecret: clientSecret, codes: map[string]grant{}}
+	iss.Rotate()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", iss.discovery)
+	mux.HandleFunc("/jwks", iss.jwks)
+	mux.HandleFunc("/token", iss.token)
+	iss.Server = httptest.NewServer(mux)
+	return iss
+}
+
+// Rotate replaces the signing key with a new one under a new kid. Tokens
+// signed before are no longer verifiable.
+func (iss *Issuer) Rotate() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.key = key
+	iss.kid = fmt.Sprintf("key-%d", time.Now().UnixNano())
+}
+
+// Authorize plays the user signing in at the provider: it reads the
+// request the relying party sent to the authorization endpoint and returns
+// the code and state the browser is redirected back with. The ID token
+// redeemed for the code carries claims over the defaults (iss, aud, nonce,
+// iat and exp); a nil value removes a default.
+func (iss *Issuer) Authorize(authURL string, claims map[string]any) (code, state string, err error) {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	if q.Get("client_id") != iss.ClientID || q.Get("code_challenge_method") != "S256" {
+		return "", "", fmt.Errorf("unexpected authorization request %s", authURL)
+	}
+	now := time.Now()
+	tok := jwt.MapClaims{
+		"iss":   iss.URL,
+		"aud":   iss.ClientID,
+		"nonce": q.Get("nonce"),
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(tok, k)
+		} else {
+			tok[k] = v
+		}
+	}
+	code, err = utils.RandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	iss.mu.Lock()
+	iss.codes[code] = grant{challenge: q.Get("code_challenge"), claims: tok}
+	iss.mu.Unlock()
+	return code, q.Get("state"), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (iss *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"issuer":                 iss.URL,
+		"authorization_endpoint": iss.URL + "/authorize",
+		"token_endpoint":         iss.URL + "/token",
+		"jwks_uri":               iss.URL + "/jwks",
+	})
+}
+
+func (iss *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	iss.mu.Lock()
+	jwk, err := utils.NewJWK(iss.kid, "RS256", &iss.key.PublicKey)
+	iss.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, utils.JWKSet{Keys: []utils.JWK{jwk}})
+}
+
+func (iss *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	fail := func(code, desc string) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": code, "error_description": desc})
+	}
+	if r.Method != http.MethodPost || r.ParseForm() != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		fail("invalid_request", "bad token request")
+		return
+	}
+	id, secret, _ := r.BasicAuth()
+	if id != iss.ClientID || secret != iss.ClientSecret {
+		fail("invalid_client", "bad client credentials")
+		return
+	}
+	iss.mu.Lock()
+	g, ok := iss.codes[r.PostForm.Get("code")]
+	delete(iss.codes, r.PostForm.Get("code"))
+	key, kid := iss.key, iss.kid
+	iss.mu.Unlock()
+	if !ok {
+		fail("invalid_grant", "unknown code")
+		return
+	}
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		fail("invalid_grant", "PKCE verification failed")
+		return
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, g.claims)
+	t.Header["kid"] = kid
+	signed, err := t.SignedString(key)
+	if err != nil {
+		fail("server_error", err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"access_token": "unused", "token_type": "Bearer", "id_token": signed})
+}
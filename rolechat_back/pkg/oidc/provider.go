@@ -0,0 +1,259 @@
+// Package oidc signs users in with an OpenID Connect provider using the
+// authorization code flow with PKCE. Endpoints and keys come from the
+// issuer's discovery document, so any standards-compliant provider works.
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"rolechat_back/pkg/utils"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// discoveryTTL is how long discovery documents and keys are cached. An ID
+// token signed with an unknown kid refreshes the keys early, so rotation at
+// the provider is picked up.
+const discoveryTTL = time.Hour
+
+// Config configures one provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string // defaults to openid, email and profile
+}
+
+// Claims is the part of an ID token RoleChat uses.
+type Claims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider talks to one issuer. It is safe for concurrent use.
+type Provider struct {
+	cfg    Config
+	client *http.Client
+
+	mu        sync.Mutex
+	meta      *discovery
+	keys      map[string]any // kid -> public key
+	fetchedAt time.Time
+}
+
+// NewProvider returns a provider that fetches discovery lazily with client,
+// or a client with a 10 second timeout when client is nil.
+func NewProvider(cfg Config, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	cfg.Issuer = strings.TrimRight(cfg.Issuer, "/")
+	return &Provider{cfg: cfg, client: client}
+}
+
+func (p *Provider) getJSON(ctx context.Context, endpoint string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", endpoint, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// load fetches the discovery document and keys when they are missing,
+// stale, or force is set.
+func (p *Provider) load(ctx context.Context, force bool) (*discovery, map[string]any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil && !force && time.Since(p.fetchedAt) < discoveryTTL {
+		return p.meta, p.keys, nil
+	}
+	var meta discovery
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if strings.TrimRight(meta.Issuer, "/") != p.cfg.Issuer {
+		return nil, nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", meta.Issuer, p.cfg.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, nil, errors.New("oidc discovery: missing endpoints")
+	}
+	var set utils.JWKSet
+	if err := p.getJSON(ctx, meta.JWKSURI, &set); err != nil {
+		return nil, nil, fmt.Errorf("oidc keys: %w", err)
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if pub, err := k.PublicKey(); err == nil {
+			keys[k.Kid] = pub
+		}
+	}
+	p.meta, p.keys, p.fetchedAt = &meta, keys, time.Now()
+	return p.meta, p.keys, nil
+}
+
+// PKCEChallenge is the S256 code challenge for verifier.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL is where the user is sent to sign in. state, nonce and the
+// PKCE verifier must be kept by the caller for Exchange.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, _, err := p.load(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", PKCEChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// Exchange redeems the authorization code and returns the verified claims
+// of the ID token.
+func (p *Provider) Exchange(ctx context.Context, code, nonce, verifier string) (*Claims, error) {
+	meta, _, err := p.load(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("code_verifier", verifier)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tok); err != nil {
+		return nil, fmt.Errorf("oidc token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tok.IDToken == "" {
+		return nil, fmt.Errorf("oidc token exchange failed: %s %s", tok.Error, tok.ErrorDescription)
+	}
+	return p.verifyIDToken(ctx, tok.IDToken, nonce)
+}
+
+type idTokenClaims struct {
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"` // some providers send "true"
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+	jwt.RegisteredClaims
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, raw, nonce string) (*Claims, error) {
+	keyFunc := func(refreshed bool) jwt.Keyfunc {
+		return func(t *jwt.Token) (any, error) {
+			kid, _ := t.Header["kid"].(string)
+			_, keys, err := p.load(ctx, refreshed)
+			if err != nil {
+				return nil, err
+			}
+			if key, ok := keys[kid]; ok {
+				return key, nil
+			}
+			if kid == "" && len(keys) == 1 {
+				for _, key := range keys {
+					return key, nil
+				}
+			}
+			return nil, errUnknownKey
+		}
+	}
+	meta, _, err := p.load(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(meta.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(time.Minute),
+	}
+	var claims idTokenClaims
+	_, err = jwt.ParseWithClaims(raw, &claims, keyFunc(false), opts...)
+	if errors.Is(err, errUnknownKey) {
+		claims = idTokenClaims{}
+		_, err = jwt.ParseWithClaims(raw, &claims, keyFunc(true), opts...)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid id token: %w", err)
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("invalid id token: nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("invalid id token: no subject")
+	}
+	verified := false
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		verified = v
+	case string:
+		verified = v == "true"
+	}
+	return &Claims{Subject: claims.Subject, Email: claims.Email, EmailVerified: verified, Name: claims.Name}, nil
+}
+
+var errUnknownKey = errors.New("unknown signing key")
@@ -0,0 +1,140 @@
+package oidc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"rolechat_back/pkg/oidc/oidctest"
+)
+
+func newTestProvider(t *testing.T) (*oidctest.Issuer, *Provider) {
+	t.Helper()
+	iss := oidctest.NewIssuer("client", "secret")
+	t.Cleanup(iss.Close)
+	p := NewProvider(Config{
+		Issuer:       iss.URL + "/",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RedirectURL:  "https://rolechat.example/api/auth/oidc/test/callback",
+	}, iss.Client())
+	return iss, p
+}
+
+// signIn runs the flow up to Exchange with the given ID token claims.
+func signIn(t *testing.T, iss *oidctest.Issuer, p *Provider, claims map[string]any, verifier string) (*Claims, error) {
+	t.Helper()
+	ctx := context.Background()
+	authURL, err := p.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state, err := iss.Authorize(authURL, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != "state" {
+		t.Fatalf("state = %q, want %q", state, "state")
+	}
+	return p.Exchange(ctx, code, "nonce", verifier)
+}
+
+func TestExchange(t *testing.T) {
+	iss, p := newTestProvider(t)
+	claims, err := signIn(t, iss, p, map[string]any{
+		"sub":            "user-1",
+		"email":          "a@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}, "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Claims{Subject: "user-1", Email: "a@example.com", EmailVerified: true, Name: "Alice"}
+	if *claims != want {
+		t.Fatalf("claims = %+v, want %+v", *claims, want)
+	}
+}
+
+func TestExchangeEmailVerified(t *testing.T) {
+	tests := []struct {
+		name     string
+		verified any
+		want     bool
+	}{
+		{"bool true", true, true},
+		{"string true", "true", true},
+		{"bool false", false, false},
+		{"string false", "false", false},
+		{"missing", nil, false},
+	}
+	iss, p := newTestProvider(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := signIn(t, iss, p, map[string]any{"sub": "u", "email": "a@example.com", "email_verified": tt.verified}, "verifier")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims.EmailVerified != tt.want {
+				t.Fatalf("EmailVerified = %v, want %v", claims.EmailVerified, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   map[string]any
+		verifier string
+		want     string
+	}{
+		{"nonce", map[string]any{"sub": "u", "nonce": "other"}, "verifier", "nonce mismatch"},
+		{"missing nonce", map[string]any{"sub": "u", "nonce": nil}, "verifier", "nonce mismatch"},
+		{"audience", map[string]any{"sub": "u", "aud": "someone-else"}, "verifier", "invalid id token"},
+		{"issuer", map[string]any{"sub": "u", "iss": "https://evil.example"}, "verifier", "invalid id token"},
+		{"expired", map[string]any{"sub": "u", "exp": time.Now().Add(-time.Hour).Unix()}, "verifier", "invalid id token"},
+		{"no expiry", map[string]any{"sub": "u", "exp": nil}, "verifier", "invalid id token"},
+		{"no subject", map[string]any{}, "verifier", "no subject"},
+		{"pkce verifier", map[string]any{"sub": "u"}, "wrong", "token exchange failed"},
+	}
+	iss, p := newTestProvider(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := signIn(t, iss, p, tt.claims, tt.verifier)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeAfterKeyRotation(t *testing.T) {
+	iss, p := newTestProvider(t)
+	ctx := context.Background()
+	authURL, err := p.AuthCodeURL(ctx, "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The provider has cached the old key; the new kid makes it refetch.
+	iss.Rotate()
+	code, _, err := iss.Authorize(authURL, map[string]any{"sub": "u"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(ctx, code, "nonce", "verifier"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	iss := oidctest.NewIssuer("client", "secret")
+	defer iss.Close()
+	// Same server, but the discovery document names a different issuer.
+	p := NewProvider(Config{Issuer: strings.Replace(iss.URL, "127.0.0.1", "localhost", 1), ClientID: "client"}, iss.Client())
+	_, err := p.AuthCodeURL(context.Background(), "s", "n", "v")
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("err = %v, want an issuer mismatch", err)
+	}
+}
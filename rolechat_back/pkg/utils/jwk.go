@@ -0,0 +1,121 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWK is a public key in JSON Web Key form (RFC 7517). Only the members
+// needed for RSA, EC and Ed25519 signature keys are kept.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served at a jwks_uri.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK encodes an RSA, EC or Ed25519 public key as a signature key.
+func NewJWK(kid, alg string, pub crypto.PublicKey) (JWK, error) {
+	k := JWK{Kid: kid, Use: "sig", Alg: alg}
+	enc := base64.RawURLEncoding.EncodeToString
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		k.Kty = "RSA"
+		k.N = enc(p.N.Bytes())
+		k.E = enc(big.NewInt(int64(p.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (p.Curve.Params().BitSize + 7) / 8
+		k.Kty = "EC"
+		k.Crv = p.Curve.Params().Name
+		k.X = enc(p.X.FillBytes(make([]byte, size)))
+		k.Y = enc(p.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		k.Kty = "OKP"
+		k.Crv = "Ed25519"
+		k.X = enc(p)
+	default:
+		return JWK{}, fmt.Errorf("unsupported public key %T", pub)
+	}
+	return k, nil
+}
+
+func decodeB64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// PublicKey returns the key as an *rsa.PublicKey, *ecdsa.PublicKey or
+// ed25519.PublicKey.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeB64(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeB64(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeB64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeB64(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid EC key")
+		}
+		return pub, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeB64(k.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -11,10 +11,12 @@ type JWTClaims struct {
 	Role      string `json:"role"`
 	Status    string `json:"status"`
 	TokenType string `json:"token_type"`
+	SessionID string `json:"sid,omitempty"` // access tokens: jti of the refresh token they were issued with
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(userID uint, role, status, tokenType, secret, jti string, expires time.Duration) (string, error) {
+// GenerateToken signs a token with the active key of keys.
+func GenerateToken(userID uint, role, status, tokenType string, keys *KeySet, jti, sid string, expires time.Duration) (string, error) {
 	if expires <= 0 {
 		expires = 15 * time.Minute
 	}
@@ -23,6 +25,7 @@ func GenerateToken(userID uint, role, status, tokenType, secret, jti string, exp
 		Role:      role,
 		Status:    status,
 		TokenType: tokenType,
+		SessionID: sid,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expires)),
@@ -30,14 +33,13 @@ func GenerateToken(userID uint, role, status, tokenType, secret, jti string, exp
 			NotBefore: jwt.NewNumericDate(time.Now()),
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return keys.Sign(claims)
 }
 
-func ValidateToken(tokenString, secret string) (*JWTClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+// ValidateToken accepts tokens signed by any key of keys with that key's
+// algorithm.
+func ValidateToken(tokenString string, keys *KeySet) (*JWTClaims, error) {
+	token, err := keys.Parse(tokenString, &JWTClaims{})
 
 	if err != nil {
 		return nil, err
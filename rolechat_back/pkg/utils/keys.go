@@ -0,0 +1,181 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// minRSABits is the smallest RSA modulus accepted for signing keys.
+const minRSABits = 2048
+
+// SigningKey is one key of a KeySet. Keys loaded from a public key alone
+// only verify; they are kept during rotation until tokens they signed have
+// expired.
+type SigningKey struct {
+	ID     string
+	Method jwt.SigningMethod
+	sign   any // private key or HMAC secret; nil for verification-only keys
+	verify any
+}
+
+// NewHMACKey returns an HS256 key. With an empty id tokens carry no kid,
+// as they did before keys had ids.
+func NewHMACKey(id, secret string) *SigningKey {
+	return &SigningKey{ID: id, Method: jwt.SigningMethodHS256, sign: []byte(secret), verify: []byte(secret)}
+}
+
+// LoadSigningKey reads an RSA or Ed25519 key from PEM files. The private key
+// (PKCS#8, or PKCS#1 for RSA) signs with RS256 or EdDSA; if only the public
+// key (PKIX) is given the key only verifies.
+func LoadSigningKey(id, privateFile, publicFile string) (*SigningKey, error) {
+	if id == "" {
+		return nil, errors.New("signing key id required")
+	}
+	var (
+		priv crypto.Signer
+		pub  crypto.PublicKey
+	)
+	switch {
+	case privateFile != "":
+		block, err := readPEM(privateFile)
+		if err != nil {
+			return nil, err
+		}
+		var key any
+		if block.Type == "RSA PRIVATE KEY" {
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		} else {
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("key %s: unsupported private key", id)
+		}
+		priv, pub = signer, signer.Public()
+	case publicFile != "":
+		block, err := readPEM(publicFile)
+		if err != nil {
+			return nil, err
+		}
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("key %s: %w", id, err)
+		}
+	default:
+		return nil, fmt.Errorf("key %s: private_key_file or public_key_file required", id)
+	}
+
+	k := &SigningKey{ID: id, verify: pub}
+	switch p := pub.(type) {
+	case *rsa.PublicKey:
+		if p.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("key %s: RSA keys must have at least %d bits", id, minRSABits)
+		}
+		k.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		k.Method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("key %s: only RSA and Ed25519 keys are supported", id)
+	}
+	if priv != nil {
+		k.sign = priv
+	}
+	return k, nil
+}
+
+func readPEM(file string) (*pem.Block, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", file)
+	}
+	return block, nil
+}
+
+// KeySet signs tokens with its active key and verifies them with whichever
+// key the token's kid names, so keys can be rotated without invalidating
+// tokens already issued: add the new key, make it active once verifiers
+// have fetched it, and drop the old one after its tokens expire.
+type KeySet struct {
+	active  *SigningKey
+	keys    map[string]*SigningKey
+	methods []string
+}
+
+// NewKeySet returns a set that signs with the key named activeID.
+func NewKeySet(activeID string, keys ...*SigningKey) (*KeySet, error) {
+	ks := &KeySet{keys: make(map[string]*SigningKey, len(keys))}
+	for _, k := range keys {
+		if _, dup := ks.keys[k.ID]; dup {
+			return nil, fmt.Errorf("duplicate signing key id %q", k.ID)
+		}
+		ks.keys[k.ID] = k
+		if !slices.Contains(ks.methods, k.Method.Alg()) {
+			ks.methods = append(ks.methods, k.Method.Alg())
+		}
+	}
+	ks.active = ks.keys[activeID]
+	if ks.active == nil {
+		return nil, fmt.Errorf("active signing key %q not found", activeID)
+	}
+	if ks.active.sign == nil {
+		return nil, fmt.Errorf("active signing key %q has no private key", activeID)
+	}
+	return ks, nil
+}
+
+// Sign signs claims with the active key and names it in the kid header.
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.active.Method, claims)
+	if ks.active.ID != "" {
+		token.Header["kid"] = ks.active.ID
+	}
+	return token.SignedString(ks.active.sign)
+}
+
+// Parse verifies tokenString into claims. The token must be signed with the
+// algorithm of the key its kid names; the alg header alone is never trusted.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		k, ok := ks.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if t.Method.Alg() != k.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return k.verify, nil
+	}, jwt.WithValidMethods(ks.methods), jwt.WithExpirationRequired())
+}
+
+// JWKS lists the public keys of the set for /.well-known/jwks.json. HMAC
+// keys are secret and never listed.
+func (ks *KeySet) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, k := range ks.keys {
+		if _, secret := k.verify.([]byte); secret {
+			continue
+		}
+		if jwk, err := NewJWK(k.ID, k.Method.Alg(), k.verify); err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	slices.SortFunc(set.Keys, func(a, b JWK) int { return strings.Compare(a.Kid, b.Kid) })
+	return set
+}
@@ -0,0 +1,246 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// rsaKeyFiles returns PEM files for a new RSA key: the private key in
+// PKCS#1 and the public key in PKIX form.
+func rsaKeyFiles(t *testing.T, bits int) (priv, pub string, pubPEM []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub = writePEM(t, "rsa.pub.pem", "PUBLIC KEY", der)
+	pubPEM, _ = os.ReadFile(pub)
+	return writePEM(t, "rsa.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)), pub, pubPEM
+}
+
+func ed25519KeyFile(t *testing.T) (string, ed25519.PrivateKey) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, "ed.pem", "PRIVATE KEY", der), key
+}
+
+func testClaims() *JWTClaims {
+	return &JWTClaims{UserID: 7, TokenType: "access", RegisteredClaims: jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}}
+}
+
+func mustKey(t *testing.T) func(*SigningKey, error) *SigningKey {
+	return func(k *SigningKey, err error) *SigningKey {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	must := mustKey(t)
+	oldPriv, _, _ := rsaKeyFiles(t, 2048)
+	edFile, _ := ed25519KeyFile(t)
+	old := must(LoadSigningKey("old", oldPriv, ""))
+
+	before, err := NewKeySet("old", old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := before.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key signs; the old one still verifies what it signed.
+	after, err := NewKeySet("new", old, must(LoadSigningKey("new", edFile, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims, err := ValidateToken(token, after); err != nil || claims.UserID != 7 {
+		t.Fatalf("old token after rotation: %v, %v", claims, err)
+	}
+	fresh, err := after.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := after.Parse(fresh, &JWTClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "new" || parsed.Method.Alg() != "EdDSA" {
+		t.Fatalf("new token kid %v alg %s", parsed.Header["kid"], parsed.Method.Alg())
+	}
+	if _, err := ValidateToken(fresh, before); err == nil {
+		t.Fatal("token of an unknown key accepted")
+	}
+}
+
+func TestKeySetParseRejects(t *testing.T) {
+	must := mustKey(t)
+	rsaPriv, _, rsaPubPEM := rsaKeyFiles(t, 2048)
+	edFile, edKey := ed25519KeyFile(t)
+	// The legacy HMAC key makes HS256 an accepted method overall, so only
+	// the per-key check stops the forgeries below.
+	keys, err := NewKeySet("rsa",
+		must(LoadSigningKey("rsa", rsaPriv, "")),
+		must(LoadSigningKey("ed", edFile, "")),
+		NewHMACKey("", "legacy-secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(method jwt.SigningMethod, kid any, key any, claims jwt.Claims) string {
+		t.Helper()
+		tok := jwt.NewWithClaims(method, claims)
+		if kid != nil {
+			tok.Header["kid"] = kid
+		}
+		s, err := tok.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	noExp := &JWTClaims{UserID: 7}
+	tests := []struct {
+		name, token, want string
+	}{
+		{"unknown kid", sign(jwt.SigningMethodEdDSA, "other", edKey, testClaims()), "unknown signing key"},
+		{"kid of another algorithm", sign(jwt.SigningMethodEdDSA, "rsa", edKey, testClaims()), "unexpected signing method"},
+		{"hmac with the rsa public key", sign(jwt.SigningMethodHS256, "rsa", rsaPubPEM, testClaims()), "unexpected signing method"},
+		{"hmac without kid, wrong secret", sign(jwt.SigningMethodHS256, nil, rsaPubPEM, testClaims()), "signature is invalid"},
+		// A kid that is not a string falls back to the legacy key.
+		{"non-string kid", sign(jwt.SigningMethodEdDSA, 5, edKey, testClaims()), "unexpected signing method"},
+		{"no expiry", sign(jwt.SigningMethodEdDSA, "ed", edKey, noExp), "exp claim is required"},
+		{"alg none", sign(jwt.SigningMethodNone, "ed", jwt.UnsafeAllowNoneSignatureType, testClaims()), "signing method none is invalid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := keys.Parse(tt.token, &JWTClaims{})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want %q", err, tt.want)
+			}
+		})
+	}
+
+	// Without an HMAC key in the set HS256 is refused outright.
+	rsaOnly, err := NewKeySet("rsa", must(LoadSigningKey("rsa", rsaPriv, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := sign(jwt.SigningMethodHS256, "rsa", rsaPubPEM, testClaims())
+	if _, err := rsaOnly.Parse(forged, &JWTClaims{}); err == nil || !strings.Contains(err.Error(), "signing method HS256 is invalid") {
+		t.Fatalf("forged HS256 token: err = %v", err)
+	}
+}
+
+func TestKeySetLegacyHMAC(t *testing.T) {
+	legacy, err := NewKeySet("", NewHMACKey("", "secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := GenerateToken(7, "user", "active", "access", legacy, "jti", "sid", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := legacy.Parse(token, &JWTClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := parsed.Header["kid"]; ok {
+		t.Fatalf("legacy token has kid %v", parsed.Header["kid"])
+	}
+	claims := parsed.Claims.(*JWTClaims)
+	if claims.UserID != 7 || claims.ID != "jti" || claims.SessionID != "sid" {
+		t.Fatalf("claims = %+v", claims)
+	}
+	other, _ := NewKeySet("", NewHMACKey("", "other"))
+	if _, err := ValidateToken(token, other); err == nil {
+		t.Fatal("token accepted with the wrong secret")
+	}
+}
+
+func TestKeySetJWKS(t *testing.T) {
+	must := mustKey(t)
+	rsaPriv, rsaPub, _ := rsaKeyFiles(t, 2048)
+	edFile, _ := ed25519KeyFile(t)
+	keys, err := NewKeySet("b-ed",
+		NewHMACKey("", "secret"),
+		must(LoadSigningKey("c-rsa", rsaPriv, "")),
+		must(LoadSigningKey("a-rsa-old", "", rsaPub)),
+		must(LoadSigningKey("b-ed", edFile, "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	set := keys.JWKS()
+	var got []string
+	for _, k := range set.Keys {
+		got = append(got, k.Kid+":"+k.Kty+":"+k.Alg)
+	}
+	want := "a-rsa-old:RSA:RS256,b-ed:OKP:EdDSA,c-rsa:RSA:RS256"
+	if strings.Join(got, ",") != want {
+		t.Fatalf("JWKS = %v, want %s", got, want)
+	}
+
+	hmacOnly, _ := NewKeySet("", NewHMACKey("", "secret"))
+	if n := len(hmacOnly.JWKS().Keys); n != 0 {
+		t.Fatalf("HMAC-only set publishes %d keys", n)
+	}
+}
+
+func TestKeySetConfigErrors(t *testing.T) {
+	must := mustKey(t)
+	rsaPriv, rsaPub, _ := rsaKeyFiles(t, 2048)
+	smallPriv, _, _ := rsaKeyFiles(t, 1024)
+	if _, err := LoadSigningKey("", rsaPriv, ""); err == nil {
+		t.Error("key without id accepted")
+	}
+	if _, err := LoadSigningKey("small", smallPriv, ""); err == nil || !strings.Contains(err.Error(), "at least 2048 bits") {
+		t.Errorf("1024-bit key: err = %v", err)
+	}
+	if _, err := LoadSigningKey("none", "", ""); err == nil {
+		t.Error("key without files accepted")
+	}
+	if _, err := NewKeySet("pub", must(LoadSigningKey("pub", "", rsaPub))); err == nil || !strings.Contains(err.Error(), "no private key") {
+		t.Errorf("verification-only active key: err = %v", err)
+	}
+	if _, err := NewKeySet("missing", must(LoadSigningKey("a", rsaPriv, ""))); err == nil {
+		t.Error("missing active key accepted")
+	}
+	if _, err := NewKeySet("a", must(LoadSigningKey("a", rsaPriv, "")), must(LoadSigningKey("a", "", rsaPub))); err == nil {
+		t.Error("duplicate key id accepted")
+	}
+}
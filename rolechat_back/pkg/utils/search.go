@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PostgreSQL's built-in text search configurations split on whitespace and
+// punctuation, which leaves an entire Chinese sentence as a single lexeme.
+// Text is therefore segmented here instead: latin words are kept whole and
+// CJK runs are indexed as unigrams plus overlapping bigrams, which needs no
+// server-side extension and still matches arbitrary substrings.
+
+const (
+	maxLexemePositions = 256
+	maxLexemePosition  = 16383
+	maxWordRunes       = 100
+)
+
+type textRun struct {
+	text string
+	cjk  bool
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func splitRuns(text string) []textRun {
+	var (
+		runs []textRun
+		cur  []rune
+		cjk  bool
+	)
+	flush := func() {
+		if len(cur) > 0 {
+			runs = append(runs, textRun{text: string(cur), cjk: cjk})
+			cur = cur[:0]
+		}
+	}
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			if !cjk {
+				flush()
+			}
+			cjk = true
+			cur = append(cur, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if cjk {
+				flush()
+			}
+			cjk = false
+			cur = append(cur, unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+	return runs
+}
+
+func quoteLexeme(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// SearchVector returns a tsvector literal for text, to be cast with ::tsvector.
+func SearchVector(text string) string {
+	positions := map[string][]int{}
+	pos := 1
+	add := func(lex string, p int) {
+		if len(positions[lex]) < maxLexemePositions {
+			positions[lex] = append(positions[lex], p)
+		}
+	}
+	for _, run := range splitRuns(text) {
+		if pos > maxLexemePosition {
+			break
+		}
+		if !run.cjk {
+			if utf8.RuneCountInString(run.text) <= maxWordRunes {
+				add(run.text, pos)
+			}
+			pos++
+			continue
+		}
+		rs := []rune(run.text)
+		for i := range rs {
+			if pos > maxLexemePosition {
+				break
+			}
+			add(string(rs[i]), pos)
+			if i+1 < len(rs) {
+				add(string(rs[i:i+2]), pos)
+			}
+			pos++
+		}
+	}
+	lexemes := make([]string, 0, len(positions))
+	for lex := range positions {
+		lexemes = append(lexemes, lex)
+	}
+	sort.Strings(lexemes)
+	var b strings.Builder
+	for i, lex := range lexemes {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(quoteLexeme(lex))
+		b.WriteByte(':')
+		for j, p := range positions[lex] {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(strconv.Itoa(p))
+		}
+	}
+	return b.String()
+}
+
+// SearchQuery turns user input into a tsquery literal matching SearchVector,
+// plus the normalised terms used for highlighting. Every term must match;
+// CJK terms match as phrases, latin words as prefixes.
+func SearchQuery(query string) (string, []string) {
+	var (
+		groups []string
+		terms  []string
+	)
+	for _, run := range splitRuns(query) {
+		terms = append(terms, run.text)
+		if !run.cjk {
+			groups = append(groups, quoteLexeme(run.text)+":*")
+			continue
+		}
+		rs := []rune(run.text)
+		if len(rs) == 1 {
+			groups = append(groups, quoteLexeme(run.text))
+			continue
+		}
+		bigrams := make([]string, 0, len(rs)-1)
+		for i := 0; i+1 < len(rs); i++ {
+			bigrams = append(bigrams, quoteLexeme(string(rs[i:i+2])))
+		}
+		groups = append(groups, "("+strings.Join(bigrams, " <-> ")+")")
+	}
+	return strings.Join(groups, " & "), terms
+}
+
+// HighlightSnippet cuts a window of about radius runes on each side of the
+// first matching term and wraps every term occurrence in <mark>. The rest of
+// the text is HTML-escaped so the snippet can be rendered as-is.
+func HighlightSnippet(text string, terms []string, radius int) string {
+	rs := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	if len(lower) != len(rs) {
+		lower = rs
+	}
+	type span struct{ start, end int }
+	var spans []span
+	for _, term := range terms {
+		tr := []rune(term)
+		if len(tr) == 0 {
+			continue
+		}
+		for i := 0; i+len(tr) <= len(lower); i++ {
+			if string(lower[i:i+len(tr)]) == term {
+				spans = append(spans, span{i, i + len(tr)})
+				i += len(tr) - 1
+			}
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+
+	start, end := 0, len(rs)
+	if len(spans) > 0 {
+		start = max(spans[0].start-radius, 0)
+		end = min(spans[0].end+radius, len(rs))
+	} else if end > 2*radius {
+		end = 2 * radius
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	cur := start
+	for _, sp := range spans {
+		if sp.start < cur || sp.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(rs[cur:sp.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(rs[sp.start:sp.end])))
+		b.WriteString("</mark>")
+		cur = sp.end
+	}
+	b.WriteString(html.EscapeString(string(rs[cur:end])))
+	if end < len(rs) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
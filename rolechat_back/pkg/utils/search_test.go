@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearchVector(t *testing.T) {
+	tests := []struct {
+		name, text, want string
+	}{
+		{"empty", "", ""},
+		{"latin words", "Hello, hello world!", "'hello':1,2 'world':3"},
+		{"cjk bigrams", "你好世界", "'世':3 '世界':3 '你':1 '你好':1 '好':2 '好世':2 '界':4"},
+		{"mixed runs", "Go语言", "'go':1 '言':3 '语':2 '语言':2"},
+		{"punctuation splits cjk", "猫。狗", "'狗':2 '猫':1"},
+		{"kana and hangul", "ねこ고양", "'こ':2 'こ고':2 'ね':1 'ねこ':1 '고':3 '고양':3 '양':4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SearchVector(tt.text); got != tt.want {
+				t.Fatalf("SearchVector(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchVectorLimits(t *testing.T) {
+	long := make([]byte, maxWordRunes+1)
+	for i := range long {
+		long[i] = 'a'
+	}
+	// An overlong word is skipped but still takes a position.
+	if got, want := SearchVector(string(long)+" ok"), "'ok':2"; got != want {
+		t.Fatalf("SearchVector(long word) = %q, want %q", got, want)
+	}
+}
+
+func TestSearchQuery(t *testing.T) {
+	tests := []struct {
+		name, query, want string
+		terms             []string
+	}{
+		{"empty", "  ", "", nil},
+		{"latin prefix", "Hel", "'hel':*", []string{"hel"}},
+		{"single cjk rune", "猫", "'猫'", []string{"猫"}},
+		{"cjk phrase", "你好世界", "('你好' <-> '好世' <-> '世界')", []string{"你好世界"}},
+		{"all terms required", "角色 chat", "('角色') & 'chat':*", []string{"角色", "chat"}},
+		{"quotes are separators", "it's", "'it':* & 's':*", []string{"it", "s"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, terms := SearchQuery(tt.query)
+			if got != tt.want || !reflect.DeepEqual(terms, tt.terms) {
+				t.Fatalf("SearchQuery(%q) = %q, %q; want %q, %q", tt.query, got, terms, tt.want, tt.terms)
+			}
+		})
+	}
+}
+
+func TestQuoteLexeme(t *testing.T) {
+	if got, want := quoteLexeme(`a'b\c`), `'a''b\\c'`; got != want {
+		t.Fatalf("quoteLexeme = %s, want %s", got, want)
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		name, text string
+		terms      []string
+		radius     int
+		want       string
+	}{
+		{"escapes html", "Hello <b>World</b>", []string{"world"}, 100, "Hello &lt;b&gt;<mark>World</mark>&lt;/b&gt;"},
+		{"window around first hit", "0123456789猫0123456789", []string{"猫"}, 2, "…89<mark>猫</mark>01…"},
+		{"every occurrence", "猫和猫", []string{"猫"}, 10, "<mark>猫</mark>和<mark>猫</mark>"},
+		{"no hit", "abcdefgh", []string{"zz"}, 2, "abcd…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := HighlightSnippet(tt.text, tt.terms, tt.radius); got != tt.want {
+				t.Fatalf("HighlightSnippet() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}